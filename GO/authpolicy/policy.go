@@ -0,0 +1,80 @@
+// Package authpolicy reads the access policy that every RPC declares with the (auth) method option.
+package authpolicy
+
+import (
+	"fmt"
+	"log"
+	pb "pcbook/generateProto"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+// Load returns the policy of every method of the given services, keyed by full method name
+// such as "/techschool.pcbook.LaptopService/CreateLaptop".
+// Methods that declare no policy are logged and left out, so that they are denied.
+func Load(serviceNames ...string) (map[string]*pb.AuthPolicy, error) {
+	policies := make(map[string]*pb.AuthPolicy)
+
+	for _, serviceName := range serviceNames {
+		descriptor, err := protoregistry.GlobalFiles.FindDescriptorByName(protoreflect.FullName(serviceName))
+		if err != nil {
+			return nil, fmt.Errorf("cannot find service %s: %w", serviceName, err)
+		}
+
+		service, ok := descriptor.(protoreflect.ServiceDescriptor)
+		if !ok {
+			return nil, fmt.Errorf("%s is not a service", serviceName)
+		}
+
+		methods := service.Methods()
+		for i := 0; i < methods.Len(); i++ {
+			method := methods.Get(i)
+			fullMethod := fmt.Sprintf("/%s/%s", service.FullName(), method.Name())
+
+			policy := Of(method)
+			if policy == nil {
+				log.Printf("WARNING: %s declares no auth policy and will be denied", fullMethod)
+				continue
+			}
+
+			policies[fullMethod] = policy
+		}
+	}
+
+	return policies, nil
+}
+
+// Of returns the policy declared by a method, or nil if it declares none.
+func Of(method protoreflect.MethodDescriptor) *pb.AuthPolicy {
+	options := method.Options()
+	if options == nil || !proto.HasExtension(options, pb.E_Auth) {
+		return nil
+	}
+
+	policy, ok := proto.GetExtension(options, pb.E_Auth).(*pb.AuthPolicy)
+	if !ok || policy == nil {
+		return nil
+	}
+	return policy
+}
+
+// Permits reports whether a caller with the given scopes may call a method with the policy.
+func Permits(policy *pb.AuthPolicy, scopes []string) bool {
+	if policy.GetPublic() {
+		return true
+	}
+
+	granted := make(map[string]bool, len(scopes))
+	for _, scope := range scopes {
+		granted[scope] = true
+	}
+
+	for _, scope := range policy.GetScopes() {
+		if !granted[scope] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,147 @@
+package authpolicy_test
+
+import (
+	"pcbook/authpolicy"
+	pb "pcbook/generateProto"
+	"pcbook/service"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+func TestLoad(t *testing.T) {
+	t.Parallel()
+
+	serviceDescs := []grpc.ServiceDesc{
+		pb.AuthService_ServiceDesc,
+		pb.LaptopService_ServiceDesc,
+		pb.ReviewService_ServiceDesc,
+	}
+
+	serviceNames := []string{}
+	methods := 0
+	for _, desc := range serviceDescs {
+		serviceNames = append(serviceNames, desc.ServiceName)
+		methods += len(desc.Methods) + len(desc.Streams)
+	}
+
+	policies, err := authpolicy.Load(serviceNames...)
+	require.NoError(t, err)
+
+	// every method must declare a policy, otherwise it is denied to everyone
+	require.Len(t, policies, methods)
+
+	require.True(t, policies["/techschool.pcbook.AuthService/Login"].GetPublic())
+	require.True(t, policies["/techschool.pcbook.LaptopService/SearchLaptop"].GetPublic())
+	require.Equal(t, []string{"laptops:write"}, policies["/techschool.pcbook.LaptopService/CreateLaptop"].GetScopes())
+	require.Equal(t, []string{"ratings:write"}, policies["/techschool.pcbook.LaptopService/RateLaptop"].GetScopes())
+
+	_, err = authpolicy.Load("techschool.pcbook.UnknownService")
+	require.Error(t, err)
+}
+
+func TestDefaultRoleAccess(t *testing.T) {
+	t.Parallel()
+
+	policies, err := authpolicy.Load(
+		pb.AuthService_ServiceDesc.ServiceName,
+		pb.LaptopService_ServiceDesc.ServiceName,
+		pb.ReviewService_ServiceDesc.ServiceName,
+	)
+	require.NoError(t, err)
+
+	userMethods := []string{
+		"/techschool.pcbook.AuthService/ChangePassword",
+		"/techschool.pcbook.AuthService/ConfirmTOTP",
+		"/techschool.pcbook.AuthService/EnrollTOTP",
+		"/techschool.pcbook.LaptopService/GetMyRatings",
+		"/techschool.pcbook.LaptopService/RateLaptop",
+		"/techschool.pcbook.LaptopService/RetractRating",
+		"/techschool.pcbook.ReviewService/ListReviews",
+		"/techschool.pcbook.ReviewService/SubmitReview",
+	}
+	requireRoleAccess(t, policies, service.DefaultRoles, service.UserRole, userMethods...)
+
+	// vendors inherit everything users can do
+	vendorMethods := append([]string{
+		"/techschool.pcbook.LaptopService/CreateLaptop",
+		"/techschool.pcbook.LaptopService/DeleteImage",
+		"/techschool.pcbook.LaptopService/DeleteLaptop",
+		"/techschool.pcbook.LaptopService/SetPrimaryImage",
+		"/techschool.pcbook.LaptopService/UploadImage",
+	}, userMethods...)
+	requireRoleAccess(t, policies, service.DefaultRoles, service.VendorRole, vendorMethods...)
+
+	// admins inherit everything vendors can do
+	adminMethods := append([]string{
+		"/techschool.pcbook.AuthService/CreateApiKey",
+		"/techschool.pcbook.AuthService/CreateUser",
+		"/techschool.pcbook.AuthService/DeleteUser",
+		"/techschool.pcbook.AuthService/ListApiKeys",
+		"/techschool.pcbook.AuthService/ListUsers",
+		"/techschool.pcbook.AuthService/QueryAuditLog",
+		"/techschool.pcbook.AuthService/RevokeApiKey",
+		"/techschool.pcbook.AuthService/SetUserRole",
+		"/techschool.pcbook.ReviewService/ModerateReview",
+	}, vendorMethods...)
+	requireRoleAccess(t, policies, service.DefaultRoles, service.AdminRole, adminMethods...)
+}
+
+func TestCustomRoleAccess(t *testing.T) {
+	t.Parallel()
+
+	policies, err := authpolicy.Load(pb.LaptopService_ServiceDesc.ServiceName)
+	require.NoError(t, err)
+
+	roles, err := service.NewRoles(map[string]service.RoleDefinition{
+		"viewer":   {Scopes: []string{service.ScopeRatingsRead}},
+		"importer": {Inherits: []string{"viewer"}, Scopes: []string{service.ScopeLaptopsWrite, service.ScopeImagesWrite}},
+	})
+	require.NoError(t, err)
+
+	requireRoleAccess(t, policies, roles, "viewer",
+		"/techschool.pcbook.LaptopService/GetMyRatings",
+	)
+	requireRoleAccess(t, policies, roles, "importer",
+		"/techschool.pcbook.LaptopService/CreateLaptop",
+		"/techschool.pcbook.LaptopService/DeleteImage",
+		"/techschool.pcbook.LaptopService/DeleteLaptop",
+		"/techschool.pcbook.LaptopService/GetMyRatings",
+		"/techschool.pcbook.LaptopService/SetPrimaryImage",
+		"/techschool.pcbook.LaptopService/UploadImage",
+	)
+	requireRoleAccess(t, policies, roles, "unknown")
+
+	_, err = service.NewRoles(map[string]service.RoleDefinition{
+		"a": {Inherits: []string{"b"}},
+		"b": {Inherits: []string{"a"}},
+	})
+	require.Error(t, err, "inheritance cycles must be rejected")
+
+	_, err = service.NewRoles(map[string]service.RoleDefinition{
+		"a": {Inherits: []string{"missing"}},
+	})
+	require.Error(t, err, "unknown parent roles must be rejected")
+}
+
+// requireRoleAccess asserts that the role can call exactly the given non-public methods.
+func requireRoleAccess(
+	t *testing.T,
+	policies map[string]*pb.AuthPolicy,
+	roles *service.Roles,
+	role string,
+	expected ...string,
+) {
+	t.Helper()
+
+	scopes := roles.Scopes(role)
+	reachable := []string{}
+	for method, policy := range policies {
+		if !policy.GetPublic() && authpolicy.Permits(policy, scopes) {
+			reachable = append(reachable, method)
+		}
+	}
+
+	require.ElementsMatch(t, expected, reachable, "methods reachable by role %s", role)
+}
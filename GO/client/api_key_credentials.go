@@ -0,0 +1,27 @@
+package client
+
+import (
+	"context"
+
+	"google.golang.org/grpc/credentials"
+)
+
+// APIKeyCredentials sends an API key in the x-api-key header of every call.
+type APIKeyCredentials struct {
+	apiKey string
+}
+
+var _ credentials.PerRPCCredentials = (*APIKeyCredentials)(nil)
+
+func NewAPIKeyCredentials(apiKey string) *APIKeyCredentials {
+	return &APIKeyCredentials{apiKey: apiKey}
+}
+
+func (c *APIKeyCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"x-api-key": c.apiKey}, nil
+}
+
+// RequireTransportSecurity keeps the key from being sent in clear text.
+func (c *APIKeyCredentials) RequireTransportSecurity() bool {
+	return true
+}
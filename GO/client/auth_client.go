@@ -8,34 +8,118 @@ import (
 	"google.golang.org/grpc"
 )
 
+// defaultAuthCallTimeout limits the calls of the auth client whose context has no deadline.
+const defaultAuthCallTimeout = 5 * time.Second
+
+// AuthClient calls the auth service. Every method takes the context of the call,
+// limited to defaultAuthCallTimeout if it has no deadline.
 type AuthClient struct {
-	service  pb.AuthServiceClient
-	userName string
-	password string
+	service pb.AuthServiceClient
+}
+
+// Tokens are the credentials returned by a login or a token refresh.
+type Tokens struct {
+	AccessToken  string
+	RefreshToken string
+}
+
+// OTPRequiredError is returned by a login with the right password when the user has two-factor authentication.
+// VerifyOTP completes the login.
+type OTPRequiredError struct {
+	Challenge string
 }
 
-func NewAuthClient(cc *grpc.ClientConn, userName, password string) *AuthClient {
+func (e *OTPRequiredError) Error() string {
+	return "a one-time password is required to complete the login"
+}
+
+func NewAuthClient(cc grpc.ClientConnInterface) *AuthClient {
 	return &AuthClient{
-		service:  pb.NewAuthServiceClient(cc),
-		userName: userName,
-		password: password,
+		service: pb.NewAuthServiceClient(cc),
 	}
 }
 
-func (c *AuthClient) Login() (string, error) {
+// withTimeout returns the context of a call, limited by the default timeout if the caller set no deadline.
+func (c *AuthClient) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); !ok {
+		return context.WithTimeout(ctx, defaultAuthCallTimeout)
+	}
+	return context.WithCancel(ctx)
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+func (c *AuthClient) Login(ctx context.Context, userName, password string) (*Tokens, error) {
+	ctx, cancel := c.withTimeout(ctx)
 	defer cancel()
 
 	req := &pb.LoginRequest{
-		Username: c.userName,
-		Password: c.password,
+		Username: userName,
+		Password: password,
 	}
 
 	res, err := c.service.Login(ctx, req)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	if len(res.GetOtpChallenge()) > 0 {
+		return nil, &OTPRequiredError{Challenge: res.GetOtpChallenge()}
+	}
+
+	return &Tokens{
+		AccessToken:  res.GetAccessToken(),
+		RefreshToken: res.GetRefreshToken(),
+	}, nil
+}
+
+// VerifyOTP completes a login challenged for a one-time password, or a recovery code.
+func (c *AuthClient) VerifyOTP(ctx context.Context, challenge string, code string) (*Tokens, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	req := &pb.VerifyOTPRequest{
+		OtpChallenge: challenge,
+		Code:         code,
+	}
+
+	res, err := c.service.VerifyOTP(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Tokens{
+		AccessToken:  res.GetAccessToken(),
+		RefreshToken: res.GetRefreshToken(),
+	}, nil
+}
+
+// RefreshToken exchanges a refresh token for new tokens. The old refresh token can't be used again.
+func (c *AuthClient) RefreshToken(ctx context.Context, refreshToken string) (*Tokens, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	req := &pb.RefreshTokenRequest{
+		RefreshToken: refreshToken,
+	}
+
+	res, err := c.service.RefreshToken(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Tokens{
+		AccessToken:  res.GetAccessToken(),
+		RefreshToken: res.GetRefreshToken(),
+	}, nil
+}
+
+// Logout revokes the refresh token and the access token issued with it.
+func (c *AuthClient) Logout(ctx context.Context, refreshToken string) error {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	req := &pb.LogoutRequest{
+		RefreshToken: refreshToken,
 	}
 
-	return res.AccessToken, nil
+	_, err := c.service.Logout(ctx, req)
+	return err
 }
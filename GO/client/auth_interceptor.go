@@ -2,39 +2,131 @@ package client
 
 import (
 	"context"
+	"errors"
 	"log"
+	"pcbook/authpolicy"
+	"sync"
 	"time"
 
+	"github.com/dgrijalva/jwt-go"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
+const (
+	defaultRefreshMargin = time.Minute
+	defaultMinBackoff    = time.Second
+	defaultMaxBackoff    = time.Minute
+)
+
+// AuthInterceptorClient attaches the access token to the calls that need it,
+// and renews the token in the background before it expires.
 type AuthInterceptorClient struct {
-	authClient  *AuthClient
-	authMethod  map[string]bool
-	accessToken string
+	authClient    *AuthClient
+	authMethod    map[string]bool
+	refreshMargin time.Duration
+	minBackoff    time.Duration
+	maxBackoff    time.Duration
+	login         func(ctx context.Context) (*Tokens, error)
+
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// renewMutex makes concurrent renewals wait for a single refresh
+	renewMutex sync.Mutex
+	mutex      sync.RWMutex
+	tokens     Tokens
+	renewedAt  time.Time
+}
+
+type AuthInterceptorClientOption func(*AuthInterceptorClient)
+
+// WithRefreshMargin sets how long before the access token expires it is refreshed.
+// Tokens living less than twice the margin are refreshed halfway through their life.
+func WithRefreshMargin(margin time.Duration) AuthInterceptorClientOption {
+	return func(c *AuthInterceptorClient) {
+		c.refreshMargin = margin
+	}
 }
 
+// WithRefreshBackoff sets the wait before retrying a failed refresh, doubled after each failure up to max.
+func WithRefreshBackoff(min time.Duration, max time.Duration) AuthInterceptorClientOption {
+	return func(c *AuthInterceptorClient) {
+		c.minBackoff = min
+		c.maxBackoff = max
+	}
+}
+
+// WithLogin logs in again when the refresh token is rejected, e.g. after it expired or was revoked.
+func WithLogin(login func(ctx context.Context) (*Tokens, error)) AuthInterceptorClientOption {
+	return func(c *AuthInterceptorClient) {
+		c.login = login
+	}
+}
+
+// NewAuthInterceptorClient attaches the access token from a login to the auth methods,
+// and uses the refresh token to renew it ahead of its expiry until Close or Logout is called.
 func NewAuthInterceptorClient(
 	authClient *AuthClient,
+	tokens *Tokens,
 	authMethod map[string]bool,
-	refreshDuration time.Duration,
+	options ...AuthInterceptorClientOption,
 ) (*AuthInterceptorClient, error) {
+	if tokens == nil || len(tokens.AccessToken) == 0 {
+		return nil, errors.New("an access token is required")
+	}
+
 	interceptor := &AuthInterceptorClient{
-		authClient: authClient,
-		authMethod: authMethod,
+		authClient:    authClient,
+		authMethod:    authMethod,
+		refreshMargin: defaultRefreshMargin,
+		minBackoff:    defaultMinBackoff,
+		maxBackoff:    defaultMaxBackoff,
+		done:          make(chan struct{}),
+		tokens:        *tokens,
+		renewedAt:     time.Now(),
 	}
+	for _, option := range options {
+		option(interceptor)
+	}
+
+	go interceptor.refreshLoop()
+
+	return interceptor, nil
+}
 
-	err := interceptor.scheduleRefreshToken(refreshDuration)
+// AuthMethods returns the methods of the given services that need an access token,
+// as declared by their auth policy in the proto descriptors.
+func AuthMethods(serviceNames ...string) (map[string]bool, error) {
+	policies, err := authpolicy.Load(serviceNames...)
 	if err != nil {
 		return nil, err
 	}
 
-	return interceptor, nil
+	authMethods := make(map[string]bool)
+	for method, policy := range policies {
+		if !policy.GetPublic() {
+			authMethods[method] = true
+		}
+	}
+	return authMethods, nil
 }
 
-func (c *AuthInterceptorClient) attachToken(ctx context.Context) context.Context {
-	return metadata.AppendToOutgoingContext(ctx, "authorization", c.accessToken)
+func (c *AuthInterceptorClient) needsToken(method string) bool {
+	return c.authMethod[method]
+}
+
+func (c *AuthInterceptorClient) currentTokens() Tokens {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.tokens
+}
+
+func attachToken(ctx context.Context, accessToken string) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, "authorization", accessToken)
 }
 
 func (c *AuthInterceptorClient) Unary() grpc.UnaryClientInterceptor {
@@ -48,14 +140,27 @@ func (c *AuthInterceptorClient) Unary() grpc.UnaryClientInterceptor {
 	) error {
 		log.Print("---> intercepting unary method: ", method)
 
-		if c.authMethod[method] {
-			return invoker(c.attachToken(ctx), method, req, reply, cc, opts...)
+		if !c.needsToken(method) {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+
+		accessToken := c.currentTokens().AccessToken
+		err := invoker(attachToken(ctx, accessToken), method, req, reply, cc, opts...)
+		if status.Code(err) != codes.Unauthenticated {
+			return err
 		}
 
-		return invoker(ctx, method, req, reply, cc, opts...)
+		// the token may have expired or been revoked, the call is replayed once with a new one
+		renewErr := c.renew(ctx, accessToken)
+		if renewErr != nil {
+			log.Print("cannot renew access token: ", renewErr)
+			return err
+		}
+		return invoker(attachToken(ctx, c.currentTokens().AccessToken), method, req, reply, cc, opts...)
 	}
 }
 
+// Stream attaches the token to stream calls. They aren't replayed, as their messages may be consumed already.
 func (c *AuthInterceptorClient) Stream() grpc.StreamClientInterceptor {
 	return func(
 		ctx context.Context,
@@ -67,40 +172,124 @@ func (c *AuthInterceptorClient) Stream() grpc.StreamClientInterceptor {
 	) (grpc.ClientStream, error) {
 		log.Print("---> intercepting stream method: ", method)
 
-		if c.authMethod[method] {
-			return streamer(c.attachToken(ctx), desc, cc, method, opts...)
+		if c.needsToken(method) {
+			return streamer(attachToken(ctx, c.currentTokens().AccessToken), desc, cc, method, opts...)
 		}
 
 		return streamer(ctx, desc, cc, method, opts...)
 	}
 }
 
-func (c *AuthInterceptorClient) refreshToken() error {
-	accessToken, err := c.authClient.Login()
+// renew replaces the tokens, unless they have been renewed since staleAccessToken was read.
+// An empty staleAccessToken always renews them.
+func (c *AuthInterceptorClient) renew(ctx context.Context, staleAccessToken string) error {
+	c.renewMutex.Lock()
+	defer c.renewMutex.Unlock()
+
+	current := c.currentTokens()
+	if len(staleAccessToken) > 0 && current.AccessToken != staleAccessToken {
+		return nil
+	}
+
+	tokens, err := c.authClient.RefreshToken(ctx, current.RefreshToken)
+	if status.Code(err) == codes.Unauthenticated && c.login != nil {
+		tokens, err = c.login(ctx)
+	}
 	if err != nil {
 		return err
 	}
 
-	c.accessToken = accessToken
-
+	c.mutex.Lock()
+	c.tokens = *tokens
+	c.renewedAt = time.Now()
+	c.mutex.Unlock()
 	return nil
 }
 
-func (c *AuthInterceptorClient) scheduleRefreshToken(refreshDuration time.Duration) error {
-	err := c.refreshToken()
-	if err != nil {
-		return err
+// untilRefresh returns how long the current access token can be used before it should be refreshed.
+func (c *AuthInterceptorClient) untilRefresh() time.Duration {
+	c.mutex.RLock()
+	accessToken, renewedAt := c.tokens.AccessToken, c.renewedAt
+	c.mutex.RUnlock()
+
+	claims := &jwt.StandardClaims{}
+	_, _, err := new(jwt.Parser).ParseUnverified(accessToken, claims)
+	if err != nil || claims.ExpiresAt == 0 {
+		// the expiry of an opaque token is unknown, it is refreshed every margin
+		return time.Until(renewedAt.Add(c.refreshMargin))
 	}
 
-	go func() {
-		for {
-			time.Sleep(refreshDuration)
-			err := c.refreshToken()
-			if err != nil {
-				return
-			}
+	expiresAt := time.Unix(claims.ExpiresAt, 0)
+	refreshAt := expiresAt.Add(-c.refreshMargin)
+	if claims.IssuedAt > 0 {
+		halfway := time.Unix(claims.IssuedAt, 0).Add(expiresAt.Sub(time.Unix(claims.IssuedAt, 0)) / 2)
+		if refreshAt.Before(halfway) {
+			refreshAt = halfway
 		}
+	}
+	return time.Until(refreshAt)
+}
+
+func (c *AuthInterceptorClient) refreshLoop() {
+	// a refresh in progress is cancelled by Close
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-c.done
+		cancel()
 	}()
 
-	return nil
+	backoff := time.Duration(0)
+	for {
+		wait := c.untilRefresh()
+		if backoff > 0 {
+			wait = backoff
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-c.done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		// a failed call may have renewed the token in the meantime
+		if c.untilRefresh() > 0 {
+			backoff = 0
+			continue
+		}
+
+		err := c.renew(ctx, "")
+		if err == nil {
+			backoff = 0
+			continue
+		}
+
+		backoff *= 2
+		if backoff < c.minBackoff {
+			backoff = c.minBackoff
+		}
+		if backoff > c.maxBackoff {
+			backoff = c.maxBackoff
+		}
+		log.Printf("cannot refresh token, retrying in %v: %v", backoff, err)
+	}
+}
+
+// Close stops renewing the token in the background. The token stays valid until it expires.
+func (c *AuthInterceptorClient) Close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+}
+
+// Logout stops renewing the token and revokes it on the server.
+func (c *AuthInterceptorClient) Logout(ctx context.Context) error {
+	c.Close()
+
+	c.renewMutex.Lock()
+	defer c.renewMutex.Unlock()
+
+	return c.authClient.Logout(ctx, c.currentTokens().RefreshToken)
 }
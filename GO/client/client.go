@@ -0,0 +1,219 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	pb "pcbook/generateProto"
+
+	"google.golang.org/grpc"
+)
+
+// Client holds a single connection to a pcbook server, shared by the auth and laptop clients.
+// When it logs in, it attaches the access token to the calls needing one and renews it
+// over the same connection.
+type Client struct {
+	conn        *grpc.ClientConn
+	auth        *AuthClient
+	laptop      *LaptopClient
+	interceptor *AuthInterceptorClient
+}
+
+// clientConfig is the configuration built by the options of New.
+type clientConfig struct {
+	dialOptions        []grpc.DialOption
+	userName           string
+	password           string
+	otp                string
+	tokens             *Tokens
+	serviceConfig      ServiceConfig
+	laptopOptions      []LaptopClientOption
+	interceptorOptions []AuthInterceptorClientOption
+}
+
+type ClientOption func(*clientConfig)
+
+// WithDialOptions adds options to the connection, such as its transport credentials.
+func WithDialOptions(options ...grpc.DialOption) ClientOption {
+	return func(config *clientConfig) {
+		config.dialOptions = append(config.dialOptions, options...)
+	}
+}
+
+// WithPassword logs in with the password. The session is then renewed with the refresh token only,
+// logging in again with the password takes WithLogin among the auth interceptor options.
+func WithPassword(userName string, password string) ClientOption {
+	return func(config *clientConfig) {
+		config.userName = userName
+		config.password = password
+	}
+}
+
+// WithOneTimePassword completes the first login of a user with two-factor authentication.
+func WithOneTimePassword(code string) ClientOption {
+	return func(config *clientConfig) {
+		config.otp = code
+	}
+}
+
+// WithTokens resumes a session from the tokens of a previous login, instead of logging in.
+func WithTokens(tokens *Tokens) ClientOption {
+	return func(config *clientConfig) {
+		config.tokens = tokens
+	}
+}
+
+// WithAPIKey authenticates every call with the API key of a service account.
+func WithAPIKey(apiKey string) ClientOption {
+	return WithDialOptions(grpc.WithPerRPCCredentials(NewAPIKeyCredentials(apiKey)))
+}
+
+// WithTenantID names the tenant of every call.
+func WithTenantID(tenantID string) ClientOption {
+	return WithDialOptions(grpc.WithPerRPCCredentials(NewTenantCredentials(tenantID)))
+}
+
+// WithServiceConfig replaces DefaultServiceConfig, to change the timeouts, retries or hedging of the laptop calls.
+func WithServiceConfig(serviceConfig ServiceConfig) ClientOption {
+	return func(config *clientConfig) {
+		config.serviceConfig = serviceConfig
+	}
+}
+
+// WithLaptopClientOptions configures the laptop client.
+func WithLaptopClientOptions(options ...LaptopClientOption) ClientOption {
+	return func(config *clientConfig) {
+		config.laptopOptions = append(config.laptopOptions, options...)
+	}
+}
+
+// WithAuthInterceptorOptions configures the renewal of the access token.
+func WithAuthInterceptorOptions(options ...AuthInterceptorClientOption) ClientOption {
+	return func(config *clientConfig) {
+		config.interceptorOptions = append(config.interceptorOptions, options...)
+	}
+}
+
+// New connects to the server at address. With a password or tokens, it logs in over the connection
+// before returning, then attaches the access token to the calls of every service declaring they need one.
+// Without them, only public calls and calls authenticated by an API key or a client certificate succeed.
+// The laptop calls follow DefaultServiceConfig unless WithServiceConfig is given.
+func New(address string, options ...ClientOption) (*Client, error) {
+	config := &clientConfig{serviceConfig: DefaultServiceConfig()}
+	for _, option := range options {
+		option(config)
+	}
+
+	c := &Client{}
+	// each hedged attempt goes through the auth interceptor to get the current token
+	dialOptions := append(config.serviceConfig.DialOptions(), config.dialOptions...)
+	conn, err := grpc.Dial(address, append(dialOptions,
+		grpc.WithChainUnaryInterceptor(c.unary),
+		grpc.WithChainStreamInterceptor(c.stream),
+	)...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot dial server: %w", err)
+	}
+	c.conn = conn
+	c.auth = NewAuthClient(conn)
+	c.laptop = NewLaptopClient(conn, config.laptopOptions...)
+
+	err = c.login(config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// login installs the auth interceptor once the client has tokens.
+// The calls logging in go through the connection before it is installed.
+func (c *Client) login(config *clientConfig) error {
+	tokens := config.tokens
+	if tokens == nil && len(config.userName) > 0 {
+		var err error
+		tokens, err = c.auth.Login(context.Background(), config.userName, config.password)
+		var otpRequired *OTPRequiredError
+		if errors.As(err, &otpRequired) && len(config.otp) > 0 {
+			tokens, err = c.auth.VerifyOTP(context.Background(), otpRequired.Challenge, config.otp)
+		}
+		if err != nil {
+			return fmt.Errorf("cannot login: %w", err)
+		}
+	}
+	if tokens == nil {
+		return nil
+	}
+
+	authMethods, err := AuthMethods(
+		pb.AuthService_ServiceDesc.ServiceName,
+		pb.LaptopService_ServiceDesc.ServiceName,
+		pb.ReviewService_ServiceDesc.ServiceName,
+	)
+	if err != nil {
+		return fmt.Errorf("cannot load auth methods: %w", err)
+	}
+
+	// the password isn't kept: once the refresh token is rejected, the calls fail with Unauthenticated
+	c.interceptor, err = NewAuthInterceptorClient(c.auth, tokens, authMethods, config.interceptorOptions...)
+	return err
+}
+
+func (c *Client) unary(
+	ctx context.Context,
+	method string,
+	req, reply interface{},
+	cc *grpc.ClientConn,
+	invoker grpc.UnaryInvoker,
+	opts ...grpc.CallOption,
+) error {
+	if c.interceptor == nil {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+	return c.interceptor.Unary()(ctx, method, req, reply, cc, invoker, opts...)
+}
+
+func (c *Client) stream(
+	ctx context.Context,
+	desc *grpc.StreamDesc,
+	cc *grpc.ClientConn,
+	method string,
+	streamer grpc.Streamer,
+	opts ...grpc.CallOption,
+) (grpc.ClientStream, error) {
+	if c.interceptor == nil {
+		return streamer(ctx, desc, cc, method, opts...)
+	}
+	return c.interceptor.Stream()(ctx, desc, cc, method, streamer, opts...)
+}
+
+// Auth returns the client of the auth service.
+func (c *Client) Auth() *AuthClient {
+	return c.auth
+}
+
+// Laptop returns the client of the laptop service.
+func (c *Client) Laptop() *LaptopClient {
+	return c.laptop
+}
+
+// Conn returns the connection, for the services without a client of their own.
+func (c *Client) Conn() grpc.ClientConnInterface {
+	return c.conn
+}
+
+// Logout stops renewing the access token and revokes the session, if the client logged in.
+func (c *Client) Logout(ctx context.Context) error {
+	if c.interceptor == nil {
+		return nil
+	}
+	return c.interceptor.Logout(ctx)
+}
+
+// Close stops renewing the access token and closes the connection.
+func (c *Client) Close() error {
+	if c.interceptor != nil {
+		c.interceptor.Close()
+	}
+	return c.conn.Close()
+}
@@ -0,0 +1,337 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	pb "pcbook/generateProto"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultChunkSize    = 1024
+	defaultConcurrency  = 4
+	defaultRetryBackoff = 200 * time.Millisecond
+)
+
+// UploadJob is a single image file to upload for a laptop.
+type UploadJob struct {
+	LaptopID  string
+	ImagePath string
+}
+
+// UploadProgress reports how many bytes of a job have been sent so far.
+type UploadProgress struct {
+	Job        UploadJob
+	Attempt    int
+	SentBytes  int64
+	TotalBytes int64
+}
+
+// UploadResult is the outcome of a single job. Err is nil if the upload succeeded.
+type UploadResult struct {
+	Job      UploadJob
+	ImageID  string
+	Size     uint32
+	Attempts int
+	Err      error
+}
+
+// UploadOptions configures a batch upload. Zero values fall back to defaults.
+type UploadOptions struct {
+	// Concurrency is the number of upload streams opened at the same time.
+	Concurrency int
+	// ChunkSize is the number of bytes sent in each stream message.
+	ChunkSize int
+	// MaxRetries is the number of times a failed file is retried.
+	MaxRetries int
+	// RetryBackoff is the wait before the first retry, doubled on every attempt.
+	RetryBackoff time.Duration
+	// Timeout limits each upload attempt, if set.
+	Timeout time.Duration
+	// Progress is called after every chunk. It is called from several goroutines at once.
+	Progress func(UploadProgress)
+}
+
+var imageExtensions = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+	".gif":  true,
+	".webp": true,
+}
+
+// DirectoryJobs returns a job for every image file directly inside dir.
+func DirectoryJobs(laptopID string, dir string) ([]UploadJob, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read image directory: %w", err)
+	}
+
+	jobs := []UploadJob{}
+	for _, entry := range entries {
+		if entry.IsDir() || !imageExtensions[strings.ToLower(filepath.Ext(entry.Name()))] {
+			continue
+		}
+		jobs = append(jobs, UploadJob{
+			LaptopID:  laptopID,
+			ImagePath: filepath.Join(dir, entry.Name()),
+		})
+	}
+
+	return jobs, nil
+}
+
+// ManifestJobs reads a JSON manifest mapping laptop IDs to image files.
+// Relative file paths are resolved against the manifest's directory.
+func ManifestJobs(manifestPath string) ([]UploadJob, error) {
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read manifest: %w", err)
+	}
+
+	manifest := map[string][]string{}
+	err = json.Unmarshal(data, &manifest)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse manifest: %w", err)
+	}
+
+	laptopIDs := make([]string, 0, len(manifest))
+	for laptopID := range manifest {
+		laptopIDs = append(laptopIDs, laptopID)
+	}
+	sort.Strings(laptopIDs)
+
+	dir := filepath.Dir(manifestPath)
+	jobs := []UploadJob{}
+	for _, laptopID := range laptopIDs {
+		for _, imagePath := range manifest[laptopID] {
+			if !filepath.IsAbs(imagePath) {
+				imagePath = filepath.Join(dir, imagePath)
+			}
+			jobs = append(jobs, UploadJob{
+				LaptopID:  laptopID,
+				ImagePath: imagePath,
+			})
+		}
+	}
+
+	return jobs, nil
+}
+
+// UploadDirectory uploads every image in dir to the given laptop.
+func (laptopClient *LaptopClient) UploadDirectory(
+	ctx context.Context,
+	laptopID string,
+	dir string,
+	options UploadOptions,
+) ([]UploadResult, error) {
+	jobs, err := DirectoryJobs(laptopID, dir)
+	if err != nil {
+		return nil, err
+	}
+	return laptopClient.UploadImages(ctx, jobs, options), nil
+}
+
+// UploadManifest uploads every image listed in a JSON manifest file.
+func (laptopClient *LaptopClient) UploadManifest(
+	ctx context.Context,
+	manifestPath string,
+	options UploadOptions,
+) ([]UploadResult, error) {
+	jobs, err := ManifestJobs(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	return laptopClient.UploadImages(ctx, jobs, options), nil
+}
+
+// UploadImages uploads the jobs over several concurrent streams.
+// It returns one result per job, in the same order as the jobs.
+func (laptopClient *LaptopClient) UploadImages(
+	ctx context.Context,
+	jobs []UploadJob,
+	options UploadOptions,
+) []UploadResult {
+	if options.Concurrency <= 0 {
+		options.Concurrency = defaultConcurrency
+	}
+	if options.ChunkSize <= 0 {
+		options.ChunkSize = defaultChunkSize
+	}
+	if options.RetryBackoff <= 0 {
+		options.RetryBackoff = defaultRetryBackoff
+	}
+
+	results := make([]UploadResult, len(jobs))
+	indexes := make(chan int)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < options.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				results[index] = laptopClient.uploadWithRetry(ctx, jobs[index], options)
+			}
+		}()
+	}
+
+	for i := range jobs {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	return results
+}
+
+func (laptopClient *LaptopClient) uploadWithRetry(ctx context.Context, job UploadJob, options UploadOptions) UploadResult {
+	result := UploadResult{Job: job}
+	backoff := options.RetryBackoff
+
+	for {
+		result.Attempts++
+
+		res, err := laptopClient.uploadFile(ctx, job, result.Attempts, options)
+		if err == nil {
+			result.ImageID = res.GetId()
+			result.Size = res.GetSize()
+			result.Err = nil
+			return result
+		}
+		result.Err = err
+
+		if result.Attempts > options.MaxRetries || !isRetryable(err) {
+			return result
+		}
+
+		select {
+		case <-ctx.Done():
+			return result
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func isRetryable(err error) bool {
+	st, ok := status.FromError(err)
+	if !ok {
+		return false
+	}
+
+	switch st.Code() {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Aborted, codes.ResourceExhausted:
+		return true
+	default:
+		return false
+	}
+}
+
+func (laptopClient *LaptopClient) uploadFile(
+	ctx context.Context,
+	job UploadJob,
+	attempt int,
+	options UploadOptions,
+) (*pb.UploadImageResponse, error) {
+	file, err := os.Open(job.ImagePath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open image file: %w", err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	totalBytes, err := io.Copy(hash, file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read image file: %w", err)
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, fmt.Errorf("cannot rewind image file: %w", err)
+	}
+
+	var cancel context.CancelFunc
+	if options.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, options.Timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+
+	stream, err := laptopClient.service.UploadImage(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &pb.UploadImageRequest{
+		Data: &pb.UploadImageRequest_ImageInfo{
+			ImageInfo: &pb.ImageInfo{
+				LaptopId:  job.LaptopID,
+				ImageType: filepath.Ext(job.ImagePath),
+				Checksum:  hex.EncodeToString(hash.Sum(nil)),
+			},
+		},
+	}
+	err = stream.Send(req)
+	if err != nil {
+		return nil, sendError(stream, err)
+	}
+
+	reader := bufio.NewReader(file)
+	buffer := make([]byte, options.ChunkSize)
+	var sentBytes int64
+
+	for {
+		n, err := reader.Read(buffer)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot read chunk to buffer: %w", err)
+		}
+
+		req := &pb.UploadImageRequest{
+			Data: &pb.UploadImageRequest_ChunkData{
+				ChunkData: buffer[:n],
+			},
+		}
+		err = stream.Send(req)
+		if err != nil {
+			return nil, sendError(stream, err)
+		}
+
+		sentBytes += int64(n)
+		if options.Progress != nil {
+			options.Progress(UploadProgress{
+				Job:        job,
+				Attempt:    attempt,
+				SentBytes:  sentBytes,
+				TotalBytes: totalBytes,
+			})
+		}
+	}
+
+	return stream.CloseAndRecv()
+}
+
+// sendError returns the status sent by the server when a stream is aborted in the middle of sending.
+func sendError(stream pb.LaptopService_UploadImageClient, err error) error {
+	if err != io.EOF {
+		return err
+	}
+	_, err = stream.CloseAndRecv()
+	return err
+}
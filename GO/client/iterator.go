@@ -0,0 +1,78 @@
+package client
+
+import (
+	"context"
+	"io"
+)
+
+// Iterator reads the results of a server stream one at a time:
+//
+//	for it.Next() {
+//		use(it.Value())
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+//
+// Breaking out of the loop early must be followed by Close to release the stream.
+type Iterator[T any] struct {
+	method string
+	recv   func() (T, error)
+	cancel context.CancelFunc
+
+	value T
+	err   error
+	done  bool
+}
+
+func newIterator[T any](method string, recv func() (T, error), cancel context.CancelFunc) *Iterator[T] {
+	return &Iterator[T]{
+		method: method,
+		recv:   recv,
+		cancel: cancel,
+	}
+}
+
+// Next receives the next value, and returns false once the stream ends or fails.
+func (it *Iterator[T]) Next() bool {
+	if it.done {
+		return false
+	}
+
+	value, err := it.recv()
+	if err != nil {
+		if err != io.EOF {
+			it.err = rpcError(it.method, err)
+		}
+		it.Close()
+		return false
+	}
+
+	it.value = value
+	return true
+}
+
+// Value returns the value received by the last call to Next.
+func (it *Iterator[T]) Value() T {
+	return it.value
+}
+
+// Err returns the error that ended the stream, or nil if it ended normally or was closed.
+func (it *Iterator[T]) Err() error {
+	return it.err
+}
+
+// Close cancels the stream. It is safe to call more than once.
+func (it *Iterator[T]) Close() {
+	it.done = true
+	it.cancel()
+}
+
+// All reads the remaining values of the stream.
+func (it *Iterator[T]) All() ([]T, error) {
+	values := []T{}
+	for it.Next() {
+		values = append(values, it.Value())
+	}
+	return values, it.Err()
+}
@@ -1,175 +1,284 @@
 package client
 
 import (
-	"bufio"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
-	"log"
-	"os"
-	"path/filepath"
 	pb "pcbook/generateProto"
+	"strings"
 	"time"
 
+	"github.com/google/uuid"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
+// LaptopClient calls the laptop service. Every method takes the context of the call,
+// and returns the failures of the server as *RPCError, which keeps the gRPC status.
 type LaptopClient struct {
-	service pb.LaptopServiceClient
+	service     pb.LaptopServiceClient
+	callTimeout time.Duration
+	chunkSize   int
 }
 
-func NewLaptopClient(cc *grpc.ClientConn) *LaptopClient {
-	return &LaptopClient{
-		service: pb.NewLaptopServiceClient(cc),
+type LaptopClientOption func(*LaptopClient)
+
+// WithCallTimeout limits the calls whose context has no deadline, streams included.
+// By default the calls only end with their context.
+func WithCallTimeout(timeout time.Duration) LaptopClientOption {
+	return func(c *LaptopClient) {
+		c.callTimeout = timeout
 	}
 }
 
-func (laptopClient *LaptopClient) CreateLaptop(laptop *pb.Laptop) {
-	req := &pb.CreateLaptopRequest{
-		Laptop: laptop,
+// WithUploadChunkSize sets the number of bytes sent in each message by UploadImage.
+func WithUploadChunkSize(size int) LaptopClientOption {
+	return func(c *LaptopClient) {
+		c.chunkSize = size
+	}
+}
+
+func NewLaptopClient(cc grpc.ClientConnInterface, options ...LaptopClientOption) *LaptopClient {
+	laptopClient := &LaptopClient{
+		service:   pb.NewLaptopServiceClient(cc),
+		chunkSize: defaultChunkSize,
+	}
+	for _, option := range options {
+		option(laptopClient)
+	}
+	return laptopClient
+}
+
+// RatedLaptop is a laptop with the summary of its ratings.
+type RatedLaptop struct {
+	Laptop  *pb.Laptop
+	Summary *pb.RatingSummary
+}
+
+// Rating is the rating of a laptop after a score was added or retracted.
+// Err is set when RateLaptop could not rate this laptop, the other scores are still applied.
+type Rating struct {
+	LaptopID     string
+	RatedCount   uint32
+	AverageScore float64
+	Err          error
+}
+
+// withTimeout returns the context of a call, limited by the call timeout if the caller set no deadline.
+func (laptopClient *LaptopClient) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); !ok && laptopClient.callTimeout > 0 {
+		return context.WithTimeout(ctx, laptopClient.callTimeout)
 	}
-	// set timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	return context.WithCancel(ctx)
+}
+
+// CreateLaptop saves the laptop and returns its ID. A laptop without an ID is sent with one generated
+// by the client, so that a retried call can't save it twice: when the server answers that this ID
+// already exists, an earlier attempt saved the laptop and its ID is returned.
+func (laptopClient *LaptopClient) CreateLaptop(ctx context.Context, laptop *pb.Laptop) (string, error) {
+	ctx, cancel := laptopClient.withTimeout(ctx)
 	defer cancel()
 
+	generatedID := len(laptop.GetId()) == 0
+	if generatedID {
+		laptop = proto.Clone(laptop).(*pb.Laptop)
+		laptop.Id = uuid.New().String()
+	}
+
+	req := &pb.CreateLaptopRequest{
+		Laptop: laptop,
+	}
 	res, err := laptopClient.service.CreateLaptop(ctx, req)
+	if generatedID && status.Code(err) == codes.AlreadyExists {
+		return laptop.GetId(), nil
+	}
 	if err != nil {
-		st, ok := status.FromError(err)
-		if ok {
-			if st.Code() == codes.AlreadyExists {
-				log.Print("laptop already exists")
-
-			} else {
-				log.Fatal("cannot create laptop: ", err)
-			}
-			return
-		}
+		return "", rpcError("CreateLaptop", err)
 	}
-	log.Print("create laptop with id: ", res.Id)
+
+	return res.GetId(), nil
 }
 
-func (laptopClient *LaptopClient) SearchLaptop(filter *pb.Filter) {
-	log.Print("searching for laptop with filter: ", filter)
+// GetLaptop returns the laptop with the given ID.
+func (laptopClient *LaptopClient) GetLaptop(ctx context.Context, id string) (*pb.Laptop, error) {
+	ctx, cancel := laptopClient.withTimeout(ctx)
+	defer cancel()
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	res, err := laptopClient.service.GetLaptop(ctx, &pb.GetLaptopRequest{Id: id})
+	if err != nil {
+		return nil, rpcError("GetLaptop", err)
+	}
+
+	return res.GetLaptop(), nil
+}
+
+// DeleteLaptop removes the laptop from the catalog. Only its owner or an admin may delete it.
+func (laptopClient *LaptopClient) DeleteLaptop(ctx context.Context, id string) error {
+	ctx, cancel := laptopClient.withTimeout(ctx)
 	defer cancel()
 
+	_, err := laptopClient.service.DeleteLaptop(ctx, &pb.DeleteLaptopRequest{Id: id})
+	return rpcError("DeleteLaptop", err)
+}
+
+// SearchLaptop returns the laptops matching the filter as the server finds them.
+func (laptopClient *LaptopClient) SearchLaptop(ctx context.Context, filter *pb.Filter) (*Iterator[*pb.Laptop], error) {
+	ctx, cancel := laptopClient.withTimeout(ctx)
+
 	req := &pb.SearchLaptopRequest{
 		Filter: filter,
 	}
 	stream, err := laptopClient.service.SearchLaptop(ctx, req)
 	if err != nil {
-		log.Fatal("cannot search laptop: ", err)
+		cancel()
+		return nil, rpcError("SearchLaptop", err)
 	}
 
-	for {
+	return newIterator("SearchLaptop", func() (*pb.Laptop, error) {
 		res, err := stream.Recv()
-		if err == io.EOF {
-			log.Print("stream is closed by server", err)
-			return
-		}
-		if err != nil {
-			log.Fatal("cannot receive response: ", err)
-		}
-		laptop := res.GetLaptop()
-		log.Print("-found a laptop: ", laptop.GetId())
-		log.Print("  +price: ", laptop.GetPriceUsd())
-		log.Print("  +brand name: ", laptop.GetName())
-		log.Print("  +cpu cores: ", laptop.GetCpu().GetNumberCores())
-		log.Print("  +cpu: ", laptop.GetCpu().GetMinGhz())
-		log.Print("  +ram: ", laptop.GetRam().GetValue(), laptop.GetRam().GetUnit())
+		return res.GetLaptop(), err
+	}, cancel), nil
+}
 
-	}
+// UploadImage uploads the image file, whose type is taken from its extension.
+// UploadImages uploads many files concurrently, with retries.
+func (laptopClient *LaptopClient) UploadImage(ctx context.Context, laptopID string, imagePath string) (*pb.UploadImageResponse, error) {
+	ctx, cancel := laptopClient.withTimeout(ctx)
+	defer cancel()
 
-}
+	job := UploadJob{
+		LaptopID:  laptopID,
+		ImagePath: imagePath,
+	}
+	options := UploadOptions{
+		ChunkSize: laptopClient.chunkSize,
+	}
 
-func (laptopClient *LaptopClient) UploadImage(laptopID string, imageType string, imagePath string) {
-	file, err := os.Open(imagePath)
+	res, err := laptopClient.uploadFile(ctx, job, 1, options)
+	if _, ok := status.FromError(err); !ok {
+		// the image file could not be read
+		return nil, err
+	}
 	if err != nil {
-		log.Fatal("cannot open image file: ", err)
+		return nil, rpcError("UploadImage", err)
 	}
-	defer file.Close()
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	return res, nil
+}
+
+// DownloadImage writes the data of the image to w and returns its info.
+// The data is checked against the checksum of the image, if the server knows it.
+func (laptopClient *LaptopClient) DownloadImage(ctx context.Context, laptopID string, imageID string, w io.Writer) (*pb.ImageInfo, error) {
+	ctx, cancel := laptopClient.withTimeout(ctx)
 	defer cancel()
 
-	stream, err := laptopClient.service.UploadImage(ctx)
+	req := &pb.DownloadImageRequest{
+		LaptopId: laptopID,
+		ImageId:  imageID,
+	}
+	stream, err := laptopClient.service.DownloadImage(ctx, req)
 	if err != nil {
-		log.Fatal("cannot upload image: ", err)
+		return nil, rpcError("DownloadImage", err)
 	}
 
-	req := &pb.UploadImageRequest{
-		Data: &pb.UploadImageRequest_ImageInfo{
-			ImageInfo: &pb.ImageInfo{
-				LaptopId:  laptopID,
-				ImageType: filepath.Ext(imagePath),
-			},
-		},
-	}
-	// log.Print("sending image info: ", req)
-	err = stream.Send(req)
+	res, err := stream.Recv()
 	if err != nil {
-		log.Fatal("cannot send image info: ", err)
+		return nil, rpcError("DownloadImage", err)
 	}
+	info := res.GetImageInfo()
 
-	reader := bufio.NewReader(file)
-	buffer := make([]byte, 1024)
-
+	hash := sha256.New()
 	for {
-		n, err := reader.Read(buffer)
+		res, err := stream.Recv()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			log.Fatal("cannot read chunk to buffer: ", err)
+			return nil, rpcError("DownloadImage", err)
 		}
 
-		req := &pb.UploadImageRequest{
-			Data: &pb.UploadImageRequest_ChunkData{
-				ChunkData: buffer[:n],
-			},
-		}
-		// log.Print("sending chunk: ", req)
-		err = stream.Send(req)
+		chunk := res.GetChunkData()
+		hash.Write(chunk)
+		_, err = w.Write(chunk)
 		if err != nil {
-			log.Fatal("cannot send chunk to server: ", err, stream.RecvMsg(nil))
+			return nil, fmt.Errorf("cannot write image data: %w", err)
 		}
 	}
 
-	res, err := stream.CloseAndRecv()
-	if err != nil {
-		log.Fatal("cannot receive response: ", err)
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	if len(info.GetChecksum()) > 0 && !strings.EqualFold(info.GetChecksum(), checksum) {
+		return nil, fmt.Errorf("image checksum doesn't match: got %s, want %s", checksum, info.GetChecksum())
+	}
+	return info, nil
+}
+
+func (laptopClient *LaptopClient) SetPrimaryImage(ctx context.Context, laptopID string, imageID string) error {
+	ctx, cancel := laptopClient.withTimeout(ctx)
+	defer cancel()
+
+	req := &pb.SetPrimaryImageRequest{
+		LaptopId: laptopID,
+		ImageId:  imageID,
 	}
+	_, err := laptopClient.service.SetPrimaryImage(ctx, req)
+	return rpcError("SetPrimaryImage", err)
+}
 
-	log.Printf("image uploaded with id: %s, size: %d", res.GetId(), res.GetSize())
+func (laptopClient *LaptopClient) DeleteImage(ctx context.Context, laptopID string, imageID string) error {
+	ctx, cancel := laptopClient.withTimeout(ctx)
+	defer cancel()
 
+	req := &pb.DeleteImageRequest{
+		LaptopId: laptopID,
+		ImageId:  imageID,
+	}
+	_, err := laptopClient.service.DeleteImage(ctx, req)
+	return rpcError("DeleteImage", err)
 }
 
-func (laptopClient *LaptopClient) RateLaptop(laptopIDs []string, scores []float64) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+// RateLaptop gives each laptop the score at the same index, over a single stream.
+// It returns the new rating of every laptop, in the order of the requests.
+func (laptopClient *LaptopClient) RateLaptop(ctx context.Context, laptopIDs []string, scores []float64) ([]Rating, error) {
+	if len(laptopIDs) != len(scores) {
+		return nil, fmt.Errorf("got %d laptops but %d scores", len(laptopIDs), len(scores))
+	}
+
+	ctx, cancel := laptopClient.withTimeout(ctx)
 	defer cancel()
 
 	stream, err := laptopClient.service.RateLaptop(ctx)
 	if err != nil {
-		return fmt.Errorf("cannot rate laptop: %w", err)
+		return nil, rpcError("RateLaptop", err)
 	}
 
-	waitResponse := make(chan error)
+	ratings := make([]Rating, 0, len(laptopIDs))
+	// buffered, so that the receiver ends once the stream is cancelled even if nobody waits for it anymore
+	waitResponse := make(chan error, 1)
 	go func() {
 		for {
 			res, err := stream.Recv()
 			if err == io.EOF {
-				log.Print("stream is closed by server")
 				waitResponse <- nil
 				return
 			}
 			if err != nil {
-				waitResponse <- fmt.Errorf("cannot receive response: %w", err)
+				waitResponse <- rpcError("RateLaptop", err)
 				return
 			}
-			log.Print("received response: ", res)
+
+			rating := Rating{
+				LaptopID:     res.GetLaptopId(),
+				RatedCount:   res.GetRatedCount(),
+				AverageScore: res.GetAverageCore(),
+			}
+			if !res.GetOk() {
+				rating.Err = status.Error(codes.Code(res.GetErrorCode()), res.GetErrorMessage())
+			}
+			ratings = append(ratings, rating)
 		}
 	}()
 
@@ -178,19 +287,97 @@ func (laptopClient *LaptopClient) RateLaptop(laptopIDs []string, scores []float6
 			LaptopId: laptopID,
 			Score:    scores[i],
 		}
-		log.Print("sending request: ", req)
 		err := stream.Send(req)
 		if err != nil {
-			return fmt.Errorf("cannot send request: %v - %v", err, stream.RecvMsg(nil))
+			// the status of an aborted stream comes with the receive
+			recvErr := <-waitResponse
+			if recvErr != nil {
+				return nil, recvErr
+			}
+			return nil, rpcError("RateLaptop", err)
 		}
-
-		log.Print("sent request: ", req)
 	}
 
 	err = stream.CloseSend()
 	if err != nil {
-		return fmt.Errorf("cannot close stream: %w", err)
+		return nil, rpcError("RateLaptop", err)
 	}
 
-	return <-waitResponse
+	err = <-waitResponse
+	if err != nil {
+		return nil, err
+	}
+	return ratings, nil
+}
+
+// GetMyRatings returns the scores the caller gave to laptops.
+func (laptopClient *LaptopClient) GetMyRatings(ctx context.Context) ([]*pb.UserRating, error) {
+	ctx, cancel := laptopClient.withTimeout(ctx)
+	defer cancel()
+
+	res, err := laptopClient.service.GetMyRatings(ctx, &pb.GetMyRatingsRequest{})
+	if err != nil {
+		return nil, rpcError("GetMyRatings", err)
+	}
+
+	return res.GetRatings(), nil
+}
+
+// RetractRating removes the caller's score of the laptop and returns its new rating.
+func (laptopClient *LaptopClient) RetractRating(ctx context.Context, laptopID string) (Rating, error) {
+	ctx, cancel := laptopClient.withTimeout(ctx)
+	defer cancel()
+
+	req := &pb.RetractRatingRequest{
+		LaptopId: laptopID,
+	}
+	res, err := laptopClient.service.RetractRating(ctx, req)
+	if err != nil {
+		return Rating{}, rpcError("RetractRating", err)
+	}
+
+	return Rating{
+		LaptopID:     res.GetLaptopId(),
+		RatedCount:   res.GetRatedCount(),
+		AverageScore: res.GetAverageCore(),
+	}, nil
+}
+
+func (laptopClient *LaptopClient) GetRatingSummary(ctx context.Context, laptopID string) (*pb.RatingSummary, error) {
+	ctx, cancel := laptopClient.withTimeout(ctx)
+	defer cancel()
+
+	req := &pb.GetRatingSummaryRequest{
+		LaptopId: laptopID,
+	}
+	res, err := laptopClient.service.GetRatingSummary(ctx, req)
+	if err != nil {
+		return nil, rpcError("GetRatingSummary", err)
+	}
+
+	return res.GetSummary(), nil
+}
+
+// TopRatedLaptops returns the laptops matching the filter, best rated first.
+// A limit of 0 returns all of them.
+func (laptopClient *LaptopClient) TopRatedLaptops(ctx context.Context, filter *pb.Filter, limit uint32) (*Iterator[RatedLaptop], error) {
+	ctx, cancel := laptopClient.withTimeout(ctx)
+
+	req := &pb.TopRatedLaptopsRequest{
+		Filter: filter,
+		Limit:  limit,
+	}
+	stream, err := laptopClient.service.TopRatedLaptops(ctx, req)
+	if err != nil {
+		cancel()
+		return nil, rpcError("TopRatedLaptops", err)
+	}
+
+	return newIterator("TopRatedLaptops", func() (RatedLaptop, error) {
+		res, err := stream.Recv()
+		if err != nil {
+			return RatedLaptop{}, err
+		}
+		return RatedLaptop{Laptop: res.GetLaptop(), Summary: res.GetSummary()}, nil
+	}, cancel), nil
 }
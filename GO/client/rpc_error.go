@@ -0,0 +1,33 @@
+package client
+
+import (
+	"google.golang.org/grpc/status"
+)
+
+// RPCError is a call rejected by the server or failed in transport.
+// It keeps the gRPC status of the call, so status.Code and status.FromError work on it.
+type RPCError struct {
+	// Method is the RPC that failed, such as "CreateLaptop".
+	Method string
+	Err    error
+}
+
+func (e *RPCError) Error() string {
+	return "cannot call " + e.Method + ": " + e.Err.Error()
+}
+
+func (e *RPCError) Unwrap() error {
+	return e.Err
+}
+
+func (e *RPCError) GRPCStatus() *status.Status {
+	return status.Convert(e.Err)
+}
+
+// rpcError wraps an error returned by a gRPC call, keeping nil as is.
+func rpcError(method string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &RPCError{Method: method, Err: err}
+}
@@ -0,0 +1,252 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	pb "pcbook/generateProto"
+	"sort"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// ServiceConfig sets the timeouts, retries and hedging of the calls to the laptop service.
+// Retries and timeouts are applied by gRPC through the default service config of the connection,
+// hedging by an interceptor, since gRPC-Go doesn't implement the hedging policy.
+type ServiceConfig struct {
+	// MaxAttempts is the number of attempts of a retried or hedged call, at most 5. Below 2, nothing is retried.
+	MaxAttempts int
+	// InitialBackoff is the wait before the first retry, or the first hedged attempt following a failure,
+	// doubled after each attempt up to MaxBackoff. Every wait is randomized between zero and its value.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Methods configures the calls by method name, e.g. "GetLaptop".
+	Methods map[string]MethodConfig
+}
+
+// MethodConfig configures the calls to one method.
+type MethodConfig struct {
+	// Timeout limits the call, all attempts included. Zero means no limit.
+	Timeout time.Duration
+	// Retry retries the call when it fails with Unavailable before the server answered or committed to an answer.
+	// Only idempotent methods should be retried. A hedged method isn't retried, its attempts replace the retries.
+	Retry bool
+	// HedgingDelay sends another attempt of a unary call every time this delay passes without an answer,
+	// or after the backoff once an attempt fails with Unavailable, and returns the first answer.
+	// Zero disables hedging. Only reads should be hedged.
+	HedgingDelay time.Duration
+}
+
+// DefaultServiceConfig retries the reads and CreateLaptop, whose client-generated ID makes it idempotent,
+// and limits the calls that should answer quickly. Nothing is hedged.
+func DefaultServiceConfig() ServiceConfig {
+	return ServiceConfig{
+		MaxAttempts:    4,
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     2 * time.Second,
+		Methods: map[string]MethodConfig{
+			"CreateLaptop":     {Timeout: 5 * time.Second, Retry: true},
+			"GetLaptop":        {Timeout: 5 * time.Second, Retry: true},
+			"SearchLaptop":     {Timeout: 30 * time.Second, Retry: true},
+			"DeleteLaptop":     {Timeout: 5 * time.Second},
+			"SetPrimaryImage":  {Timeout: 5 * time.Second},
+			"DeleteImage":      {Timeout: 5 * time.Second},
+			"GetMyRatings":     {Timeout: 5 * time.Second, Retry: true},
+			"RetractRating":    {Timeout: 5 * time.Second},
+			"GetRatingSummary": {Timeout: 5 * time.Second, Retry: true},
+			"TopRatedLaptops":  {Timeout: 30 * time.Second, Retry: true},
+		},
+	}
+}
+
+type methodName struct {
+	Service string `json:"service"`
+	Method  string `json:"method"`
+}
+
+type retryPolicy struct {
+	MaxAttempts          int      `json:"maxAttempts"`
+	InitialBackoff       string   `json:"initialBackoff"`
+	MaxBackoff           string   `json:"maxBackoff"`
+	BackoffMultiplier    float64  `json:"backoffMultiplier"`
+	RetryableStatusCodes []string `json:"retryableStatusCodes"`
+}
+
+type methodConfig struct {
+	Name        []methodName `json:"name"`
+	Timeout     string       `json:"timeout,omitempty"`
+	RetryPolicy *retryPolicy `json:"retryPolicy,omitempty"`
+}
+
+// JSON returns the gRPC service config applying the timeouts and retries.
+func (config ServiceConfig) JSON() string {
+	methods := make([]string, 0, len(config.Methods))
+	for method := range config.Methods {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+
+	methodConfigs := []methodConfig{}
+	for _, method := range methods {
+		methodConfig := methodConfig{
+			Name: []methodName{{Service: pb.LaptopService_ServiceDesc.ServiceName, Method: method}},
+		}
+		if timeout := config.Methods[method].Timeout; timeout > 0 {
+			methodConfig.Timeout = formatDuration(timeout)
+		}
+		// gRPC would retry every hedged attempt, multiplying the calls, so the attempts of hedged methods
+		// are only sent by the hedging interceptor
+		if config.Methods[method].Retry && config.Methods[method].HedgingDelay <= 0 && config.MaxAttempts > 1 {
+			methodConfig.RetryPolicy = &retryPolicy{
+				MaxAttempts:          config.MaxAttempts,
+				InitialBackoff:       formatDuration(config.InitialBackoff),
+				MaxBackoff:           formatDuration(config.MaxBackoff),
+				BackoffMultiplier:    2,
+				RetryableStatusCodes: []string{"UNAVAILABLE"},
+			}
+		}
+		if len(methodConfig.Timeout) > 0 || methodConfig.RetryPolicy != nil {
+			methodConfigs = append(methodConfigs, methodConfig)
+		}
+	}
+
+	// the values are strings, numbers and slices of them, which always serialize
+	data, _ := json.Marshal(map[string]interface{}{"methodConfig": methodConfigs})
+	return string(data)
+}
+
+// formatDuration writes a duration the way the service config expects, in seconds.
+func formatDuration(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64) + "s"
+}
+
+// DialOptions apply the config to a connection. A service config returned by the name resolver
+// takes precedence over it, and so does a later grpc.WithDefaultServiceConfig.
+func (config ServiceConfig) DialOptions() []grpc.DialOption {
+	return []grpc.DialOption{
+		grpc.WithDefaultServiceConfig(config.JSON()),
+		grpc.WithChainUnaryInterceptor(config.hedgingInterceptor()),
+	}
+}
+
+// hedgingInterceptor sends the attempts of the hedged unary methods, within the timeout of the call.
+// The service config applies the timeout to each attempt, which would let the call last longer.
+func (config ServiceConfig) hedgingInterceptor() grpc.UnaryClientInterceptor {
+	hedged := make(map[string]MethodConfig)
+	for method, methodConfig := range config.Methods {
+		if methodConfig.HedgingDelay > 0 {
+			hedged["/"+pb.LaptopService_ServiceDesc.ServiceName+"/"+method] = methodConfig
+		}
+	}
+
+	return func(
+		ctx context.Context,
+		method string,
+		req, reply interface{},
+		cc *grpc.ClientConn,
+		invoker grpc.UnaryInvoker,
+		opts ...grpc.CallOption,
+	) error {
+		methodConfig, hedging := hedged[method]
+		message, ok := reply.(proto.Message)
+		if !hedging || !ok || config.MaxAttempts < 2 {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+
+		if methodConfig.Timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, methodConfig.Timeout)
+			defer cancel()
+		}
+		return config.hedge(ctx, methodConfig.HedgingDelay, message, func(ctx context.Context, reply proto.Message) error {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		})
+	}
+}
+
+type hedgedAttempt struct {
+	reply proto.Message
+	err   error
+}
+
+// hedge runs up to MaxAttempts attempts of a call, each with its own reply, and merges the first answer into reply.
+// An attempt failing with Unavailable is followed by the next one after the backoff, unless the delay passes first.
+// The attempts still running are cancelled once it returns.
+func (config ServiceConfig) hedge(
+	ctx context.Context,
+	delay time.Duration,
+	reply proto.Message,
+	call func(ctx context.Context, reply proto.Message) error,
+) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	attempts := make(chan hedgedAttempt, config.MaxAttempts)
+	sent := 0
+	send := func() {
+		attemptReply := proto.Clone(reply)
+		proto.Reset(attemptReply)
+		sent++
+		go func() {
+			err := call(ctx, attemptReply)
+			attempts <- hedgedAttempt{reply: attemptReply, err: err}
+		}()
+	}
+
+	send()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	backoff := config.InitialBackoff
+	for pending := 1; ; {
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-timer.C:
+			if sent < config.MaxAttempts {
+				send()
+				pending++
+				timer.Reset(delay)
+			}
+		case attempt := <-attempts:
+			pending--
+			if attempt.err == nil {
+				proto.Merge(reply, attempt.reply)
+				return nil
+			}
+			if status.Code(attempt.err) != codes.Unavailable || sent == config.MaxAttempts && pending == 0 {
+				return attempt.err
+			}
+			if sent == config.MaxAttempts {
+				continue
+			}
+
+			wait := time.Duration(0)
+			if backoff > 0 {
+				wait = time.Duration(rand.Int63n(int64(backoff)))
+			}
+			backoff *= 2
+			if backoff > config.MaxBackoff {
+				backoff = config.MaxBackoff
+			}
+
+			// the next attempt is sent after the backoff, or the delay if it passes first
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			if wait < delay {
+				timer.Reset(wait)
+			} else {
+				timer.Reset(delay)
+			}
+		}
+	}
+}
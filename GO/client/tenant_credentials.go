@@ -0,0 +1,28 @@
+package client
+
+import (
+	"context"
+
+	"google.golang.org/grpc/credentials"
+)
+
+// TenantCredentials names the tenant of every call in the x-tenant-id header.
+// Calls authenticated by a token or an API key must name the tenant the credentials were issued for.
+type TenantCredentials struct {
+	tenantID string
+}
+
+var _ credentials.PerRPCCredentials = (*TenantCredentials)(nil)
+
+func NewTenantCredentials(tenantID string) *TenantCredentials {
+	return &TenantCredentials{tenantID: tenantID}
+}
+
+func (c *TenantCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"x-tenant-id": c.tenantID}, nil
+}
+
+// RequireTransportSecurity is false as the tenant id is not a secret.
+func (c *TenantCredentials) RequireTransportSecurity() bool {
+	return false
+}
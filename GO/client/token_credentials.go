@@ -0,0 +1,28 @@
+package client
+
+import (
+	"context"
+
+	"google.golang.org/grpc/credentials"
+)
+
+// TokenCredentials sends an access token in the authorization header of every call.
+// Unlike AuthInterceptorClient, it doesn't renew the token.
+type TokenCredentials struct {
+	accessToken string
+}
+
+var _ credentials.PerRPCCredentials = (*TokenCredentials)(nil)
+
+func NewTokenCredentials(accessToken string) *TokenCredentials {
+	return &TokenCredentials{accessToken: accessToken}
+}
+
+func (c *TokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": c.accessToken}, nil
+}
+
+// RequireTransportSecurity keeps the token from being sent in clear text.
+func (c *TokenCredentials) RequireTransportSecurity() bool {
+	return true
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
@@ -15,16 +16,30 @@ import (
 	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
 )
 
 func testCreateLaptop(laptopClient *client.LaptopClient) {
-	laptopClient.CreateLaptop(sample.NewLaptop())
+	createLaptop(laptopClient, sample.NewLaptop())
+}
+
+func createLaptop(laptopClient *client.LaptopClient, laptop *pb.Laptop) {
+	id, err := laptopClient.CreateLaptop(context.Background(), laptop)
+	if status.Code(err) == codes.AlreadyExists {
+		log.Print("laptop already exists")
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Print("create laptop with id: ", id)
 }
 
 func testSearchLaptop(laptopClient *client.LaptopClient) {
 	for i := 0; i < 10; i++ {
-		laptopClient.CreateLaptop(sample.NewLaptop())
+		createLaptop(laptopClient, sample.NewLaptop())
 	}
 
 	filter := &pb.Filter{
@@ -34,13 +49,37 @@ func testSearchLaptop(laptopClient *client.LaptopClient) {
 		MinRam:      &pb.Memory{Value: 8, Unit: pb.Memory_GIGABYTE},
 	}
 
-	laptopClient.SearchLaptop(filter)
+	log.Print("searching for laptop with filter: ", filter)
+	laptops, err := laptopClient.SearchLaptop(context.Background(), filter)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer laptops.Close()
+
+	for laptops.Next() {
+		laptop := laptops.Value()
+		log.Print("-found a laptop: ", laptop.GetId())
+		log.Print("  +price: ", laptop.GetPriceUsd())
+		log.Print("  +brand name: ", laptop.GetName())
+		log.Print("  +cpu cores: ", laptop.GetCpu().GetNumberCores())
+		log.Print("  +cpu: ", laptop.GetCpu().GetMinGhz())
+		log.Print("  +ram: ", laptop.GetRam().GetValue(), laptop.GetRam().GetUnit())
+		log.Print("  +primary image: ", laptop.GetPrimaryImageId())
+	}
+	if err := laptops.Err(); err != nil {
+		log.Fatal(err)
+	}
 }
 
 func testUploadImage(laptopClient *client.LaptopClient) {
 	laptop := sample.NewLaptop()
-	laptopClient.CreateLaptop(laptop)
-	laptopClient.UploadImage(laptop.GetId(), "jpg", "tmp/kho-hieu.jpg")
+	createLaptop(laptopClient, laptop)
+
+	res, err := laptopClient.UploadImage(context.Background(), laptop.GetId(), "tmp/kho-hieu.jpg")
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("image uploaded with id: %s, size: %d", res.GetId(), res.GetSize())
 }
 
 func testRateLaptop(laptopClient *client.LaptopClient) {
@@ -50,7 +89,7 @@ func testRateLaptop(laptopClient *client.LaptopClient) {
 	for i := 0; i < n; i++ {
 		laptop := sample.NewLaptop()
 		laptopIDs[i] = laptop.GetId()
-		laptopClient.CreateLaptop(laptop)
+		createLaptop(laptopClient, laptop)
 	}
 
 	scores := make([]float64, n)
@@ -67,28 +106,25 @@ func testRateLaptop(laptopClient *client.LaptopClient) {
 			scores[i] = sample.RandomLaptopScore()
 		}
 
-		err := laptopClient.RateLaptop(laptopIDs, scores)
+		ratings, err := laptopClient.RateLaptop(context.Background(), laptopIDs, scores)
 		if err != nil {
 			log.Fatal(err)
 		}
+		for _, rating := range ratings {
+			if rating.Err != nil {
+				log.Printf("cannot rate laptop %s: %v", rating.LaptopID, rating.Err)
+				continue
+			}
+			log.Printf("laptop %s: average score %.2f from %d ratings", rating.LaptopID, rating.AverageScore, rating.RatedCount)
+		}
 	}
 }
 
 const (
-	username        = "admin"
-	password        = "admin"
-	refreshDuration = 30 * time.Second
+	username = "admin"
+	password = "admin"
 )
 
-func authMethods() map[string]bool {
-	laptopServicePath := "/pcbook.LaptopService/"
-	return map[string]bool{
-		laptopServicePath + "CreateLaptop": true,
-		laptopServicePath + "UploadImage":  true,
-		laptopServicePath + "RateLaptop":   true,
-	}
-}
-
 func loadTLSCredentials() (credentials.TransportCredentials, error) {
 	pemServerCA, err := ioutil.ReadFile("cert/ca-cert.pem")
 	if err != nil {
@@ -100,9 +136,16 @@ func loadTLSCredentials() (credentials.TransportCredentials, error) {
 		return nil, errors.New("cannot add server CA to cert pool")
 	}
 
+	// the server requires a client certificate signed by the same CA
+	clientCert, err := tls.LoadX509KeyPair("cert/client-cert.pem", "cert/client-key.pem")
+	if err != nil {
+		return nil, err
+	}
+
 	// create the credentials
 	config := &tls.Config{
-		RootCAs: certPool,
+		Certificates: []tls.Certificate{clientCert},
+		RootCAs:      certPool,
 	}
 
 	return credentials.NewTLS(config), nil
@@ -110,6 +153,9 @@ func loadTLSCredentials() (credentials.TransportCredentials, error) {
 
 func main() {
 	serverAddress := flag.String("serverAddress", "", "server address")
+	apiKey := flag.String("api-key", "", "API key to authenticate with instead of logging in")
+	otp := flag.String("otp", "", "one-time password of the authenticator app, or a recovery code, if the user has two-factor authentication")
+	tenantID := flag.String("tenant", "", "tenant whose catalog to use, the tenant of the credentials if empty")
 	flag.Parse()
 	log.Print("dial server: ", *serverAddress)
 
@@ -119,29 +165,30 @@ func main() {
 		log.Fatal("cannot load TLS credentials: ", err)
 	}
 
-	conn1, err := grpc.Dial(*serverAddress, grpc.WithTransportCredentials(tlsCredentials))
-	if err != nil {
-		log.Fatal("cannot dial server: ", err)
+	options := []client.ClientOption{
+		client.WithDialOptions(grpc.WithTransportCredentials(tlsCredentials)),
+		client.WithLaptopClientOptions(client.WithCallTimeout(5 * time.Second)),
 	}
-	defer conn1.Close()
-
-	authClient := client.NewAuthClient(conn1, username, password)
-	interceptor, err := client.NewAuthInterceptorClient(authClient, authMethods(), refreshDuration)
-	if err != nil {
-		log.Fatal(err)
+	if len(*tenantID) > 0 {
+		options = append(options, client.WithTenantID(*tenantID))
+	}
+	if len(*apiKey) > 0 {
+		// service accounts send their API key instead of logging in
+		options = append(options, client.WithAPIKey(*apiKey))
+	} else {
+		options = append(options, client.WithPassword(username, password), client.WithOneTimePassword(*otp))
 	}
 
-	conn2, err := grpc.Dial(
-		*serverAddress,
-		grpc.WithTransportCredentials(tlsCredentials),
-		grpc.WithUnaryInterceptor(interceptor.Unary()),
-		grpc.WithStreamInterceptor(interceptor.Stream()),
-	)
+	pcbook, err := client.New(*serverAddress, options...)
+	var otpRequired *client.OTPRequiredError
+	if errors.As(err, &otpRequired) {
+		log.Fatal(err, ", pass it with -otp")
+	}
 	if err != nil {
-		log.Fatal("cannot dial server: ", err)
+		log.Fatal(err)
 	}
-	defer conn2.Close()
+	defer pcbook.Close()
+	defer pcbook.Logout(context.Background())
 
-	laptopClient := client.NewLaptopClient(conn2)
-	testRateLaptop(laptopClient)
+	testRateLaptop(pcbook.Laptop())
 }
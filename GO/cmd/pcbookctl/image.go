@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"pcbook/client"
+	"strconv"
+)
+
+// uploadedImage is the outcome of the upload of one file.
+type uploadedImage struct {
+	File     string `json:"file"`
+	ImageID  string `json:"image_id,omitempty"`
+	Size     uint32 `json:"size,omitempty"`
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error,omitempty"`
+}
+
+var uploadedImageTable = table[uploadedImage]{
+	header: []string{"FILE", "IMAGE ID", "SIZE", "ATTEMPTS", "ERROR"},
+	row: func(image uploadedImage) []string {
+		return []string{image.File, image.ImageID, strconv.Itoa(int(image.Size)), strconv.Itoa(image.Attempts), image.Error}
+	},
+}
+
+// downloadedImage is an image written to a file.
+type downloadedImage struct {
+	File     string `json:"file"`
+	Type     string `json:"type"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum,omitempty"`
+}
+
+var downloadedImageTable = table[downloadedImage]{
+	header: []string{"FILE", "TYPE", "SIZE", "CHECKSUM"},
+	row: func(image downloadedImage) []string {
+		return []string{image.File, image.Type, strconv.FormatInt(image.Size, 10), image.Checksum}
+	},
+}
+
+func runImage(ctx context.Context, options *globalOptions, args []string) error {
+	if len(args) == 0 {
+		return usagef("image: a subcommand is required: upload or download")
+	}
+
+	switch args[0] {
+	case "upload":
+		return runImageUpload(ctx, options, args[1:])
+	case "download":
+		return runImageDownload(ctx, options, args[1:])
+	default:
+		return usagef("image: unknown subcommand %q", args[0])
+	}
+}
+
+func runImageUpload(ctx context.Context, options *globalOptions, args []string) error {
+	flags := flag.NewFlagSet("image upload", flag.ContinueOnError)
+	laptopID := flags.String("laptop", "", "ID of the laptop")
+	concurrency := flags.Int("concurrency", 4, "number of files uploaded at the same time")
+	retries := flags.Int("retries", 2, "number of times a failed upload is retried")
+	err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(*laptopID) == 0 || flags.NArg() == 0 {
+		return usagef("image upload: -laptop and at least one file are required")
+	}
+
+	jobs := make([]client.UploadJob, flags.NArg())
+	for i, file := range flags.Args() {
+		jobs[i] = client.UploadJob{LaptopID: *laptopID, ImagePath: file}
+	}
+
+	conn, err := dialAuthenticated(ctx, options, true)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	results := client.NewLaptopClient(conn).UploadImages(ctx, jobs, client.UploadOptions{
+		Concurrency: *concurrency,
+		MaxRetries:  *retries,
+	})
+
+	images := make([]uploadedImage, len(results))
+	var failure error
+	failures := 0
+	for i, result := range results {
+		images[i] = uploadedImage{
+			File:     result.Job.ImagePath,
+			ImageID:  result.ImageID,
+			Size:     result.Size,
+			Attempts: result.Attempts,
+		}
+		if result.Err != nil {
+			images[i].Error = result.Err.Error()
+			if failure == nil {
+				failure = result.Err
+			}
+			failures++
+		}
+	}
+
+	err = printValues(options, uploadedImageTable, images)
+	if err != nil {
+		return err
+	}
+	if failure != nil {
+		return fmt.Errorf("%d of %d uploads failed, the first one with: %w", failures, len(results), failure)
+	}
+	return nil
+}
+
+func runImageDownload(ctx context.Context, options *globalOptions, args []string) error {
+	flags := flag.NewFlagSet("image download", flag.ContinueOnError)
+	laptopID := flags.String("laptop", "", "ID of the laptop")
+	imageID := flags.String("image", "", "ID of the image")
+	out := flags.String("out", "", "file to write the image to, - for stdout, the image ID and type if empty")
+	err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(*laptopID) == 0 || len(*imageID) == 0 {
+		return usagef("image download: -laptop and -image are required")
+	}
+
+	conn, err := dialAuthenticated(ctx, options, false)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	laptopClient := client.NewLaptopClient(conn)
+
+	if *out == "-" {
+		_, err := laptopClient.DownloadImage(ctx, *laptopID, *imageID, options.stdout)
+		return err
+	}
+
+	// the type of the image, which names the file by default, is only known once it is downloaded
+	file, err := os.CreateTemp(filepath.Dir(*out), "."+*imageID+"-*")
+	if err != nil {
+		return fmt.Errorf("cannot create image file: %w", err)
+	}
+	defer os.Remove(file.Name())
+
+	info, err := laptopClient.DownloadImage(ctx, *laptopID, *imageID, file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	size, err := file.Seek(0, io.SeekCurrent)
+	if err == nil {
+		err = file.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("cannot write image file: %w", err)
+	}
+
+	filename := *out
+	if len(filename) == 0 {
+		filename = *imageID + info.GetImageType()
+	}
+	err = os.Rename(file.Name(), filename)
+	if err != nil {
+		return fmt.Errorf("cannot write image file: %w", err)
+	}
+
+	return printValue(options, downloadedImageTable, downloadedImage{
+		File:     filename,
+		Type:     info.GetImageType(),
+		Size:     size,
+		Checksum: info.GetChecksum(),
+	})
+}
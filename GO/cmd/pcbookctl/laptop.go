@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"pcbook/client"
+	pb "pcbook/generateProto"
+	"pcbook/serializer"
+	"strconv"
+)
+
+var laptopTable = table[*pb.Laptop]{
+	header: []string{"ID", "BRAND", "NAME", "CPU", "CORES", "RAM", "PRICE USD", "OWNER"},
+	row: func(laptop *pb.Laptop) []string {
+		return []string{
+			laptop.GetId(),
+			laptop.GetBrand(),
+			laptop.GetName(),
+			laptop.GetCpu().GetName(),
+			strconv.Itoa(int(laptop.GetCpu().GetNumberCores())),
+			fmt.Sprintf("%d %s", laptop.GetRam().GetValue(), laptop.GetRam().GetUnit()),
+			strconv.FormatFloat(laptop.GetPriceUsd(), 'f', 2, 64),
+			laptop.GetOwner(),
+		}
+	},
+}
+
+var laptopIDTable = table[*pb.CreateLaptopResponse]{
+	header: []string{"ID"},
+	row: func(res *pb.CreateLaptopResponse) []string {
+		return []string{res.GetId()}
+	},
+}
+
+func runLaptop(ctx context.Context, options *globalOptions, args []string) error {
+	if len(args) == 0 {
+		return usagef("laptop: a subcommand is required: create, get, search or delete")
+	}
+
+	switch args[0] {
+	case "create":
+		return runLaptopCreate(ctx, options, args[1:])
+	case "get":
+		return runLaptopGet(ctx, options, args[1:])
+	case "search":
+		return runLaptopSearch(ctx, options, args[1:])
+	case "delete":
+		return runLaptopDelete(ctx, options, args[1:])
+	default:
+		return usagef("laptop: unknown subcommand %q", args[0])
+	}
+}
+
+func runLaptopCreate(ctx context.Context, options *globalOptions, args []string) error {
+	flags := flag.NewFlagSet("laptop create", flag.ContinueOnError)
+	file := flags.String("file", "-", "JSON file of the laptop, - for stdin")
+	err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+	if *file == "-" {
+		data, err = io.ReadAll(options.stdin)
+	} else {
+		data, err = os.ReadFile(*file)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read laptop: %w", err)
+	}
+
+	laptop := &pb.Laptop{}
+	err = serializer.JSONToProtobuf(string(data), laptop)
+	if err != nil {
+		return fmt.Errorf("cannot parse laptop: %w", err)
+	}
+
+	conn, err := dialAuthenticated(ctx, options, true)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	id, err := client.NewLaptopClient(conn).CreateLaptop(ctx, laptop)
+	if err != nil {
+		return err
+	}
+	return printValue(options, laptopIDTable, &pb.CreateLaptopResponse{Id: id})
+}
+
+func runLaptopGet(ctx context.Context, options *globalOptions, args []string) error {
+	flags := flag.NewFlagSet("laptop get", flag.ContinueOnError)
+	err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return usagef("laptop get: a laptop ID is required")
+	}
+
+	conn, err := dialAuthenticated(ctx, options, false)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	laptop, err := client.NewLaptopClient(conn).GetLaptop(ctx, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	return printValue(options, laptopTable, laptop)
+}
+
+func runLaptopSearch(ctx context.Context, options *globalOptions, args []string) error {
+	flags := flag.NewFlagSet("laptop search", flag.ContinueOnError)
+	maxPrice := flags.Float64("max-price", 0, "maximum price in USD, 0 for any price")
+	minCores := flags.Uint("min-cores", 0, "minimum number of CPU cores")
+	minGhz := flags.Float64("min-ghz", 0, "minimum CPU frequency in GHz")
+	minRAM := flags.Uint64("min-ram", 0, "minimum RAM in GB")
+	owner := flags.String("owner", "", "only the laptops of this user")
+	err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+
+	filter := &pb.Filter{
+		MaxPriceUsd: *maxPrice,
+		MinCpuCores: uint32(*minCores),
+		MinCpuGhz:   *minGhz,
+		MinRam:      &pb.Memory{Value: *minRAM, Unit: pb.Memory_GIGABYTE},
+		Owner:       *owner,
+	}
+
+	conn, err := dialAuthenticated(ctx, options, false)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	it, err := client.NewLaptopClient(conn).SearchLaptop(ctx, filter)
+	if err != nil {
+		return err
+	}
+	laptops, err := it.All()
+	if err != nil {
+		return err
+	}
+	return printValues(options, laptopTable, laptops)
+}
+
+func runLaptopDelete(ctx context.Context, options *globalOptions, args []string) error {
+	flags := flag.NewFlagSet("laptop delete", flag.ContinueOnError)
+	err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return usagef("laptop delete: a laptop ID is required")
+	}
+
+	conn, err := dialAuthenticated(ctx, options, true)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return client.NewLaptopClient(conn).DeleteLaptop(ctx, flags.Arg(0))
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"pcbook/client"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func runLogin(ctx context.Context, options *globalOptions, args []string) error {
+	flags := flag.NewFlagSet("login", flag.ContinueOnError)
+	userName := flags.String("user", "", "name of the user")
+	password := flags.String("password", "", "password of the user, read from the terminal or stdin if empty")
+	otp := flags.String("otp", "", "one-time password or recovery code, read from stdin if the user has two-factor authentication")
+	err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(*userName) == 0 {
+		return usagef("login: -user is required")
+	}
+
+	if len(*password) == 0 {
+		*password, err = readSecret(options, "password: ")
+		if err != nil {
+			return err
+		}
+	}
+
+	conn, err := dial(options)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	authClient := client.NewAuthClient(conn)
+	tokens, err := authClient.Login(ctx, *userName, *password)
+	var otpRequired *client.OTPRequiredError
+	if errors.As(err, &otpRequired) {
+		if len(*otp) == 0 {
+			*otp, err = readLine(options, "one-time password: ")
+			if err != nil {
+				return err
+			}
+		}
+		tokens, err = authClient.VerifyOTP(ctx, otpRequired.Challenge, *otp)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot login: %w", err)
+	}
+
+	err = writeTokenCache(options.tokenFile, &tokenCache{
+		Address:      options.address,
+		UserName:     *userName,
+		AccessToken:  tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "logged in to %s as %s\n", options.address, *userName)
+	return nil
+}
+
+func runLogout(ctx context.Context, options *globalOptions, args []string) error {
+	flags := flag.NewFlagSet("logout", flag.ContinueOnError)
+	err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+
+	cache, err := readTokenCache(options.tokenFile)
+	if err != nil {
+		return err
+	}
+
+	conn, err := dial(options)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// a session that has expired already is as good as revoked
+	err = client.NewAuthClient(conn).Logout(ctx, cache.RefreshToken)
+	if err != nil && status.Code(err) != codes.Unauthenticated {
+		return fmt.Errorf("cannot logout: %w", err)
+	}
+
+	err = os.Remove(options.tokenFile)
+	if err != nil {
+		return fmt.Errorf("cannot remove token file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+// Command pcbookctl manages the laptops, images, ratings and users of a pcbook server.
+//
+// Usage:
+//
+//	pcbookctl [global flags] <command> [flags] [arguments]
+//
+// Run pcbookctl -h for the list of commands.
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+
+	"golang.org/x/term"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Exit codes. A call rejected by the server exits with exitStatusBase plus its gRPC code,
+// e.g. 15 for NotFound and 17 for PermissionDenied.
+const (
+	exitError      = 1
+	exitUsage      = 2
+	exitStatusBase = 10
+)
+
+const usage = `Usage: pcbookctl [global flags] <command> [flags] [arguments]
+
+Commands:
+  login                         log in and cache the tokens
+  logout                        revoke the cached tokens
+  laptop create [-file F]       create a laptop from JSON, read from stdin by default
+  laptop get ID                 show a laptop
+  laptop search [flags]         search laptops
+  laptop delete ID              delete a laptop
+  image upload -laptop ID FILE...
+                                upload images of a laptop
+  image download -laptop ID -image ID [-out F]
+                                download an image
+  rate LAPTOP_ID=SCORE...       rate laptops
+  user list                     list the users
+  user create -name N -role R   create a user, the password is read from the terminal or stdin
+  user delete NAME              delete a user
+  user set-role NAME ROLE       change the role of a user
+
+Run "pcbookctl <command> -h" for the flags of a command.
+
+A call rejected by the server exits with 10 plus its gRPC status code,
+e.g. 15 for NotFound, 17 for PermissionDenied and 26 for Unauthenticated.
+
+Global flags:
+`
+
+// usageError is a command line that cannot be run.
+type usageError struct {
+	message string
+}
+
+func (e *usageError) Error() string {
+	return e.message
+}
+
+func usagef(format string, args ...interface{}) error {
+	return &usageError{message: fmt.Sprintf(format, args...)}
+}
+
+// globalOptions are the flags shared by every command.
+type globalOptions struct {
+	address   string
+	caCert    string
+	cert      string
+	key       string
+	tenantID  string
+	apiKey    string
+	tokenFile string
+	output    string
+
+	stdin  *bufio.Reader
+	stdout io.Writer
+	// terminal is stdin if it is a terminal, to read passwords without echo
+	terminal *os.File
+}
+
+type command func(ctx context.Context, options *globalOptions, args []string) error
+
+var commands = map[string]command{
+	"login":  runLogin,
+	"logout": runLogout,
+	"laptop": runLaptop,
+	"image":  runImage,
+	"rate":   runRate,
+	"user":   runUser,
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	err := run(ctx, os.Args[1:], os.Stdin, os.Stdout)
+	stop()
+
+	if err != nil && !errors.Is(err, flag.ErrHelp) {
+		fmt.Fprintln(os.Stderr, "pcbookctl:", err)
+	}
+	os.Exit(exitCode(err))
+}
+
+func run(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer) error {
+	options := &globalOptions{
+		stdin:  bufio.NewReader(stdin),
+		stdout: stdout,
+	}
+	if file, ok := stdin.(*os.File); ok && term.IsTerminal(int(file.Fd())) {
+		options.terminal = file
+	}
+
+	flags := flag.NewFlagSet("pcbookctl", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), usage)
+		flags.PrintDefaults()
+	}
+	flags.StringVar(&options.address, "address", "localhost:8080", "address of the server")
+	flags.StringVar(&options.caCert, "ca-cert", "cert/ca-cert.pem", "CA certificate that signed the server certificate")
+	flags.StringVar(&options.cert, "cert", "cert/client-cert.pem", "client certificate")
+	flags.StringVar(&options.key, "key", "cert/client-key.pem", "private key of the client certificate")
+	flags.StringVar(&options.tenantID, "tenant", "", "tenant whose catalog to use, the tenant of the credentials if empty")
+	flags.StringVar(&options.apiKey, "api-key", "", "API key to authenticate with instead of the cached tokens")
+	flags.StringVar(&options.tokenFile, "token-file", defaultTokenFile(), "file caching the tokens of the last login")
+	flags.StringVar(&options.output, "output", formatTable, "output format: table, json or yaml")
+	err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+
+	if !isFormat(options.output) {
+		return usagef("unknown output format %q", options.output)
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return usagef("a command is required")
+	}
+
+	name := flags.Arg(0)
+	cmd, ok := commands[name]
+	if !ok {
+		return usagef("unknown command %q", name)
+	}
+	return cmd(ctx, options, flags.Args()[1:])
+}
+
+// parseFlags parses the flags of a command, which print their own error and usage.
+func parseFlags(flags *flag.FlagSet, args []string) error {
+	err := flags.Parse(args)
+	if err != nil && !errors.Is(err, flag.ErrHelp) {
+		return &usageError{message: err.Error()}
+	}
+	return err
+}
+
+func defaultTokenFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ".pcbook-token.json"
+	}
+	return filepath.Join(dir, "pcbook", "token.json")
+}
+
+// exitCode tells apart usage errors, local failures and the status of calls rejected by the server.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+
+	var usageErr *usageError
+	if errors.As(err, &usageErr) {
+		return exitUsage
+	}
+
+	var grpcErr interface{ GRPCStatus() *status.Status }
+	if errors.As(err, &grpcErr) {
+		code := grpcErr.GRPCStatus().Code()
+		if code != codes.OK {
+			return exitStatusBase + int(code)
+		}
+	}
+
+	return exitError
+}
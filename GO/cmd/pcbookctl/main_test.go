@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	pb "pcbook/generateProto"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRunUsage(t *testing.T) {
+	t.Parallel()
+
+	// every command line fails before dialing, the server address is never used
+	testCases := []struct {
+		name string
+		args []string
+		code int
+	}{
+		{"no command", []string{}, exitUsage},
+		{"unknown command", []string{"fly"}, exitUsage},
+		{"unknown output format", []string{"-output", "xml", "laptop", "get", "id"}, exitUsage},
+		{"unknown global flag", []string{"-verbose", "laptop", "get", "id"}, exitUsage},
+		{"help", []string{"-h"}, 0},
+		{"command help", []string{"laptop", "search", "-h"}, 0},
+		{"login without user", []string{"login"}, exitUsage},
+		{"laptop without subcommand", []string{"laptop"}, exitUsage},
+		{"unknown laptop subcommand", []string{"laptop", "fly"}, exitUsage},
+		{"laptop get without id", []string{"laptop", "get"}, exitUsage},
+		{"laptop get with two ids", []string{"laptop", "get", "id1", "id2"}, exitUsage},
+		{"laptop delete without id", []string{"laptop", "delete"}, exitUsage},
+		{"invalid search flag", []string{"laptop", "search", "-max-price", "cheap"}, exitUsage},
+		{"image without subcommand", []string{"image"}, exitUsage},
+		{"image upload without laptop", []string{"image", "upload", "laptop.png"}, exitUsage},
+		{"image upload without file", []string{"image", "upload", "-laptop", "id"}, exitUsage},
+		{"image download without image", []string{"image", "download", "-laptop", "id"}, exitUsage},
+		{"rate without score", []string{"rate"}, exitUsage},
+		{"rate without separator", []string{"rate", "id"}, exitUsage},
+		{"rate with invalid score", []string{"rate", "id=high"}, exitUsage},
+		{"user without subcommand", []string{"user"}, exitUsage},
+		{"user create without name", []string{"user", "create"}, exitUsage},
+		{"user delete without name", []string{"user", "delete"}, exitUsage},
+		{"user set-role without role", []string{"user", "set-role", "alice"}, exitUsage},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			args := append([]string{"-address", "unused:0", "-token-file", filepath.Join(t.TempDir(), "token.json")}, tc.args...)
+			stdout := &bytes.Buffer{}
+			err := run(context.Background(), args, strings.NewReader(""), stdout)
+			require.Equal(t, tc.code, exitCode(err), "error: %v", err)
+			require.Empty(t, stdout.String())
+		})
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name string
+		err  error
+		code int
+	}{
+		{"success", nil, 0},
+		{"help", flag.ErrHelp, 0},
+		{"usage", usagef("laptop get: a laptop ID is required"), 2},
+		{"local failure", errors.New("cannot read CA certificate"), 1},
+		{"not found", status.Error(codes.NotFound, "laptop id doesn't exist"), 15},
+		{"permission denied", status.Error(codes.PermissionDenied, "not the owner"), 17},
+		{"unavailable", status.Error(codes.Unavailable, "connection refused"), 24},
+		{"wrapped status", fmt.Errorf("cannot login: %w", status.Error(codes.Unauthenticated, "invalid password")), 26},
+		{"not logged in", errNotLoggedIn, 26},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			require.Equal(t, tc.code, exitCode(tc.err))
+		})
+	}
+}
+
+func TestOutputFormats(t *testing.T) {
+	t.Parallel()
+
+	images := []uploadedImage{
+		{File: "front.png", ImageID: "image-1", Size: 2048, Attempts: 1},
+		{File: "back.png", Attempts: 3, Error: "connection refused"},
+	}
+	user := &pb.UserInfo{Username: "alice", Role: "admin"}
+
+	testCases := []struct {
+		format string
+		values string
+		value  string
+	}{
+		{
+			format: formatTable,
+			values: "FILE       IMAGE ID  SIZE  ATTEMPTS  ERROR\n" +
+				"front.png  image-1   2048  1         \n" +
+				"back.png             0     3         connection refused\n",
+			value: "USERNAME  ROLE\n" +
+				"alice     admin\n",
+		},
+		{
+			format: formatJSON,
+			values: `[
+  {
+    "file": "front.png",
+    "image_id": "image-1",
+    "size": 2048,
+    "attempts": 1
+  },
+  {
+    "file": "back.png",
+    "attempts": 3,
+    "error": "connection refused"
+  }
+]
+`,
+			value: `{
+  "username": "alice",
+  "role": "admin"
+}
+`,
+		},
+		{
+			format: formatYAML,
+			values: `- file: front.png
+  image_id: image-1
+  size: 2048
+  attempts: 1
+- file: back.png
+  attempts: 3
+  error: connection refused
+`,
+			value: `username: alice
+role: admin
+`,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.format, func(t *testing.T) {
+			t.Parallel()
+
+			stdout := &bytes.Buffer{}
+			options := &globalOptions{output: tc.format, stdout: stdout}
+			require.NoError(t, printValues(options, uploadedImageTable, images))
+			require.Equal(t, tc.values, stdout.String())
+
+			stdout.Reset()
+			require.NoError(t, printValue(options, userTable, user))
+			require.Equal(t, tc.value, stdout.String())
+		})
+	}
+}
+
+func TestTokenCache(t *testing.T) {
+	t.Parallel()
+
+	filename := filepath.Join(t.TempDir(), "pcbook", "token.json")
+	_, err := readTokenCache(filename)
+	require.ErrorIs(t, err, errNotLoggedIn)
+
+	cache := &tokenCache{
+		Address:      "localhost:8080",
+		UserName:     "alice",
+		AccessToken:  "access",
+		RefreshToken: "refresh",
+	}
+	require.NoError(t, writeTokenCache(filename, cache))
+
+	info, err := os.Stat(filename)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	info, err = os.Stat(filepath.Dir(filename))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0700), info.Mode().Perm())
+
+	read, err := readTokenCache(filename)
+	require.NoError(t, err)
+	require.Equal(t, cache, read)
+
+	// a token file readable by others is replaced by a private one
+	require.NoError(t, os.Chmod(filename, 0644))
+	cache.AccessToken = "renewed"
+	require.NoError(t, writeTokenCache(filename, cache))
+	info, err = os.Stat(filename)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	entries, err := os.ReadDir(filepath.Dir(filename))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
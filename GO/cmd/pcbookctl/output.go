@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"pcbook/serializer"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/golang/protobuf/proto"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	formatTable = "table"
+	formatJSON  = "json"
+	formatYAML  = "yaml"
+)
+
+func isFormat(format string) bool {
+	return format == formatTable || format == formatJSON || format == formatYAML
+}
+
+// table describes how to show values of one type as the rows of a table.
+type table[T any] struct {
+	header []string
+	row    func(value T) []string
+}
+
+// printValue writes a single value, as an object in JSON and YAML.
+func printValue[T any](options *globalOptions, t table[T], value T) error {
+	if options.output == formatTable {
+		return printTable(options.stdout, t, []T{value})
+	}
+
+	data, err := toJSON(value)
+	if err != nil {
+		return err
+	}
+	return printJSON(options, data)
+}
+
+// printValues writes a list of values, as an array in JSON and YAML.
+func printValues[T any](options *globalOptions, t table[T], values []T) error {
+	if options.output == formatTable {
+		return printTable(options.stdout, t, values)
+	}
+
+	items := make([]json.RawMessage, len(values))
+	for i, value := range values {
+		data, err := toJSON(value)
+		if err != nil {
+			return err
+		}
+		items[i] = data
+	}
+
+	data, err := json.Marshal(items)
+	if err != nil {
+		return fmt.Errorf("cannot serialize output: %w", err)
+	}
+	return printJSON(options, data)
+}
+
+// toJSON serializes protobuf messages with their proto field names, and other values with encoding/json.
+func toJSON(value interface{}) ([]byte, error) {
+	if message, ok := value.(proto.Message); ok {
+		data, err := serializer.ProtobufToJSON(message)
+		if err != nil {
+			return nil, fmt.Errorf("cannot serialize output: %w", err)
+		}
+		return []byte(data), nil
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf("cannot serialize output: %w", err)
+	}
+	return data, nil
+}
+
+func printJSON(options *globalOptions, data []byte) error {
+	if options.output == formatYAML {
+		return printYAML(options.stdout, data)
+	}
+
+	out := bytes.Buffer{}
+	err := json.Indent(&out, data, "", "  ")
+	if err != nil {
+		return fmt.Errorf("cannot format output: %w", err)
+	}
+	out.WriteByte('\n')
+
+	_, err = out.WriteTo(options.stdout)
+	return err
+}
+
+// printYAML converts JSON to YAML, keeping the order of the fields.
+func printYAML(w io.Writer, data []byte) error {
+	node := &yaml.Node{}
+	err := yaml.Unmarshal(data, node)
+	if err != nil {
+		return fmt.Errorf("cannot convert output to YAML: %w", err)
+	}
+	blockStyle(node)
+
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	err = encoder.Encode(node)
+	if err != nil {
+		return fmt.Errorf("cannot convert output to YAML: %w", err)
+	}
+	return encoder.Close()
+}
+
+// blockStyle drops the flow style and the quotes that the nodes parsed from JSON keep.
+func blockStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, child := range node.Content {
+		blockStyle(child)
+	}
+}
+
+func printTable[T any](w io.Writer, t table[T], values []T) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(t.header, "\t"))
+	for _, value := range values {
+		fmt.Fprintln(tw, strings.Join(t.row(value), "\t"))
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"pcbook/client"
+	pb "pcbook/generateProto"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/status"
+)
+
+var ratingTable = table[*pb.RateLaptopResponse]{
+	header: []string{"LAPTOP ID", "RATED", "AVERAGE", "ERROR"},
+	row: func(res *pb.RateLaptopResponse) []string {
+		return []string{
+			res.GetLaptopId(),
+			strconv.Itoa(int(res.GetRatedCount())),
+			strconv.FormatFloat(res.GetAverageCore(), 'f', 2, 64),
+			res.GetErrorMessage(),
+		}
+	},
+}
+
+func runRate(ctx context.Context, options *globalOptions, args []string) error {
+	flags := flag.NewFlagSet("rate", flag.ContinueOnError)
+	err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return usagef("rate: at least one LAPTOP_ID=SCORE is required")
+	}
+
+	laptopIDs := make([]string, flags.NArg())
+	scores := make([]float64, flags.NArg())
+	for i, arg := range flags.Args() {
+		laptopID, score, ok := strings.Cut(arg, "=")
+		if !ok {
+			return usagef("rate: %q is not LAPTOP_ID=SCORE", arg)
+		}
+		laptopIDs[i] = laptopID
+		scores[i], err = strconv.ParseFloat(score, 64)
+		if err != nil {
+			return usagef("rate: invalid score %q", score)
+		}
+	}
+
+	conn, err := dialAuthenticated(ctx, options, true)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ratings, err := client.NewLaptopClient(conn).RateLaptop(ctx, laptopIDs, scores)
+	if err != nil {
+		return err
+	}
+
+	responses := make([]*pb.RateLaptopResponse, len(ratings))
+	var failure error
+	for i, rating := range ratings {
+		st := status.Convert(rating.Err)
+		responses[i] = &pb.RateLaptopResponse{
+			LaptopId:     rating.LaptopID,
+			RatedCount:   rating.RatedCount,
+			AverageCore:  rating.AverageScore,
+			Ok:           rating.Err == nil,
+			ErrorCode:    int32(st.Code()),
+			ErrorMessage: st.Message(),
+		}
+		if rating.Err != nil && failure == nil {
+			failure = fmt.Errorf("cannot rate laptop %s: %w", rating.LaptopID, rating.Err)
+		}
+	}
+
+	err = printValues(options, ratingTable, responses)
+	if err != nil {
+		return err
+	}
+	return failure
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"pcbook/client"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"golang.org/x/term"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+// refreshMargin is how long before its expiry a cached access token is refreshed,
+// so that it doesn't expire in the middle of a command.
+const refreshMargin = 30 * time.Second
+
+// tokenCache is the content of the token file written by login.
+type tokenCache struct {
+	Address      string `json:"address"`
+	UserName     string `json:"username"`
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+var errNotLoggedIn = status.Error(codes.Unauthenticated, `not logged in, run "pcbookctl login" first`)
+
+func readTokenCache(filename string) (*tokenCache, error) {
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errNotLoggedIn
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read token file: %w", err)
+	}
+
+	cache := &tokenCache{}
+	err = json.Unmarshal(data, cache)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse token file %s: %w", filename, err)
+	}
+	return cache, nil
+}
+
+// writeTokenCache saves the tokens in a file only the current user can read.
+func writeTokenCache(filename string, cache *tokenCache) error {
+	data, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return fmt.Errorf("cannot serialize tokens: %w", err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(filename), 0700)
+	if err != nil {
+		return fmt.Errorf("cannot create token directory: %w", err)
+	}
+
+	// a new file is created with mode 0600, so that an existing file readable by others is replaced too
+	file, err := os.CreateTemp(filepath.Dir(filename), ".token-*")
+	if err != nil {
+		return fmt.Errorf("cannot write token file: %w", err)
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.Write(append(data, '\n'))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), filename)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot write token file: %w", err)
+	}
+	return nil
+}
+
+func loadTLSCredentials(options *globalOptions) (credentials.TransportCredentials, error) {
+	pemServerCA, err := os.ReadFile(options.caCert)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read CA certificate: %w", err)
+	}
+
+	certPool := x509.NewCertPool()
+	if !certPool.AppendCertsFromPEM(pemServerCA) {
+		return nil, errors.New("cannot add server CA to cert pool")
+	}
+
+	// the server requires a client certificate signed by the same CA
+	clientCert, err := tls.LoadX509KeyPair(options.cert, options.key)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load client certificate: %w", err)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{clientCert},
+		RootCAs:      certPool,
+	}
+	return credentials.NewTLS(config), nil
+}
+
+// dial connects to the server without credentials other than the tenant,
+// retrying the laptop calls as configured by default.
+func dial(options *globalOptions, dialOptions ...grpc.DialOption) (*grpc.ClientConn, error) {
+	tlsCredentials, err := loadTLSCredentials(options)
+	if err != nil {
+		return nil, err
+	}
+
+	dialOptions = append(dialOptions, client.DefaultServiceConfig().DialOptions()...)
+	dialOptions = append(dialOptions, grpc.WithTransportCredentials(tlsCredentials))
+	if len(options.tenantID) > 0 {
+		dialOptions = append(dialOptions, grpc.WithPerRPCCredentials(client.NewTenantCredentials(options.tenantID)))
+	}
+
+	conn, err := grpc.Dial(options.address, dialOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot dial server: %w", err)
+	}
+	return conn, nil
+}
+
+// dialAuthenticated connects to the server with the API key, or else the cached access token,
+// refreshing it first if it is about to expire. Without any credentials, it fails unless required is false.
+func dialAuthenticated(ctx context.Context, options *globalOptions, required bool) (*grpc.ClientConn, error) {
+	if len(options.apiKey) > 0 {
+		return dial(options, grpc.WithPerRPCCredentials(client.NewAPIKeyCredentials(options.apiKey)))
+	}
+
+	cache, err := readTokenCache(options.tokenFile)
+	if errors.Is(err, errNotLoggedIn) && !required {
+		return dial(options)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if cache.Address != options.address {
+		return nil, status.Errorf(codes.Unauthenticated,
+			`the cached tokens are for %s, run "pcbookctl -address %s login" first`, cache.Address, options.address)
+	}
+
+	if expiresSoon(cache.AccessToken) {
+		err = refreshTokens(ctx, options, cache)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return dial(options, grpc.WithPerRPCCredentials(client.NewTokenCredentials(cache.AccessToken)))
+}
+
+// expiresSoon reads the expiry of the token without verifying it, the server does that.
+func expiresSoon(accessToken string) bool {
+	claims := &jwt.StandardClaims{}
+	_, _, err := new(jwt.Parser).ParseUnverified(accessToken, claims)
+	if err != nil || claims.ExpiresAt == 0 {
+		return false
+	}
+	return time.Until(time.Unix(claims.ExpiresAt, 0)) < refreshMargin
+}
+
+func refreshTokens(ctx context.Context, options *globalOptions, cache *tokenCache) error {
+	conn, err := dial(options)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	tokens, err := client.NewAuthClient(conn).RefreshToken(ctx, cache.RefreshToken)
+	if status.Code(err) == codes.Unauthenticated {
+		return status.Error(codes.Unauthenticated, `the session has expired, run "pcbookctl login" again`)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot refresh token: %w", err)
+	}
+
+	cache.AccessToken = tokens.AccessToken
+	cache.RefreshToken = tokens.RefreshToken
+	return writeTokenCache(options.tokenFile, cache)
+}
+
+// readSecret reads a password from the terminal without echoing it, or else the next line of stdin.
+func readSecret(options *globalOptions, prompt string) (string, error) {
+	if options.terminal == nil {
+		return readLine(options, prompt)
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+	secret, err := term.ReadPassword(int(options.terminal.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("cannot read from terminal: %w", err)
+	}
+	return string(secret), nil
+}
+
+// readLine reads the next line of stdin, such as a one-time password.
+func readLine(options *globalOptions, prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	line, err := options.stdin.ReadString('\n')
+	if err != nil && len(line) == 0 {
+		return "", fmt.Errorf("cannot read from stdin: %w", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"flag"
+	pb "pcbook/generateProto"
+)
+
+var userTable = table[*pb.UserInfo]{
+	header: []string{"USERNAME", "ROLE"},
+	row: func(user *pb.UserInfo) []string {
+		return []string{user.GetUsername(), user.GetRole()}
+	},
+}
+
+func runUser(ctx context.Context, options *globalOptions, args []string) error {
+	if len(args) == 0 {
+		return usagef("user: a subcommand is required: list, create, delete or set-role")
+	}
+
+	switch args[0] {
+	case "list":
+		return runUserList(ctx, options, args[1:])
+	case "create":
+		return runUserCreate(ctx, options, args[1:])
+	case "delete":
+		return runUserDelete(ctx, options, args[1:])
+	case "set-role":
+		return runUserSetRole(ctx, options, args[1:])
+	default:
+		return usagef("user: unknown subcommand %q", args[0])
+	}
+}
+
+// dialAuthService connects to the auth service with the credentials of an admin.
+func dialAuthService(ctx context.Context, options *globalOptions, call func(authService pb.AuthServiceClient) error) error {
+	conn, err := dialAuthenticated(ctx, options, true)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return call(pb.NewAuthServiceClient(conn))
+}
+
+func runUserList(ctx context.Context, options *globalOptions, args []string) error {
+	flags := flag.NewFlagSet("user list", flag.ContinueOnError)
+	err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+
+	return dialAuthService(ctx, options, func(authService pb.AuthServiceClient) error {
+		res, err := authService.ListUsers(ctx, &pb.ListUsersRequest{})
+		if err != nil {
+			return err
+		}
+		return printValues(options, userTable, res.GetUsers())
+	})
+}
+
+func runUserCreate(ctx context.Context, options *globalOptions, args []string) error {
+	flags := flag.NewFlagSet("user create", flag.ContinueOnError)
+	name := flags.String("name", "", "name of the user")
+	role := flags.String("role", "user", "role of the user")
+	err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(*name) == 0 {
+		return usagef("user create: -name is required")
+	}
+
+	password, err := readSecret(options, "password of the new user: ")
+	if err != nil {
+		return err
+	}
+
+	return dialAuthService(ctx, options, func(authService pb.AuthServiceClient) error {
+		res, err := authService.CreateUser(ctx, &pb.CreateUserRequest{
+			Username: *name,
+			Password: password,
+			Role:     *role,
+		})
+		if err != nil {
+			return err
+		}
+		return printValue(options, userTable, res.GetUser())
+	})
+}
+
+func runUserDelete(ctx context.Context, options *globalOptions, args []string) error {
+	flags := flag.NewFlagSet("user delete", flag.ContinueOnError)
+	err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return usagef("user delete: a user name is required")
+	}
+
+	return dialAuthService(ctx, options, func(authService pb.AuthServiceClient) error {
+		_, err := authService.DeleteUser(ctx, &pb.DeleteUserRequest{Username: flags.Arg(0)})
+		return err
+	})
+}
+
+func runUserSetRole(ctx context.Context, options *globalOptions, args []string) error {
+	flags := flag.NewFlagSet("user set-role", flag.ContinueOnError)
+	err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return usagef("user set-role: a user name and a role are required")
+	}
+
+	return dialAuthService(ctx, options, func(authService pb.AuthServiceClient) error {
+		res, err := authService.SetUserRole(ctx, &pb.SetUserRoleRequest{
+			Username: flags.Arg(0),
+			Role:     flags.Arg(1),
+		})
+		if err != nil {
+			return err
+		}
+		return printValue(options, userTable, res.GetUser())
+	})
+}
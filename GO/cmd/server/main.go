@@ -2,12 +2,19 @@ package main
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"path/filepath"
+	"pcbook/authpolicy"
 	pb "pcbook/generateProto"
 	"pcbook/service"
+	"strings"
 	"time"
 
 	"google.golang.org/grpc"
@@ -16,36 +23,201 @@ import (
 )
 
 const (
-	secretKey     = "secret"
-	tokenDuration = 15 * time.Minute
+	secretKey            = "secret"
+	tokenDuration        = 15 * time.Minute
+	refreshTokenDuration = 7 * 24 * time.Hour
+
+	maxImagesPerLaptop = 10
 )
 
-func accessibleRoles() map[string][]string {
-	laptopServicePath := "/pcbook.LaptopService/"
-	return map[string][]string{
-		laptopServicePath + "CreateLaptop": {"admin"},
-		laptopServicePath + "UploadImage":  {"admin"},
-		laptopServicePath + "RateLaptop":   {"admin", "user"},
+func authPolicies() (map[string]*pb.AuthPolicy, error) {
+	policies, err := authpolicy.Load(
+		pb.AuthService_ServiceDesc.ServiceName,
+		pb.LaptopService_ServiceDesc.ServiceName,
+		pb.ReviewService_ServiceDesc.ServiceName,
+	)
+	if err != nil {
+		return nil, err
 	}
+
+	// server reflection comes from grpc so it cannot declare a policy, and it only exposes the API schema
+	policies["/grpc.reflection.v1alpha.ServerReflection/ServerReflectionInfo"] = &pb.AuthPolicy{Public: true}
+	return policies, nil
 }
 
-func createUser(userStore service.UserStore, username, password, role string) error {
-	user, err := service.NewUser(username, password, role)
+// seedUser is an account created at startup. Either the plain or the bcrypt-hashed password must be set.
+// Accounts without a tenant belong to the default tenant.
+type seedUser struct {
+	UserName       string `json:"username"`
+	Password       string `json:"password"`
+	HashedPassword string `json:"hashed_password"`
+	Role           string `json:"role"`
+	TenantID       string `json:"tenant"`
+}
+
+// loadRoles reads the role definitions from a JSON file, or returns the default roles if no file is given.
+func loadRoles(filename string) (*service.Roles, error) {
+	if len(filename) == 0 {
+		return service.DefaultRoles, nil
+	}
+
+	data, err := os.ReadFile(filename)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return userStore.Save(user)
+
+	definitions := map[string]service.RoleDefinition{}
+	err = json.Unmarshal(data, &definitions)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %w", filename, err)
+	}
+
+	return service.NewRoles(definitions)
 }
 
-func seedUsers(userStore service.UserStore) error {
-	err := createUser(userStore, "admin", "admin", "admin")
+func seedUsers(userStores map[string]service.UserStore, roles *service.Roles, filename string) error {
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("WARNING: seed user file %s doesn't exist, no account is created", filename)
+		return nil
+	}
 	if err != nil {
 		return err
 	}
-	return createUser(userStore, "user1", "user1", "user")
+
+	seeds := []seedUser{}
+	err = json.Unmarshal(data, &seeds)
+	if err != nil {
+		return fmt.Errorf("cannot parse %s: %w", filename, err)
+	}
+
+	for _, seed := range seeds {
+		// the account would otherwise get the hash of an empty password
+		if len(seed.Password) == 0 && len(seed.HashedPassword) == 0 {
+			return fmt.Errorf("user %s has neither a password nor a hashed_password", seed.UserName)
+		}
+		if !roles.Has(seed.Role) {
+			return fmt.Errorf("user %s has an unknown role: %s", seed.UserName, seed.Role)
+		}
+		if len(seed.TenantID) == 0 {
+			seed.TenantID = service.DefaultTenant
+		}
+		userStore, ok := userStores[seed.TenantID]
+		if !ok {
+			return fmt.Errorf("user %s has an unknown tenant: %s", seed.UserName, seed.TenantID)
+		}
+
+		user := &service.User{
+			UserName:       seed.UserName,
+			HashedPassword: seed.HashedPassword,
+			Role:           seed.Role,
+		}
+		if len(seed.HashedPassword) == 0 {
+			user, err = service.NewUser(seed.UserName, seed.Password, seed.Role)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = userStore.Save(user)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func hasTenant(tenantIDs []string, tenantID string) bool {
+	for _, id := range tenantIDs {
+		if id == tenantID {
+			return true
+		}
+	}
+	return false
+}
+
+// tenantFile returns the file of a tenant, e.g. ratings.acme.pb for ratings.pb.
+// The default tenant keeps the file itself, so the data of a single tenant deployment is kept.
+func tenantFile(filename string, tenantID string) string {
+	if tenantID == service.DefaultTenant {
+		return filename
+	}
+	ext := filepath.Ext(filename)
+	return strings.TrimSuffix(filename, ext) + "." + tenantID + ext
+}
+
+// newJWTManager signs tokens with the key in signingKeyFile, or with the shared secret if no file is given.
+// Tokens signed by the keys in verifyKeyFiles stay valid, so keys can be rotated without logging users out.
+func newJWTManager(signingKeyFile string, verifyKeyFiles string) (*service.JWTManager, error) {
+	if len(signingKeyFile) == 0 {
+		log.Print("WARNING: no JWT signing key, tokens are signed with the shared secret")
+		return service.NewJWTManager(secretKey, tokenDuration), nil
+	}
+
+	signingKey, err := service.LoadJWTKey(signingKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	verificationKeys := []*service.JWTKey{}
+	for _, filename := range strings.Split(verifyKeyFiles, ",") {
+		if len(filename) == 0 {
+			continue
+		}
+
+		key, err := service.LoadJWTKey(filename)
+		if err != nil {
+			return nil, err
+		}
+		verificationKeys = append(verificationKeys, key)
+	}
+
+	return service.NewJWTManagerWithKeys(signingKey, tokenDuration, verificationKeys...)
+}
+
+// parseCertIdentities parses comma-separated identity=role pairs, e.g. spiffe://pcbook/inventory=admin.
+// The role may name the tenant of the identity, e.g. spiffe://acme/inventory=admin@acme.
+func parseCertIdentities(value string, roles *service.Roles, tenantIDs []string) (service.CertIdentities, error) {
+	identities := service.CertIdentities{}
+	for _, pair := range strings.Split(value, ",") {
+		if len(pair) == 0 {
+			continue
+		}
+
+		index := strings.LastIndex(pair, "=")
+		if index <= 0 {
+			return nil, fmt.Errorf("cert identity %q is not of the form identity=role", pair)
+		}
+
+		identity, role := pair[:index], pair[index+1:]
+		tenantID := service.DefaultTenant
+		if at := strings.LastIndex(role, "@"); at >= 0 {
+			role, tenantID = role[:at], role[at+1:]
+		}
+		if !roles.Has(role) {
+			return nil, fmt.Errorf("cert identity %s has an unknown role: %s", identity, role)
+		}
+		if !hasTenant(tenantIDs, tenantID) {
+			return nil, fmt.Errorf("cert identity %s has an unknown tenant: %s", identity, tenantID)
+		}
+		identities[identity] = service.CertIdentity{Role: role, TenantID: tenantID}
+	}
+	return identities, nil
 }
 
 func loadTLSCredentials() (credentials.TransportCredentials, error) {
+	// client certificates must be signed by our CA
+	pemClientCA, err := os.ReadFile("cert/ca-cert.pem")
+	if err != nil {
+		return nil, err
+	}
+
+	certPool := x509.NewCertPool()
+	if !certPool.AppendCertsFromPEM(pemClientCA) {
+		return nil, errors.New("cannot add client CA to cert pool")
+	}
+
 	serverCert, err := tls.LoadX509KeyPair("cert/server-cert.pem", "cert/server-key.pem")
 	if err != nil {
 		return nil, err
@@ -55,35 +227,159 @@ func loadTLSCredentials() (credentials.TransportCredentials, error) {
 	config := tls.Config{
 		Certificates: []tls.Certificate{serverCert},
 		ClientAuth:   tls.RequireAndVerifyClientCert,
-		ClientCAs:    nil,
+		ClientCAs:    certPool,
 	}
 
 	return credentials.NewTLS(&config), nil
 }
 
+// collectImageGarbage removes the image files of every tenant that no laptop references anymore, every interval.
+func collectImageGarbage(imageStores map[string]*service.ContentAddressedImageStore, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for tenantID, imageStore := range imageStores {
+			removed, err := imageStore.GarbageCollect()
+			if err != nil {
+				log.Printf("cannot collect the images of tenant %s: %v", tenantID, err)
+			}
+			if removed > 0 {
+				log.Printf("removed %d unreferenced images of tenant %s", removed, tenantID)
+			}
+		}
+	}
+}
+
+// defaultAuditKeyFile keeps the audit key out of the working directory, where it could be committed with the log.
+func defaultAuditKeyFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ".pcbook-audit.key"
+	}
+	return filepath.Join(dir, "pcbook", "audit.key")
+}
+
 func main() {
 	port := flag.Int("port", 0, "port to listen on")
+	seedUserFile := flag.String("seed-users", "seed_users.json", "JSON file of accounts to create at startup")
+	minScore := flag.Float64("min-score", service.DefaultScoreRange.Min, "lowest accepted rating score")
+	maxScore := flag.Float64("max-score", service.DefaultScoreRange.Max, "highest accepted rating score")
+	ratingFile := flag.String("rating-file", "ratings.pb", "file to persist ratings in")
+	ratingHalfLife := flag.Duration("rating-half-life", 0, "half-life of rating weights, 0 disables time decay")
+	imageGCInterval := flag.Duration("image-gc-interval", time.Hour, "interval between removals of the image files no laptop references anymore, 0 disables them")
+	priorMean := flag.Float64("prior-mean", service.DefaultRatingPrior.Mean, "prior mean of the Bayesian rating average")
+	priorWeight := flag.Float64("prior-weight", service.DefaultRatingPrior.Weight, "number of prior ratings in the Bayesian rating average")
+	jwtKeyFile := flag.String("jwt-key", "", "PEM file of the RSA or Ed25519 private key that signs access tokens")
+	jwtVerifyKeyFiles := flag.String("jwt-verify-keys", "", "comma-separated PEM files of previous keys whose tokens are still accepted")
+	certIdentityList := flag.String("cert-identities", "", "comma-separated identity=role[@tenant] pairs authenticating callers by the SAN URI or CN of their client certificate")
+	roleFile := flag.String("roles", "", "JSON file defining the scopes and inherited roles of each role, the built-in roles if empty")
+	auditLogFile := flag.String("audit-log", "audit.log", "file of the hash-chained audit log of logins, authorization decisions and changes, no audit if empty")
+	auditKeyFile := flag.String("audit-key", defaultAuditKeyFile(), "file of the key of the audit log hashes, created if missing, to keep apart from the log")
+	tenantList := flag.String("tenants", service.DefaultTenant, "comma-separated ids of the tenants whose catalogs are served in isolation")
 	flag.Parse()
 	log.Print("starting server on port: ", *port)
 
-	userStore := service.NewInMemoryUserStore()
-	err := seedUsers(userStore)
+	roles, err := loadRoles(*roleFile)
+	if err != nil {
+		log.Fatal("cannot load roles: ", err)
+	}
+
+	tenantIDs := strings.Split(*tenantList, ",")
+	userStores := map[string]service.UserStore{}
+	for _, tenantID := range tenantIDs {
+		userStores[tenantID] = service.NewInMemoryUserStore()
+	}
+	err = seedUsers(userStores, roles, *seedUserFile)
 	if err != nil {
 		log.Fatal("cannot seed users: ", err)
 	}
 
-	jwtManager := service.NewJWTManager(secretKey, tokenDuration)
+	jwtManager, err := newJWTManager(*jwtKeyFile, *jwtVerifyKeyFiles)
+	if err != nil {
+		log.Fatal("cannot load jwt keys: ", err)
+	}
+
+	// one audit log records the events of every tenant, each admin only queries their tenant's records
+	var auditLog service.AuditLog
+	if len(*auditLogFile) > 0 {
+		auditKey, err := service.LoadAuditKey(*auditKeyFile)
+		if err != nil {
+			log.Fatal("cannot load audit key: ", err)
+		}
+		fileAuditLog, err := service.NewFileAuditLog(*auditLogFile, auditKey)
+		if err != nil {
+			log.Fatal("cannot open audit log: ", err)
+		}
+		defer fileAuditLog.Close()
+		auditLog = fileAuditLog
+	}
 
-	authServer := service.NewAuthServer(
-		userStore,
-		jwtManager,
-	)
+	// API keys are looked up by their secret before the tenant is known, each key records its tenant
+	apiKeyStore := service.NewInMemoryAPIKeyStore()
+	authServers, err := service.NewTenants(tenantIDs, func(tenantID string) (*service.AuthServer, error) {
+		return service.NewAuthServer(
+			userStores[tenantID],
+			jwtManager,
+			service.NewInMemoryRefreshTokenStore(),
+			refreshTokenDuration,
+			apiKeyStore,
+			service.WithRoles(roles),
+			service.WithTenant(tenantID),
+			service.WithAuditLog(auditLog),
+		), nil
+	})
+	if err != nil {
+		log.Fatal("cannot create auth servers: ", err)
+	}
 
-	laptopServer := service.NewLaptopServer(
-		service.NewInMemoryLaptopStore(),
-		service.NewDiskImageStore("img"),
-		service.NewInMemoryRatingStore(),
-	)
+	scoreRange := service.ScoreRange{
+		Min: *minScore,
+		Max: *maxScore,
+	}
+	reviewServerOf := map[string]*service.ReviewServer{}
+	imageStoreOf := map[string]*service.ContentAddressedImageStore{}
+	laptopServers, err := service.NewTenants(tenantIDs, func(tenantID string) (*service.LaptopServer, error) {
+		laptopStore := service.NewInMemoryLaptopStore()
+		ratingStore, err := service.NewFileRatingStore(tenantFile(*ratingFile, tenantID))
+		if err != nil {
+			return nil, fmt.Errorf("cannot load ratings: %w", err)
+		}
+
+		reviewServerOf[tenantID] = service.NewReviewServer(
+			service.NewInMemoryReviewStore(),
+			laptopStore,
+			ratingStore,
+			scoreRange,
+		)
+
+		imageStoreOf[tenantID] = service.NewContentAddressedImageStore(filepath.Join("img", tenantID), maxImagesPerLaptop)
+
+		return service.NewLaptopServer(
+			laptopStore,
+			imageStoreOf[tenantID],
+			ratingStore,
+			service.WithRatingPrior(service.RatingPrior{
+				Mean:   *priorMean,
+				Weight: *priorWeight,
+			}),
+			service.WithScoreRange(scoreRange),
+			service.WithRatingHalfLife(*ratingHalfLife),
+		), nil
+	})
+	if err != nil {
+		log.Fatal("cannot create laptop servers: ", err)
+	}
+	reviewServers, err := service.NewTenants(tenantIDs, func(tenantID string) (*service.ReviewServer, error) {
+		return reviewServerOf[tenantID], nil
+	})
+	if err != nil {
+		log.Fatal("cannot create review servers: ", err)
+	}
+	// deleted images and laptops only drop their references, their files are removed here
+	if *imageGCInterval > 0 {
+		go collectImageGarbage(imageStoreOf, *imageGCInterval)
+	}
 
 	// tsl credentials
 	creds, err := loadTLSCredentials()
@@ -91,7 +387,22 @@ func main() {
 		log.Fatal("cannot load tls credentials: ", err)
 	}
 
-	interceptor := service.NewAuthInterceptor(jwtManager, accessibleRoles())
+	policies, err := authPolicies()
+	if err != nil {
+		log.Fatal("cannot load auth policies: ", err)
+	}
+	certIdentities, err := parseCertIdentities(*certIdentityList, roles, tenantIDs)
+	if err != nil {
+		log.Fatal("cannot parse cert identities: ", err)
+	}
+	interceptor := service.NewAuthInterceptor(
+		jwtManager,
+		policies,
+		service.WithCertIdentities(certIdentities),
+		service.WithAPIKeys(apiKeyStore),
+		service.WithInterceptorRoles(roles),
+		service.WithInterceptorAuditLog(auditLog),
+	)
 
 	grpcServer := grpc.NewServer(
 		grpc.Creds(creds),
@@ -99,8 +410,9 @@ func main() {
 		grpc.StreamInterceptor(interceptor.Stream()),
 	)
 
-	pb.RegisterAuthServiceServer(grpcServer, authServer)
-	pb.RegisterLaptopServiceServer(grpcServer, laptopServer)
+	service.RegisterTenantService(grpcServer, &pb.AuthService_ServiceDesc, authServers)
+	service.RegisterTenantService(grpcServer, &pb.LaptopService_ServiceDesc, laptopServers)
+	service.RegisterTenantService(grpcServer, &pb.ReviewService_ServiceDesc, reviewServers)
 	reflection.Register(grpcServer)
 
 	address := fmt.Sprintf("0.0.0.0:%d", *port)
@@ -1,6 +1,8 @@
 package serializer
 
 import (
+	"strings"
+
 	// proto
 	proto "github.com/golang/protobuf/proto"
 	// jsonpb
@@ -19,3 +21,11 @@ func ProtobufToJSON(message proto.Message) (string, error) {
 	return marshaler.MarshalToString(message)
 
 }
+
+func JSONToProtobuf(data string, message proto.Message) error {
+	// unknown fields are rejected so that typos don't go unnoticed
+	unmarshaler := jsonpb.Unmarshaler{
+		AllowUnknownFields: false,
+	}
+	return unmarshaler.Unmarshal(strings.NewReader(data), message)
+}
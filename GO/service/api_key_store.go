@@ -0,0 +1,170 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrAPIKeyAlreadyExists = errors.New("api key already exists")
+	ErrAPIKeyNotFound      = errors.New("api key not found")
+)
+
+// APIKey is a credential of a service account. Only the hash of the secret is stored.
+type APIKey struct {
+	ID             string
+	TenantID       string
+	Name           string
+	Role           string
+	Hash           string
+	AllowedMethods []string
+	CreatedAt      time.Time
+	// ExpiresAt is zero if the key never expires
+	ExpiresAt time.Time
+	// LastUsedAt is zero if the key has never been used
+	LastUsedAt time.Time
+}
+
+// IsExpired reports whether the key has expired at the given time.
+func (key *APIKey) IsExpired(now time.Time) bool {
+	return !key.ExpiresAt.IsZero() && !now.Before(key.ExpiresAt)
+}
+
+// Allows reports whether the key may call the method.
+func (key *APIKey) Allows(fullMethod string) bool {
+	if len(key.AllowedMethods) == 0 {
+		return true
+	}
+	for _, method := range key.AllowedMethods {
+		if method == fullMethod {
+			return true
+		}
+	}
+	return false
+}
+
+func (key *APIKey) Clone() *APIKey {
+	other := *key
+	other.AllowedMethods = append([]string(nil), key.AllowedMethods...)
+	return &other
+}
+
+type APIKeyStore interface {
+	// Save stores a new API key
+	Save(key *APIKey) error
+	// FindByHash returns the API key whose secret has the given hash, whatever its tenant
+	FindByHash(hash string) (*APIKey, error)
+	// Delete removes the API key of the tenant with the given id
+	Delete(tenantID string, id string) error
+	// List returns the API keys of the tenant sorted by name
+	List(tenantID string) ([]*APIKey, error)
+	// Touch records that the API key with the given id has been used
+	Touch(id string, usedAt time.Time) error
+}
+
+type InMemoryAPIKeyStore struct {
+	mutex sync.RWMutex
+	keys  map[string]*APIKey
+}
+
+func NewInMemoryAPIKeyStore() *InMemoryAPIKeyStore {
+	return &InMemoryAPIKeyStore{
+		keys: make(map[string]*APIKey),
+	}
+}
+
+func (store *InMemoryAPIKeyStore) Save(key *APIKey) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.keys[key.ID] != nil {
+		return fmt.Errorf("api key %s: %w", key.ID, ErrAPIKeyAlreadyExists)
+	}
+
+	store.keys[key.ID] = key.Clone()
+	return nil
+}
+
+func (store *InMemoryAPIKeyStore) FindByHash(hash string) (*APIKey, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	for _, key := range store.keys {
+		if key.Hash == hash {
+			return key.Clone(), nil
+		}
+	}
+	return nil, ErrAPIKeyNotFound
+}
+
+func (store *InMemoryAPIKeyStore) Delete(tenantID string, id string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	key := store.keys[id]
+	if key == nil || key.TenantID != tenantID {
+		return fmt.Errorf("api key %s: %w", id, ErrAPIKeyNotFound)
+	}
+
+	delete(store.keys, id)
+	return nil
+}
+
+func (store *InMemoryAPIKeyStore) List(tenantID string) ([]*APIKey, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	keys := []*APIKey{}
+	for _, key := range store.keys {
+		if key.TenantID == tenantID {
+			keys = append(keys, key.Clone())
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Name != keys[j].Name {
+			return keys[i].Name < keys[j].Name
+		}
+		return keys[i].ID < keys[j].ID
+	})
+
+	return keys, nil
+}
+
+func (store *InMemoryAPIKeyStore) Touch(id string, usedAt time.Time) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	key := store.keys[id]
+	if key == nil {
+		return fmt.Errorf("api key %s: %w", id, ErrAPIKeyNotFound)
+	}
+
+	key.LastUsedAt = usedAt
+	return nil
+}
+
+// newAPIKeySecret returns a random secret and the hash it is stored under.
+func newAPIKeySecret() (string, string, error) {
+	data := make([]byte, 32)
+	_, err := rand.Read(data)
+	if err != nil {
+		return "", "", err
+	}
+
+	secret := "pcb_" + base64.RawURLEncoding.EncodeToString(data)
+	return secret, hashAPIKey(secret), nil
+}
+
+// hashAPIKey hashes a secret. The secrets are random, so a fast hash is enough.
+func hashAPIKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
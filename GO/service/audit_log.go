@@ -0,0 +1,447 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	pb "pcbook/generateProto"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// ErrAuditLogTampered is returned when the records of an audit log don't form an unbroken hash chain.
+var ErrAuditLogTampered = errors.New("audit log has been tampered with")
+
+const (
+	// auditIndexInterval is the number of records between two offsets kept in memory to resume queries.
+	auditIndexInterval = 1024
+	// auditHeadLength is the fixed length of the head file, overwritten in place.
+	auditHeadLength = 151
+)
+
+// AuditFilter selects audit records. Zero fields don't filter.
+type AuditFilter struct {
+	TenantID string
+	UserName string
+	// records from Start, inclusive, to End, exclusive
+	Start time.Time
+	End   time.Time
+}
+
+func (filter AuditFilter) matches(record *pb.AuditRecord) bool {
+	if len(filter.TenantID) > 0 && record.GetTenantId() != filter.TenantID {
+		return false
+	}
+	if len(filter.UserName) > 0 && record.GetUserName() != filter.UserName {
+		return false
+	}
+
+	recordTime := record.GetTime().AsTime()
+	if !filter.Start.IsZero() && recordTime.Before(filter.Start) {
+		return false
+	}
+	if !filter.End.IsZero() && !recordTime.Before(filter.End) {
+		return false
+	}
+	return true
+}
+
+// AuditLog is an append-only log of authentication and authorization events
+type AuditLog interface {
+	// Record appends the record to the log, setting its sequence number and hashes
+	Record(record *pb.AuditRecord) error
+	// Query returns up to limit records matching the filter with a sequence number above after, oldest first,
+	// and whether more records match.
+	Query(filter AuditFilter, after uint64, limit int) ([]*pb.AuditRecord, bool, error)
+}
+
+// FileAuditLog appends audit records to a file, one JSON record per line.
+// Each hash is an HMAC of the record with a key kept apart from the file, so that the chain
+// cannot be rewritten without the key. The sequence number and hash of the last synced record
+// are kept in the head file, filename with a .head suffix, so that removing the last records is detected too.
+// Only the head of the chain is kept in memory, queries read the file.
+type FileAuditLog struct {
+	filename string
+	key      []byte
+
+	mutex    sync.Mutex
+	file     *os.File
+	headFile *os.File
+	size     int64
+	sequence uint64
+	head     string
+	// index holds the offset of every auditIndexInterval-th record, from the first one
+	index []int64
+
+	// syncMutex lets one Sync cover the records written by the callers waiting for it
+	syncMutex sync.Mutex
+	synced    uint64
+}
+
+// auditChain is the state of an audit log read from its file.
+type auditChain struct {
+	sequence uint64
+	head     string
+	index    []int64
+	// size is the length of the complete records, a torn record after them is left by a crash
+	size int64
+	torn bool
+}
+
+// NewFileAuditLog opens the audit log in filename, creating it if needed, with the key of its hashes.
+// It returns ErrAuditLogTampered if the records already in the file fail verification.
+// An incomplete last record, left by a crash while writing it, is removed.
+func NewFileAuditLog(filename string, key []byte) (*FileAuditLog, error) {
+	if len(key) == 0 {
+		return nil, errors.New("an audit log key is required")
+	}
+
+	// the head file is created before the log, so that a log without one has been tampered with
+	headFile, err := os.OpenFile(filename+".head", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open audit log head: %w", err)
+	}
+	info, err := headFile.Stat()
+	if err == nil && info.Size() == 0 {
+		if _, statErr := os.Stat(filename); errors.Is(statErr, os.ErrNotExist) {
+			err = writeAuditHead(headFile, key, 0, "")
+			if err == nil {
+				err = headFile.Sync()
+			}
+		}
+	}
+	if err != nil {
+		headFile.Close()
+		return nil, fmt.Errorf("cannot write audit log head: %w", err)
+	}
+
+	chain, err := readAuditLog(filename, key)
+	if err != nil {
+		headFile.Close()
+		return nil, err
+	}
+
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		headFile.Close()
+		return nil, fmt.Errorf("cannot open audit log: %w", err)
+	}
+	if chain.torn {
+		err = file.Truncate(chain.size)
+		if err != nil {
+			file.Close()
+			headFile.Close()
+			return nil, fmt.Errorf("cannot remove incomplete audit record: %w", err)
+		}
+	}
+
+	return &FileAuditLog{
+		filename: filename,
+		key:      key,
+		file:     file,
+		headFile: headFile,
+		size:     chain.size,
+		sequence: chain.sequence,
+		head:     chain.head,
+		index:    chain.index,
+		synced:   chain.sequence,
+	}, nil
+}
+
+// LoadAuditKey reads the key of an audit log from filename, creating a random one if the file doesn't exist.
+func LoadAuditKey(filename string) ([]byte, error) {
+	key, err := os.ReadFile(filename)
+	if err == nil {
+		return key, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("cannot read audit key: %w", err)
+	}
+
+	key = make([]byte, 32)
+	_, err = rand.Read(key)
+	if err != nil {
+		return nil, fmt.Errorf("cannot generate audit key: %w", err)
+	}
+	err = os.MkdirAll(filepath.Dir(filename), 0700)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create audit key folder: %w", err)
+	}
+	err = os.WriteFile(filename, key, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot write audit key: %w", err)
+	}
+	return key, nil
+}
+
+// VerifyAuditLog checks the hash chain of the audit log in filename, and that it extends to its head file.
+func VerifyAuditLog(filename string, key []byte) error {
+	_, err := readAuditLog(filename, key)
+	return err
+}
+
+func readAuditLog(filename string, key []byte) (*auditChain, error) {
+	headSequence, headHash, err := readAuditHead(filename+".head", key)
+	if err != nil {
+		return nil, err
+	}
+
+	chain := &auditChain{}
+	file, err := os.Open(filename)
+	if errors.Is(err, os.ErrNotExist) && headSequence == 0 {
+		return chain, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot open audit log: %w", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if chain.sequence < headSequence {
+				return nil, fmt.Errorf("%w: records after %d have been removed", ErrAuditLogTampered, chain.sequence)
+			}
+			// a record is written with its newline at once, so a line without one was torn by a crash
+			chain.torn = len(line) > 0
+			return chain, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot read audit log: %w", err)
+		}
+
+		record := &pb.AuditRecord{}
+		err = protojson.Unmarshal(line, record)
+		if err != nil {
+			return nil, fmt.Errorf("%w: record %d cannot be parsed: %v", ErrAuditLogTampered, chain.sequence+1, err)
+		}
+		if record.GetSequence() != chain.sequence+1 || record.GetPrevHash() != chain.head {
+			return nil, fmt.Errorf("%w: record %d is out of sequence", ErrAuditLogTampered, chain.sequence+1)
+		}
+
+		hash, err := hashAuditRecord(key, record)
+		if err != nil {
+			return nil, err
+		}
+		if !hmac.Equal([]byte(record.GetHash()), []byte(hash)) {
+			return nil, fmt.Errorf("%w: record %d doesn't match its hash", ErrAuditLogTampered, record.GetSequence())
+		}
+		if record.GetSequence() == headSequence && hash != headHash {
+			return nil, fmt.Errorf("%w: record %d doesn't match the head", ErrAuditLogTampered, record.GetSequence())
+		}
+
+		if chain.sequence%auditIndexInterval == 0 {
+			chain.index = append(chain.index, chain.size)
+		}
+		chain.sequence = record.GetSequence()
+		chain.head = hash
+		chain.size += int64(len(line))
+	}
+}
+
+// hashAuditRecord returns the hex encoded HMAC-SHA256 of the record without its hash.
+func hashAuditRecord(key []byte, record *pb.AuditRecord) (string, error) {
+	unhashed := proto.Clone(record).(*pb.AuditRecord)
+	unhashed.Hash = ""
+
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(unhashed)
+	if err != nil {
+		return "", fmt.Errorf("cannot serialize audit record: %w", err)
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// readAuditHead returns the sequence number and hash of the last synced record of the log.
+// The head file is written before the log, a missing one means it has been removed.
+func readAuditHead(filename string, key []byte) (uint64, string, error) {
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, "", fmt.Errorf("%w: head file is missing", ErrAuditLogTampered)
+	}
+	if err != nil {
+		return 0, "", fmt.Errorf("cannot read audit log head: %w", err)
+	}
+	if len(data) != auditHeadLength {
+		return 0, "", fmt.Errorf("%w: head file is invalid", ErrAuditLogTampered)
+	}
+
+	sequence, err := strconv.ParseUint(string(data[:20]), 10, 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("%w: head file is invalid", ErrAuditLogTampered)
+	}
+	hash := strings.TrimSpace(string(data[21:85]))
+	if !hmac.Equal(data[86:150], []byte(macAuditHead(key, sequence, hash))) {
+		return 0, "", fmt.Errorf("%w: head file doesn't match its hash", ErrAuditLogTampered)
+	}
+	return sequence, hash, nil
+}
+
+// writeAuditHead overwrites the head file in place. Its length is fixed, so that it is written in one sector.
+func writeAuditHead(file *os.File, key []byte, sequence uint64, hash string) error {
+	head := fmt.Sprintf("%020d %-64s %s\n", sequence, hash, macAuditHead(key, sequence, hash))
+	_, err := file.WriteAt([]byte(head), 0)
+	return err
+}
+
+// macAuditHead returns the hex encoded HMAC-SHA256 of the head, so that it cannot be set back to an earlier record.
+func macAuditHead(key []byte, sequence uint64, hash string) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "head %d %s", sequence, hash)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Record appends the record and returns once it is on disk.
+// Concurrent calls share the sync of the file, so that they don't wait for one sync each.
+func (log *FileAuditLog) Record(record *pb.AuditRecord) error {
+	sequence, err := log.write(record)
+	if err != nil {
+		return err
+	}
+	return log.sync(sequence)
+}
+
+func (log *FileAuditLog) write(record *pb.AuditRecord) (uint64, error) {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+
+	record = proto.Clone(record).(*pb.AuditRecord)
+	record.Sequence = log.sequence + 1
+	record.PrevHash = log.head
+
+	hash, err := hashAuditRecord(log.key, record)
+	if err != nil {
+		return 0, err
+	}
+	record.Hash = hash
+
+	data, err := protojson.Marshal(record)
+	if err != nil {
+		return 0, fmt.Errorf("cannot serialize audit record: %w", err)
+	}
+
+	n, err := log.file.Write(append(data, '\n'))
+	if err != nil {
+		if n > 0 {
+			// the next record must not follow a partial one
+			log.file.Truncate(log.size)
+		}
+		return 0, fmt.Errorf("cannot write audit record: %w", err)
+	}
+
+	if log.sequence%auditIndexInterval == 0 {
+		log.index = append(log.index, log.size)
+	}
+	log.sequence = record.GetSequence()
+	log.head = hash
+	log.size += int64(n)
+	return log.sequence, nil
+}
+
+// sync returns once the records up to sequence are on disk, then moves the head to the last of them.
+// The head is only moved after the records are synced, so that it never names a record lost in a crash.
+// It isn't synced itself, a head lost in a crash only names an earlier record.
+func (log *FileAuditLog) sync(sequence uint64) error {
+	log.syncMutex.Lock()
+	defer log.syncMutex.Unlock()
+
+	if log.synced >= sequence {
+		return nil
+	}
+
+	log.mutex.Lock()
+	written, head := log.sequence, log.head
+	log.mutex.Unlock()
+
+	err := log.file.Sync()
+	if err != nil {
+		return fmt.Errorf("cannot write audit record: %w", err)
+	}
+	log.synced = written
+
+	err = writeAuditHead(log.headFile, log.key, written, head)
+	if err != nil {
+		return fmt.Errorf("cannot write audit log head: %w", err)
+	}
+	return nil
+}
+
+// Query reads the records from the file, starting at the indexed record closest before the first one to return.
+func (log *FileAuditLog) Query(filter AuditFilter, after uint64, limit int) ([]*pb.AuditRecord, bool, error) {
+	log.mutex.Lock()
+	size := log.size
+	i := sort.Search(len(log.index), func(i int) bool {
+		return uint64(i)*auditIndexInterval > after
+	}) - 1
+	offset, sequence := int64(0), uint64(0)
+	if i >= 0 {
+		offset, sequence = log.index[i], uint64(i)*auditIndexInterval
+	}
+	log.mutex.Unlock()
+
+	file, err := os.Open(log.filename)
+	if err != nil {
+		return nil, false, fmt.Errorf("cannot open audit log: %w", err)
+	}
+	defer file.Close()
+
+	// the records written after the query started are left out, the last one may be partly written
+	reader := bufio.NewReader(io.NewSectionReader(file, offset, size-offset))
+	records := []*pb.AuditRecord{}
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			return records, false, nil
+		}
+		if err != nil {
+			return nil, false, fmt.Errorf("cannot read audit log: %w", err)
+		}
+
+		sequence++
+		if sequence <= after {
+			continue
+		}
+
+		record := &pb.AuditRecord{}
+		err = protojson.Unmarshal(bytes.TrimSpace(line), record)
+		if err != nil {
+			return nil, false, fmt.Errorf("cannot parse audit record %d: %w", sequence, err)
+		}
+		if !filter.matches(record) {
+			continue
+		}
+		if len(records) == limit {
+			return records, true, nil
+		}
+		records = append(records, record)
+	}
+}
+
+// Close closes the files of the log.
+func (log *FileAuditLog) Close() error {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+
+	err := log.file.Close()
+	if headErr := log.headFile.Close(); err == nil {
+		err = headErr
+	}
+	return err
+}
@@ -0,0 +1,238 @@
+package service_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"pcbook/sample"
+	"pcbook/service"
+	"strings"
+	"testing"
+	"time"
+
+	pb "pcbook/generateProto"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestFileAuditLog(t *testing.T) {
+	t.Parallel()
+
+	filename := filepath.Join(t.TempDir(), "audit.log")
+	auditLog, err := service.NewFileAuditLog(filename, testAuditKey)
+	require.NoError(t, err)
+
+	for _, userName := range []string{"alice", "bob", "alice"} {
+		err := auditLog.Record(&pb.AuditRecord{
+			Time:     timestamppb.Now(),
+			UserName: userName,
+			Method:   "/techschool.pcbook.AuthService/Login",
+		})
+		require.NoError(t, err)
+	}
+	require.NoError(t, auditLog.Close())
+
+	// a record torn by a crash is removed, the records are kept across restarts, and new ones extend the chain
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = file.WriteString(`{"sequence":"4","userName":"ca`)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	auditLog, err = service.NewFileAuditLog(filename, testAuditKey)
+	require.NoError(t, err)
+	err = auditLog.Record(&pb.AuditRecord{Time: timestamppb.Now(), UserName: "carol"})
+	require.NoError(t, err)
+	require.NoError(t, auditLog.Close())
+	require.NoError(t, service.VerifyAuditLog(filename, testAuditKey))
+
+	auditLog, err = service.NewFileAuditLog(filename, testAuditKey)
+	require.NoError(t, err)
+	records, more, err := auditLog.Query(service.AuditFilter{UserName: "alice"}, 0, 10)
+	require.NoError(t, err)
+	require.False(t, more)
+	require.Len(t, records, 2)
+	require.Equal(t, uint64(1), records[0].GetSequence())
+	require.Equal(t, uint64(3), records[1].GetSequence())
+
+	records, more, err = auditLog.Query(service.AuditFilter{}, 1, 2)
+	require.NoError(t, err)
+	require.True(t, more)
+	require.Len(t, records, 2)
+	require.Equal(t, uint64(2), records[0].GetSequence())
+	require.Equal(t, uint64(3), records[1].GetSequence())
+	require.NoError(t, auditLog.Close())
+
+	data, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	lines := strings.SplitAfter(strings.TrimSuffix(string(data), "\n"), "\n")
+	require.Len(t, lines, 4)
+	head, err := os.ReadFile(filename + ".head")
+	require.NoError(t, err)
+
+	tamper := func(lines ...string) error {
+		tampered := filepath.Join(t.TempDir(), "audit.log")
+		err := os.WriteFile(tampered, []byte(strings.Join(lines, "")), 0600)
+		require.NoError(t, err)
+		err = os.WriteFile(tampered+".head", head, 0600)
+		require.NoError(t, err)
+		return service.VerifyAuditLog(tampered, testAuditKey)
+	}
+
+	err = tamper(lines[0], strings.Replace(lines[1], "bob", "eve", 1), lines[2], lines[3])
+	require.ErrorIs(t, err, service.ErrAuditLogTampered)
+
+	err = tamper(lines[0], lines[2], lines[3])
+	require.ErrorIs(t, err, service.ErrAuditLogTampered)
+
+	err = tamper(lines[1], lines[0], lines[2], lines[3])
+	require.ErrorIs(t, err, service.ErrAuditLogTampered)
+
+	err = tamper(lines[0], lines[1])
+	require.ErrorIs(t, err, service.ErrAuditLogTampered)
+
+	// the chain cannot be rewritten without the key
+	_, err = service.NewFileAuditLog(filename, []byte("another key"))
+	require.ErrorIs(t, err, service.ErrAuditLogTampered)
+
+	require.NoError(t, os.Remove(filename+".head"))
+	require.ErrorIs(t, service.VerifyAuditLog(filename, testAuditKey), service.ErrAuditLogTampered)
+}
+
+var testAuditKey = []byte("audit key")
+
+func TestLoadAuditKey(t *testing.T) {
+	t.Parallel()
+
+	// the key is created with its folder, readable by the owner only
+	filename := filepath.Join(t.TempDir(), "pcbook", "audit.key")
+	key, err := service.LoadAuditKey(filename)
+	require.NoError(t, err)
+	require.Len(t, key, 32)
+
+	info, err := os.Stat(filename)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	loaded, err := service.LoadAuditKey(filename)
+	require.NoError(t, err)
+	require.Equal(t, key, loaded)
+}
+
+func TestClientQueryAuditLog(t *testing.T) {
+	t.Parallel()
+
+	auditLog, err := service.NewFileAuditLog(filepath.Join(t.TempDir(), "audit.log"), testAuditKey)
+	require.NoError(t, err)
+	t.Cleanup(func() { auditLog.Close() })
+
+	userStore := service.NewInMemoryUserStore()
+	for _, user := range []*service.User{
+		newTestUser(t, "admin", service.AdminRole),
+		newTestUser(t, "vendor", service.VendorRole),
+		newTestUser(t, "alice", service.UserRole),
+	} {
+		require.NoError(t, userStore.Save(user))
+	}
+	serverAddress := startTestServer(t, withUserStore(userStore), withAuditLog(auditLog))
+
+	conn, err := grpc.Dial(serverAddress, grpc.WithInsecure())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	authClient := pb.NewAuthServiceClient(conn)
+	laptopClient := pb.NewLaptopServiceClient(conn)
+
+	login := func(userName string, password string) (context.Context, error) {
+		res, err := authClient.Login(context.Background(), &pb.LoginRequest{Username: userName, Password: password})
+		if err != nil {
+			return nil, err
+		}
+		return metadata.AppendToOutgoingContext(context.Background(), "authorization", res.GetAccessToken()), nil
+	}
+
+	start := time.Now()
+	admin, err := login("admin", "admin-password")
+	require.NoError(t, err)
+	vendor, err := login("vendor", "vendor-password")
+	require.NoError(t, err)
+	alice, err := login("alice", "alice-password")
+	require.NoError(t, err)
+	// the failure throttles the next logins from this peer
+	_, err = login("admin", "wrong-password")
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	laptop := sample.NewLaptop()
+	_, err = laptopClient.CreateLaptop(vendor, &pb.CreateLaptopRequest{Laptop: laptop})
+	require.NoError(t, err)
+	_, err = laptopClient.CreateLaptop(alice, &pb.CreateLaptopRequest{Laptop: sample.NewLaptop()})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	query := func(req *pb.QueryAuditLogRequest) []string {
+		res, err := authClient.QueryAuditLog(admin, req)
+		require.NoError(t, err)
+
+		events := []string{}
+		for _, record := range res.GetRecords() {
+			require.Equal(t, service.DefaultTenant, record.GetTenantId())
+			require.NotEmpty(t, record.GetPeer())
+			require.NotNil(t, record.GetLatency())
+			method := record.GetMethod()[strings.LastIndex(record.GetMethod(), "/")+1:]
+			events = append(events, strings.Join([]string{record.GetEvent().String(), method, record.GetRole(), record.GetCode()}, " "))
+		}
+		return events
+	}
+
+	// the authorization of a login comes before the user is known
+	require.Equal(t, []string{
+		"CALL Login admin OK",
+		"CALL Login  NotFound",
+		"AUTHORIZE QueryAuditLog admin OK",
+	}, query(&pb.QueryAuditLogRequest{UserName: "admin", StartTime: timestamppb.New(start)}))
+
+	require.Equal(t, []string{
+		"CALL Login vendor OK",
+		"AUTHORIZE CreateLaptop vendor OK",
+		"CALL CreateLaptop vendor OK",
+	}, query(&pb.QueryAuditLogRequest{UserName: "vendor"}))
+
+	require.Equal(t, []string{
+		"CALL Login user OK",
+		"AUTHORIZE CreateLaptop user PermissionDenied",
+	}, query(&pb.QueryAuditLogRequest{UserName: "alice"}))
+
+	require.Empty(t, query(&pb.QueryAuditLogRequest{EndTime: timestamppb.New(start)}))
+
+	// granting a public method isn't recorded unless its policy asks for an audit, like logins do
+	_, err = laptopClient.GetLaptop(vendor, &pb.GetLaptopRequest{Id: laptop.Id})
+	require.NoError(t, err)
+	events := query(&pb.QueryAuditLogRequest{})
+	require.Contains(t, events, "AUTHORIZE Login  OK")
+	require.NotContains(t, events, "AUTHORIZE GetLaptop vendor OK")
+
+	pages := [][]*pb.AuditRecord{}
+	req := &pb.QueryAuditLogRequest{UserName: "vendor", PageSize: 2}
+	for {
+		res, err := authClient.QueryAuditLog(admin, req)
+		require.NoError(t, err)
+		pages = append(pages, res.GetRecords())
+		if len(res.GetNextPageToken()) == 0 {
+			break
+		}
+		req.PageToken = res.GetNextPageToken()
+	}
+	require.Len(t, pages, 2)
+	require.Len(t, pages[0], 2)
+	require.Len(t, pages[1], 1)
+	require.Less(t, pages[0][1].GetSequence(), pages[1][0].GetSequence())
+
+	_, err = authClient.QueryAuditLog(admin, &pb.QueryAuditLogRequest{PageToken: "first"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = authClient.QueryAuditLog(vendor, &pb.QueryAuditLogRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
@@ -0,0 +1,505 @@
+package service_test
+
+import (
+	"context"
+	"pcbook/client"
+	pb "pcbook/generateProto"
+	"pcbook/service"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestClientUserManagement(t *testing.T) {
+	t.Parallel()
+
+	userStore := service.NewInMemoryUserStore()
+	admin, err := service.NewUser("admin", "admin-password", service.AdminRole)
+	require.NoError(t, err)
+	require.NoError(t, userStore.Save(admin))
+
+	serverAddress := startTestServer(t, withUserStore(userStore))
+	authClient := newTestAuthClient(t, serverAddress)
+
+	adminCtx := contextWithTestUser(t, "admin", service.AdminRole)
+	userCtx := contextWithTestUser(t, "alice", service.UserRole)
+
+	_, err = authClient.Register(context.Background(), &pb.RegisterRequest{Username: "alice", Password: "short"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = authClient.Register(context.Background(), &pb.RegisterRequest{Username: "a", Password: "long-enough"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	registered, err := authClient.Register(context.Background(), &pb.RegisterRequest{Username: "alice", Password: "alice-password"})
+	require.NoError(t, err)
+	require.Equal(t, service.UserRole, registered.GetUser().GetRole())
+
+	_, err = authClient.Register(context.Background(), &pb.RegisterRequest{Username: "alice", Password: "alice-password"})
+	require.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	_, err = authClient.Login(context.Background(), &pb.LoginRequest{Username: "alice", Password: "alice-password"})
+	require.NoError(t, err)
+
+	_, err = authClient.ChangePassword(userCtx, &pb.ChangePasswordRequest{OldPassword: "wrong-password", NewPassword: "new-password"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = authClient.ChangePassword(userCtx, &pb.ChangePasswordRequest{OldPassword: "alice-password", NewPassword: "new-password"})
+	require.NoError(t, err)
+
+	_, err = authClient.Login(context.Background(), &pb.LoginRequest{Username: "alice", Password: "new-password"})
+	require.NoError(t, err)
+
+	_, err = authClient.ListUsers(userCtx, &pb.ListUsersRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = authClient.CreateUser(adminCtx, &pb.CreateUserRequest{Username: "bob", Password: "bob-password", Role: "superuser"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	created, err := authClient.CreateUser(adminCtx, &pb.CreateUserRequest{Username: "bob", Password: "bob-password", Role: service.AdminRole})
+	require.NoError(t, err)
+	require.Equal(t, service.AdminRole, created.GetUser().GetRole())
+
+	updated, err := authClient.SetUserRole(adminCtx, &pb.SetUserRoleRequest{Username: "bob", Role: service.UserRole})
+	require.NoError(t, err)
+	require.Equal(t, service.UserRole, updated.GetUser().GetRole())
+
+	_, err = authClient.SetUserRole(adminCtx, &pb.SetUserRoleRequest{Username: "admin", Role: service.UserRole})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	_, err = authClient.DeleteUser(adminCtx, &pb.DeleteUserRequest{Username: "admin"})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	_, err = authClient.DeleteUser(adminCtx, &pb.DeleteUserRequest{Username: "alice"})
+	require.NoError(t, err)
+
+	_, err = authClient.DeleteUser(adminCtx, &pb.DeleteUserRequest{Username: "alice"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	users, err := authClient.ListUsers(adminCtx, &pb.ListUsersRequest{})
+	require.NoError(t, err)
+	require.Len(t, users.GetUsers(), 2)
+	require.Equal(t, "admin", users.GetUsers()[0].GetUsername())
+	require.Equal(t, "bob", users.GetUsers()[1].GetUsername())
+}
+
+func TestClientRefreshTokenAndLogout(t *testing.T) {
+	t.Parallel()
+
+	userStore := service.NewInMemoryUserStore()
+	user, err := service.NewUser("alice", "alice-password", service.UserRole)
+	require.NoError(t, err)
+	require.NoError(t, userStore.Save(user))
+
+	serverAddress := startTestServer(t, withUserStore(userStore))
+	authClient := newTestAuthClient(t, serverAddress)
+
+	login, err := authClient.Login(context.Background(), &pb.LoginRequest{Username: "alice", Password: "alice-password"})
+	require.NoError(t, err)
+	require.NotEmpty(t, login.GetRefreshToken())
+
+	refreshed, err := authClient.RefreshToken(context.Background(), &pb.RefreshTokenRequest{RefreshToken: login.GetRefreshToken()})
+	require.NoError(t, err)
+	require.NotEqual(t, login.GetAccessToken(), refreshed.GetAccessToken())
+	require.NotEqual(t, login.GetRefreshToken(), refreshed.GetRefreshToken())
+
+	// refresh tokens rotate, so the old one is no longer valid
+	_, err = authClient.RefreshToken(context.Background(), &pb.RefreshTokenRequest{RefreshToken: login.GetRefreshToken()})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	accessCtx := metadata.AppendToOutgoingContext(context.Background(), "authorization", refreshed.GetAccessToken())
+	changePassword := &pb.ChangePasswordRequest{OldPassword: "wrong-password", NewPassword: "new-password"}
+	_, err = authClient.ChangePassword(accessCtx, changePassword)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = authClient.Logout(context.Background(), &pb.LogoutRequest{RefreshToken: refreshed.GetRefreshToken()})
+	require.NoError(t, err)
+
+	_, err = authClient.ChangePassword(accessCtx, changePassword)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	_, err = authClient.RefreshToken(context.Background(), &pb.RefreshTokenRequest{RefreshToken: refreshed.GetRefreshToken()})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// the shared secret must never be published
+	jwks, err := authClient.GetJWKS(context.Background(), &pb.GetJWKSRequest{})
+	require.NoError(t, err)
+	require.Empty(t, jwks.GetKeys())
+}
+
+func TestClientRevokesSessionsOfChangedUsers(t *testing.T) {
+	t.Parallel()
+
+	serverAddress := startTestServer(t, withUsers(
+		newTestUser(t, "alice", service.UserRole),
+		newTestUser(t, "bob", service.AdminRole),
+		newTestUser(t, "carol", service.UserRole),
+		newTestUser(t, "dave", service.UserRole),
+	))
+	authClient := newTestAuthClient(t, serverAddress)
+	adminCtx := contextWithTestUser(t, "admin", service.AdminRole)
+
+	login := func(userName string) *pb.LoginResponse {
+		res, err := authClient.Login(context.Background(), &pb.LoginRequest{Username: userName, Password: userName + "-password"})
+		require.NoError(t, err)
+		return res
+	}
+	refresh := func(session *pb.LoginResponse) error {
+		_, err := authClient.RefreshToken(context.Background(), &pb.RefreshTokenRequest{RefreshToken: session.GetRefreshToken()})
+		return err
+	}
+
+	// a password change ends every session of the user, the stolen ones included
+	dave := login("dave")
+	alice, stolen, bob, carol := login("alice"), login("alice"), login("bob"), login("carol")
+	aliceCtx := metadata.AppendToOutgoingContext(context.Background(), "authorization", alice.GetAccessToken())
+	_, err := authClient.ChangePassword(aliceCtx, &pb.ChangePasswordRequest{OldPassword: "alice-password", NewPassword: "new-password"})
+	require.NoError(t, err)
+	require.Equal(t, codes.Unauthenticated, status.Code(refresh(alice)))
+	require.Equal(t, codes.Unauthenticated, status.Code(refresh(stolen)))
+
+	stolenCtx := metadata.AppendToOutgoingContext(context.Background(), "authorization", stolen.GetAccessToken())
+	_, err = authClient.ChangePassword(stolenCtx, &pb.ChangePasswordRequest{OldPassword: "new-password", NewPassword: "stolen-password"})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// a demoted user cannot renew the tokens of their previous role
+	_, err = authClient.SetUserRole(adminCtx, &pb.SetUserRoleRequest{Username: "bob", Role: service.UserRole})
+	require.NoError(t, err)
+	require.Equal(t, codes.Unauthenticated, status.Code(refresh(bob)))
+
+	// nor can a deleted user
+	_, err = authClient.DeleteUser(adminCtx, &pb.DeleteUserRequest{Username: "carol"})
+	require.NoError(t, err)
+	require.Equal(t, codes.Unauthenticated, status.Code(refresh(carol)))
+
+	// the other users keep their sessions
+	require.NoError(t, refresh(dave))
+}
+
+func TestClientAPIKeys(t *testing.T) {
+	t.Parallel()
+
+	serverAddress := startTestServer(t)
+	authClient := newTestAuthClient(t, serverAddress)
+	adminCtx := contextWithTestUser(t, "admin", service.AdminRole)
+
+	_, err := authClient.CreateApiKey(adminCtx, &pb.CreateApiKeyRequest{
+		Name:      "importer",
+		Role:      service.AdminRole,
+		ExpiresAt: timestamppb.New(time.Now().Add(-time.Hour)),
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = authClient.CreateApiKey(adminCtx, &pb.CreateApiKeyRequest{
+		Name:           "importer",
+		Role:           service.AdminRole,
+		AllowedMethods: []string{"ListUsers"},
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	listUsers := "/techschool.pcbook.AuthService/ListUsers"
+	created, err := authClient.CreateApiKey(adminCtx, &pb.CreateApiKeyRequest{
+		Name:           "importer",
+		Role:           service.AdminRole,
+		AllowedMethods: []string{listUsers},
+		ExpiresAt:      timestamppb.New(time.Now().Add(time.Hour)),
+	})
+	require.NoError(t, err)
+	require.NotEmpty(t, created.GetApiKey())
+	require.Nil(t, created.GetKey().GetLastUsedAt())
+
+	apiKeyCtx := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", created.GetApiKey())
+	_, err = authClient.ListUsers(apiKeyCtx, &pb.ListUsersRequest{})
+	require.NoError(t, err)
+
+	// the key is limited to the allowed methods even though its role could call more
+	_, err = authClient.ListApiKeys(apiKeyCtx, &pb.ListApiKeysRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	invalidCtx := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", "pcb_invalid")
+	_, err = authClient.ListUsers(invalidCtx, &pb.ListUsersRequest{})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	keys, err := authClient.ListApiKeys(adminCtx, &pb.ListApiKeysRequest{})
+	require.NoError(t, err)
+	require.Len(t, keys.GetKeys(), 1)
+	require.Equal(t, created.GetKey().GetId(), keys.GetKeys()[0].GetId())
+	require.NotNil(t, keys.GetKeys()[0].GetLastUsedAt())
+
+	_, err = authClient.RevokeApiKey(adminCtx, &pb.RevokeApiKeyRequest{Id: created.GetKey().GetId()})
+	require.NoError(t, err)
+
+	_, err = authClient.RevokeApiKey(adminCtx, &pb.RevokeApiKeyRequest{Id: created.GetKey().GetId()})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = authClient.ListUsers(apiKeyCtx, &pb.ListUsersRequest{})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestClientLoginThrottling(t *testing.T) {
+	t.Parallel()
+
+	userStore := service.NewInMemoryUserStore()
+	user, err := service.NewUser("alice", "alice-password", service.UserRole)
+	require.NoError(t, err)
+	require.NoError(t, userStore.Save(user))
+
+	limiter := service.NewLoginLimiter(service.LoginLimiterConfig{
+		BaseDelay:       100 * time.Millisecond,
+		MaxDelay:        time.Second,
+		MaxFailures:     3,
+		LockoutDuration: time.Hour,
+		ResetAfter:      time.Hour,
+	})
+	serverAddress := startTestServer(t, withUserStore(userStore), withAuthServerOptions(service.WithLoginLimiter(limiter)))
+	authClient := newTestAuthClient(t, serverAddress)
+
+	login := func(userName, password string) error {
+		_, err := authClient.Login(context.Background(), &pb.LoginRequest{Username: userName, Password: password})
+		return err
+	}
+
+	err = login("alice", "wrong-password")
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// the peer is throttled too, not only the username
+	for _, userName := range []string{"alice", "bob"} {
+		err = login(userName, "alice-password")
+		require.Equal(t, codes.ResourceExhausted, status.Code(err))
+		requireRetryDelay(t, err, 0, 100*time.Millisecond)
+	}
+
+	// the delay doubles after each failure
+	time.Sleep(100 * time.Millisecond)
+	err = login("alice", "wrong-password")
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	time.Sleep(100 * time.Millisecond)
+	err = login("alice", "alice-password")
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+	requireRetryDelay(t, err, 0, 100*time.Millisecond)
+
+	// unknown users get the same response as a wrong password, and count as failures
+	time.Sleep(100 * time.Millisecond)
+	err = login("bob", "bob-password")
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// the third failure locks the peer out, even with the right password
+	err = login("alice", "alice-password")
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+	requireRetryDelay(t, err, time.Minute, time.Hour)
+}
+
+func TestClientLoginThrottlingOwnAccount(t *testing.T) {
+	t.Parallel()
+
+	userStore := service.NewInMemoryUserStore()
+	require.NoError(t, userStore.Save(newTestUser(t, "alice", service.UserRole)))
+	require.NoError(t, userStore.Save(newTestUser(t, "mallory", service.UserRole)))
+
+	limiter := service.NewLoginLimiter(service.LoginLimiterConfig{
+		BaseDelay:       100 * time.Millisecond,
+		MaxDelay:        time.Second,
+		MaxFailures:     3,
+		LockoutDuration: time.Hour,
+		ResetAfter:      time.Hour,
+	})
+	serverAddress := startTestServer(t, withUserStore(userStore), withAuthServerOptions(service.WithLoginLimiter(limiter)))
+	authClient := newTestAuthClient(t, serverAddress)
+
+	login := func(userName, password string) error {
+		_, err := authClient.Login(context.Background(), &pb.LoginRequest{Username: userName, Password: password})
+		return err
+	}
+
+	// logging into one's own account between guesses doesn't reset the throttling of the peer
+	for _, delay := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond} {
+		err := login("alice", "wrong-password")
+		require.Equal(t, codes.NotFound, status.Code(err))
+		time.Sleep(delay)
+		require.NoError(t, login("mallory", "mallory-password"))
+	}
+
+	err := login("alice", "wrong-password")
+	require.Equal(t, codes.NotFound, status.Code(err))
+	err = login("mallory", "mallory-password")
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+	requireRetryDelay(t, err, time.Minute, time.Hour)
+}
+
+func TestLoginLimiterConcurrentAttempts(t *testing.T) {
+	t.Parallel()
+
+	limiter := service.NewLoginLimiter(service.LoginLimiterConfig{
+		BaseDelay:     100 * time.Millisecond,
+		MaxDelay:      time.Second,
+		MaxFailures:   3,
+		MaxConcurrent: 2,
+	})
+
+	// attempts are reserved before they are checked, so parallel guesses are bounded
+	require.Zero(t, limiter.Wait("user:alice", "peer:a"))
+	require.Zero(t, limiter.Wait("user:alice", "peer:b"))
+	require.Equal(t, 100*time.Millisecond, limiter.Wait("user:alice", "peer:c"))
+	require.Zero(t, limiter.Wait("user:bob", "peer:c"))
+
+	limiter.Failure("user:alice", "peer:a")
+	limiter.Release("user:alice", "peer:a")
+	// the failure blocks the key after the attempt ended
+	require.Positive(t, limiter.Wait("user:alice", "peer:c"))
+
+	limiter.Release("user:alice", "peer:b")
+	limiter.Release("user:bob", "peer:c")
+	require.Zero(t, limiter.Wait("user:bob", "peer:c"))
+}
+
+func TestClientTwoFactorLogin(t *testing.T) {
+	t.Parallel()
+
+	userStore := service.NewInMemoryUserStore()
+	admin, err := service.NewUser("admin", "admin-password", service.AdminRole)
+	require.NoError(t, err)
+	require.NoError(t, userStore.Save(admin))
+
+	clock := newTestClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	serverAddress := startTestServer(t,
+		withUserStore(userStore),
+		withAuthServerOptions(
+			service.WithClock(clock.Now),
+			service.WithLoginLimiter(service.NewLoginLimiter(service.LoginLimiterConfig{MaxFailures: 100})),
+		),
+	)
+	conn, err := grpc.Dial(serverAddress, grpc.WithInsecure())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	authService := pb.NewAuthServiceClient(conn)
+	authClient := client.NewAuthClient(conn)
+
+	tokens, err := authClient.Login(context.Background(), "admin", "admin-password")
+	require.NoError(t, err)
+	adminCtx := metadata.AppendToOutgoingContext(context.Background(), "authorization", tokens.AccessToken)
+
+	enrolment, err := authService.EnrollTOTP(adminCtx, &pb.EnrollTOTPRequest{})
+	require.NoError(t, err)
+	requireTOTPURI(t, enrolment.GetOtpauthUri(), "admin", enrolment.GetSecret())
+	require.Len(t, enrolment.GetRecoveryCodes(), 10)
+	for _, recoveryCode := range enrolment.GetRecoveryCodes() {
+		require.Regexp(t, `^[a-z2-7]{4}(-[a-z2-7]{4}){3}$`, recoveryCode)
+	}
+
+	// the secret is only required once the app proves it has it
+	_, err = authClient.Login(context.Background(), "admin", "admin-password")
+	require.NoError(t, err)
+
+	_, err = authService.ConfirmTOTP(adminCtx, &pb.ConfirmTOTPRequest{Code: "000000"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	code := testTOTPCode(t, enrolment.GetSecret(), clock.Now())
+	_, err = authService.ConfirmTOTP(adminCtx, &pb.ConfirmTOTPRequest{Code: code})
+	require.NoError(t, err)
+
+	login := func() string {
+		_, err := authClient.Login(context.Background(), "admin", "admin-password")
+		var otpRequired *client.OTPRequiredError
+		require.ErrorAs(t, err, &otpRequired)
+		return otpRequired.Challenge
+	}
+
+	challenge := login()
+	_, err = authClient.VerifyOTP(context.Background(), challenge, "000000")
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// the code used for the confirmation cannot be replayed
+	_, err = authClient.VerifyOTP(context.Background(), challenge, code)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	clock.Advance(30 * time.Second)
+	tokens, err = authClient.VerifyOTP(context.Background(), challenge, testTOTPCode(t, enrolment.GetSecret(), clock.Now()))
+	require.NoError(t, err)
+	require.NotEmpty(t, tokens.AccessToken)
+	require.NotEmpty(t, tokens.RefreshToken)
+
+	// a challenge is answered once
+	clock.Advance(30 * time.Second)
+	_, err = authClient.VerifyOTP(context.Background(), challenge, testTOTPCode(t, enrolment.GetSecret(), clock.Now()))
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// a lost app is replaced by recovery codes, each working once
+	recoveryCode := enrolment.GetRecoveryCodes()[3]
+	_, err = authClient.VerifyOTP(context.Background(), login(), recoveryCode)
+	require.NoError(t, err)
+	_, err = authClient.VerifyOTP(context.Background(), login(), recoveryCode)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	challenge = login()
+	clock.Advance(6 * time.Minute)
+	_, err = authClient.VerifyOTP(context.Background(), challenge, testTOTPCode(t, enrolment.GetSecret(), clock.Now()))
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// replacing the secret needs the current one
+	_, err = authService.EnrollTOTP(adminCtx, &pb.EnrollTOTPRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	clock.Advance(30 * time.Second)
+	reenrolment, err := authService.EnrollTOTP(adminCtx, &pb.EnrollTOTPRequest{Code: testTOTPCode(t, enrolment.GetSecret(), clock.Now())})
+	require.NoError(t, err)
+
+	// the current secret stays required until the new one is confirmed
+	clock.Advance(30 * time.Second)
+	_, err = authClient.VerifyOTP(context.Background(), login(), testTOTPCode(t, reenrolment.GetSecret(), clock.Now()))
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = authClient.VerifyOTP(context.Background(), login(), testTOTPCode(t, enrolment.GetSecret(), clock.Now()))
+	require.NoError(t, err)
+
+	_, err = authService.ConfirmTOTP(adminCtx, &pb.ConfirmTOTPRequest{Code: testTOTPCode(t, reenrolment.GetSecret(), clock.Now())})
+	require.NoError(t, err)
+	clock.Advance(30 * time.Second)
+	_, err = authClient.VerifyOTP(context.Background(), login(), testTOTPCode(t, enrolment.GetSecret(), clock.Now()))
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = authClient.VerifyOTP(context.Background(), login(), enrolment.GetRecoveryCodes()[4])
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = authClient.VerifyOTP(context.Background(), login(), testTOTPCode(t, reenrolment.GetSecret(), clock.Now()))
+	require.NoError(t, err)
+
+	// concurrent logins cannot both use the same recovery code
+	challenges := []string{login(), login(), login(), login()}
+	recoveryCode = reenrolment.GetRecoveryCodes()[0]
+	results := make(chan error, len(challenges))
+	for _, challenge := range challenges {
+		go func(challenge string) {
+			_, err := authClient.VerifyOTP(context.Background(), challenge, recoveryCode)
+			results <- err
+		}(challenge)
+	}
+	accepted := 0
+	for range challenges {
+		if <-results == nil {
+			accepted++
+		}
+	}
+	require.Equal(t, 1, accepted)
+}
+
+func requireRetryDelay(t *testing.T, err error, minDelay time.Duration, maxDelay time.Duration) {
+	details := status.Convert(err).Details()
+	require.Len(t, details, 1)
+
+	retryInfo, ok := details[0].(*errdetails.RetryInfo)
+	require.True(t, ok)
+
+	delay := retryInfo.GetRetryDelay().AsDuration()
+	require.Greater(t, delay, minDelay)
+	require.LessOrEqual(t, delay, maxDelay)
+}
+
+func newTestAuthClient(t *testing.T, serverAddress string) pb.AuthServiceClient {
+	conn, err := grpc.Dial(serverAddress, grpc.WithInsecure())
+	require.NoError(t, err, "cannot connect to test auth server")
+
+	return pb.NewAuthServiceClient(conn)
+}
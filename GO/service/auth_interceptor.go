@@ -2,26 +2,79 @@ package service
 
 import (
 	"context"
+	"errors"
 	"log"
+	"pcbook/authpolicy"
+	pb "pcbook/generateProto"
+	"time"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 type AuthInterceptor struct {
-	jwtManager      *JWTManager
-	accessibleRoles map[string][]string
+	jwtManager     *JWTManager
+	policies       map[string]*pb.AuthPolicy
+	certIdentities CertIdentities
+	apiKeyStore    APIKeyStore
+	roles          *Roles
+	auditLog       AuditLog
 }
 
-func NewAuthInterceptor(jwtManager *JWTManager, accessibleRoles map[string][]string) *AuthInterceptor {
-	return &AuthInterceptor{
-		jwtManager:      jwtManager,
-		accessibleRoles: accessibleRoles,
+type AuthInterceptorOption func(*AuthInterceptor)
+
+// WithCertIdentities authenticates callers without an access token by their verified client certificate.
+func WithCertIdentities(identities CertIdentities) AuthInterceptorOption {
+	return func(interceptor *AuthInterceptor) {
+		interceptor.certIdentities = identities
+	}
+}
+
+// WithAPIKeys authenticates callers that send an x-api-key header by the keys in the store.
+func WithAPIKeys(apiKeyStore APIKeyStore) AuthInterceptorOption {
+	return func(interceptor *AuthInterceptor) {
+		interceptor.apiKeyStore = apiKeyStore
+	}
+}
+
+// WithInterceptorRoles sets the scopes granted to callers authenticated by an API key or a client certificate.
+func WithInterceptorRoles(roles *Roles) AuthInterceptorOption {
+	return func(interceptor *AuthInterceptor) {
+		interceptor.roles = roles
+	}
+}
+
+// WithInterceptorAuditLog records the authorization decisions, except the calls granted to public methods
+// not asking for an audit, and the result of the calls whose policy asks for an audit, in the audit log.
+func WithInterceptorAuditLog(auditLog AuditLog) AuthInterceptorOption {
+	return func(interceptor *AuthInterceptor) {
+		interceptor.auditLog = auditLog
 	}
 }
 
+// NewAuthInterceptor returns an interceptor enforcing the given policies, keyed by full method name.
+// Methods without a policy are denied.
+func NewAuthInterceptor(
+	jwtManager *JWTManager,
+	policies map[string]*pb.AuthPolicy,
+	options ...AuthInterceptorOption,
+) *AuthInterceptor {
+	interceptor := &AuthInterceptor{
+		jwtManager: jwtManager,
+		policies:   policies,
+		roles:      DefaultRoles,
+	}
+	for _, option := range options {
+		option(interceptor)
+	}
+	return interceptor
+}
+
 func (a *AuthInterceptor) Unary() grpc.UnaryServerInterceptor {
 	return func(
 		ctx context.Context,
@@ -31,12 +84,19 @@ func (a *AuthInterceptor) Unary() grpc.UnaryServerInterceptor {
 	) (interface{}, error) {
 		log.Print("---> intercepting unary method: ", info.FullMethod)
 
-		err := a.authorize(ctx, info.FullMethod)
+		ctx, err := a.intercept(ctx, info.FullMethod)
 		if err != nil {
 			return nil, err
 		}
 
-		return handler(ctx, req)
+		if !a.audits(info.FullMethod) {
+			return handler(ctx, req)
+		}
+
+		start := time.Now()
+		res, err := handler(ctx, req)
+		a.audit(ctx, pb.AuditRecord_CALL, info.FullMethod, auditedCaller(ctx, a.jwtManager, req, res), start, err)
+		return res, err
 	}
 }
 
@@ -49,41 +109,254 @@ func (a *AuthInterceptor) Stream() grpc.StreamServerInterceptor {
 	) error {
 		log.Print("---> intercepting stream method: ", info.FullMethod)
 
-		err := a.authorize(stream.Context(), info.FullMethod)
+		ctx, err := a.intercept(stream.Context(), info.FullMethod)
 		if err != nil {
 			return err
 		}
-		return handler(srv, stream)
+
+		start := time.Now()
+		err = handler(srv, &authenticatedStream{
+			ServerStream: stream,
+			ctx:          ctx,
+		})
+		if a.audits(info.FullMethod) {
+			a.audit(ctx, pb.AuditRecord_CALL, info.FullMethod, auditedCaller(ctx, a.jwtManager, nil, nil), start, err)
+		}
+		return err
 	}
 }
 
-func (a *AuthInterceptor) authorize(ctx context.Context, fullMethod string) error {
-	roles, ok := a.accessibleRoles[fullMethod]
-	if !ok {
-		return nil
+// intercept authorizes the call and returns its context carrying the caller's claims and tenant.
+func (a *AuthInterceptor) intercept(ctx context.Context, fullMethod string) (context.Context, error) {
+	start := time.Now()
+	claims, err := a.authorize(ctx, fullMethod)
+	tenantID, tenantErr := a.tenant(ctx, fullMethod, claims)
+	if err == nil {
+		err = tenantErr
 	}
 
-	md, ok := metadata.FromIncomingContext(ctx)
+	caller := &UserClaims{}
+	if claims != nil {
+		caller = claims
+	}
+	if err != nil || a.auditsAuthorization(fullMethod) {
+		a.audit(contextWithTenant(ctx, tenantID), pb.AuditRecord_AUTHORIZE, fullMethod, caller, start, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return contextWithTenant(contextWithClaims(ctx, claims), tenantID), nil
+}
+
+// tenant returns the tenant of the call. Callers sending credentials are bound to the tenant of the credentials,
+// even for public methods. Anonymous callers name the tenant in the x-tenant-id header only to start a session,
+// e.g. logging in, their other calls are bound to the default tenant, so that no tenant can be read anonymously.
+func (a *AuthInterceptor) tenant(ctx context.Context, fullMethod string, claims *UserClaims) (string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	requested := ""
+	if values := md["x-tenant-id"]; len(values) > 0 {
+		requested = values[0]
+	}
+
+	if claims == nil && (len(md["authorization"]) > 0 || len(md["x-api-key"]) > 0) {
+		// invalid credentials don't matter to public methods, the caller is anonymous then
+		claims, _ = a.authenticate(ctx, fullMethod)
+	}
+	if claims == nil {
+		if len(requested) > 0 && a.policies[fullMethod].GetAnonymousTenant() {
+			return requested, nil
+		}
+		claims, _ = a.certIdentities.authenticate(ctx)
+	}
+	if claims == nil && len(requested) > 0 && requested != DefaultTenant {
+		return "", status.Errorf(codes.Unauthenticated, "anonymous callers cannot access tenant %s, log in first", requested)
+	}
+
+	tenantID := DefaultTenant
+	if claims != nil && len(claims.TenantID) > 0 {
+		tenantID = claims.TenantID
+	}
+	if len(requested) > 0 && requested != tenantID {
+		return "", status.Errorf(codes.PermissionDenied, "credentials of tenant %s cannot access tenant %s", tenantID, requested)
+	}
+	return tenantID, nil
+}
+
+// authorize returns the claims of the caller, or nil if the method doesn't require authentication.
+// The claims are also returned if the caller is authenticated but not permitted to call the method.
+func (a *AuthInterceptor) authorize(ctx context.Context, fullMethod string) (*UserClaims, error) {
+	policy, ok := a.policies[fullMethod]
 	if !ok {
-		return status.Errorf(codes.Unauthenticated, "metadata is not provided")
+		return nil, status.Errorf(codes.PermissionDenied, "no access policy is declared for %s", fullMethod)
 	}
+	if policy.GetPublic() {
+		return nil, nil
+	}
+
+	claims, err := a.authenticate(ctx, fullMethod)
+	if err != nil {
+		return nil, err
+	}
+
+	if !authpolicy.Permits(policy, claims.Scopes) {
+		// the claims tell the audit log who was denied
+		return claims, status.Errorf(codes.PermissionDenied,
+			"%s needs scopes %v, role %s has %v", fullMethod, policy.GetScopes(), claims.Role, claims.Scopes)
+	}
+
+	return claims, nil
+}
 
+// authenticate returns the claims of the access token, else of the API key,
+// or of the client certificate if neither is sent.
+func (a *AuthInterceptor) authenticate(ctx context.Context, fullMethod string) (*UserClaims, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
 	values := md["authorization"]
 	if len(values) == 0 {
-		return status.Errorf(codes.Unauthenticated, "authorization token is not provided")
+		apiKeys := md["x-api-key"]
+		if len(apiKeys) > 0 && a.apiKeyStore != nil {
+			return a.authenticateAPIKey(apiKeys[0], fullMethod)
+		}
+
+		claims, ok := a.certIdentities.authenticate(ctx)
+		if ok {
+			claims.Scopes = a.roles.Scopes(claims.Role)
+			return claims, nil
+		}
+		return nil, status.Errorf(codes.Unauthenticated, "authorization token is not provided")
 	}
 
 	accessToken := values[0]
 	claims, err := a.jwtManager.VerifyToken(accessToken)
 	if err != nil {
-		return status.Errorf(codes.Unauthenticated, "access token is invalid: %v", err)
+		return nil, status.Errorf(codes.Unauthenticated, "access token is invalid: %v", err)
+	}
+	return claims, nil
+}
+
+func (a *AuthInterceptor) authenticateAPIKey(secret string, fullMethod string) (*UserClaims, error) {
+	key, err := a.apiKeyStore.FindByHash(hashAPIKey(secret))
+	if errors.Is(err, ErrAPIKeyNotFound) {
+		return nil, status.Errorf(codes.Unauthenticated, "api key is invalid")
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find api key: %v", err)
+	}
+
+	now := time.Now()
+	if key.IsExpired(now) {
+		return nil, status.Errorf(codes.Unauthenticated, "api key %s has expired", key.ID)
+	}
+	if !key.Allows(fullMethod) {
+		return nil, status.Errorf(codes.PermissionDenied, "api key %s is not allowed to access %s", key.ID, fullMethod)
+	}
+
+	err = a.apiKeyStore.Touch(key.ID, now)
+	if err != nil {
+		log.Printf("cannot record use of api key %s: %v", key.ID, err)
+	}
+
+	claims := &UserClaims{
+		TenantID: key.TenantID,
+		UserName: "apikey:" + key.Name,
+		Role:     key.Role,
+		Scopes:   a.roles.Scopes(key.Role),
+	}
+	return claims, nil
+}
+
+// audits reports whether the result of calls to the method is recorded in the audit log.
+func (a *AuthInterceptor) audits(fullMethod string) bool {
+	return a.auditLog != nil && a.policies[fullMethod].GetAudit()
+}
+
+// auditsAuthorization reports whether granting a call to the method is recorded in the audit log.
+// Denials are always recorded, grants only for methods requiring authentication or asking for an audit,
+// so that public reads don't fill the log.
+func (a *AuthInterceptor) auditsAuthorization(fullMethod string) bool {
+	policy, ok := a.policies[fullMethod]
+	return !ok || !policy.GetPublic() || policy.GetAudit()
+}
+
+// audit records an event of the call, in the tenant of the context, in the audit log if there is one.
+func (a *AuthInterceptor) audit(
+	ctx context.Context,
+	event pb.AuditRecord_Event,
+	fullMethod string,
+	caller *UserClaims,
+	start time.Time,
+	err error,
+) {
+	if a.auditLog == nil {
+		return
 	}
 
-	for _, role := range roles {
-		if role == claims.Role {
-			return nil
+	record := &pb.AuditRecord{
+		Time:     timestamppb.New(start),
+		Event:    event,
+		TenantId: TenantFromContext(ctx),
+		UserName: caller.UserName,
+		Role:     caller.Role,
+		Method:   fullMethod,
+		Code:     status.Code(err).String(),
+		Latency:  durationpb.New(time.Since(start)),
+	}
+	if err != nil {
+		record.Message = status.Convert(err).Message()
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		record.Peer = p.Addr.String()
+	}
+
+	err = a.auditLog.Record(record)
+	if err != nil {
+		log.Printf("cannot record %s of %s in audit log: %v", event, fullMethod, err)
+	}
+}
+
+// auditedCaller returns the caller of an audited call. Logins are anonymous calls,
+// their caller is the user of the issued token if the login succeeded, else the user named in the request.
+func auditedCaller(ctx context.Context, jwtManager *JWTManager, req interface{}, res interface{}) *UserClaims {
+	if claims, ok := ClaimsFromContext(ctx); ok {
+		return claims
+	}
+
+	if tokens, ok := res.(interface{ GetAccessToken() string }); ok && len(tokens.GetAccessToken()) > 0 {
+		claims, err := jwtManager.VerifyToken(tokens.GetAccessToken())
+		if err == nil {
+			return claims
 		}
 	}
 
-	return status.Errorf(codes.PermissionDenied, "role %s is not allowed to access %s", claims.Role, fullMethod)
+	caller := &UserClaims{}
+	if login, ok := req.(*pb.LoginRequest); ok {
+		caller.UserName = login.GetUsername()
+	}
+	return caller
+}
+
+type claimsKey struct{}
+
+func contextWithClaims(ctx context.Context, claims *UserClaims) context.Context {
+	if claims == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, claimsKey{}, claims)
+}
+
+// ClaimsFromContext returns the claims of the authenticated caller, if any.
+func ClaimsFromContext(ctx context.Context) (*UserClaims, bool) {
+	claims, ok := ctx.Value(claimsKey{}).(*UserClaims)
+	return claims, ok
+}
+
+// authenticatedStream overrides the context of a server stream to carry the caller's claims.
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
 }
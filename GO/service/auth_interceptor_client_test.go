@@ -0,0 +1,188 @@
+package service_test
+
+import (
+	"context"
+	"pcbook/client"
+	"pcbook/service"
+	"sync"
+	"testing"
+	"time"
+
+	pb "pcbook/generateProto"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestAuthInterceptorClientRefreshesAheadOfExpiry(t *testing.T) {
+	t.Parallel()
+
+	jwtManager := service.NewJWTManager(testSecretKey, 2*time.Second)
+	counter := &callCounter{counts: make(map[string]int)}
+	serverAddress := startTestServer(t,
+		withUsers(newTestUser(t, "alice", service.UserRole)),
+		withJWTManager(jwtManager),
+		withUnaryInterceptor(counter.count),
+	)
+	_, interceptor := newTestInterceptor(t, dialTestAuthClient(t, serverAddress), client.WithRefreshMargin(time.Second))
+	changePassword := newChangePasswordCall(t, serverAddress, interceptor)
+
+	// the token lives 2s and is renewed halfway, so no call ever sees it expired
+	for i := 0; i < 30; i++ {
+		require.Equal(t, codes.PermissionDenied, status.Code(changePassword()))
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	require.Zero(t, counter.calls("ChangePassword", codes.Unauthenticated))
+	require.GreaterOrEqual(t, counter.calls("RefreshToken", codes.OK), 2)
+	require.NoError(t, interceptor.Logout(context.Background()))
+	require.Equal(t, 1, counter.calls("Logout", codes.OK))
+}
+
+func TestAuthInterceptorClientReplaysUnauthenticatedCalls(t *testing.T) {
+	t.Parallel()
+
+	jwtManager := service.NewJWTManager(testSecretKey, time.Minute)
+	counter := &callCounter{counts: make(map[string]int)}
+	serverAddress := startTestServer(t,
+		withUsers(newTestUser(t, "alice", service.UserRole)),
+		withJWTManager(jwtManager),
+		withUnaryInterceptor(counter.count),
+	)
+	tokens, interceptor := newTestInterceptor(t, dialTestAuthClient(t, serverAddress))
+	defer interceptor.Close()
+	changePassword := newChangePasswordCall(t, serverAddress, interceptor)
+	require.Equal(t, codes.PermissionDenied, status.Code(changePassword()))
+
+	// a revoked token is renewed with the refresh token, and the call replayed
+	claims, err := jwtManager.VerifyToken(tokens.AccessToken)
+	require.NoError(t, err)
+	jwtManager.RevokeToken(claims.Id, time.Unix(claims.ExpiresAt, 0))
+
+	require.Equal(t, codes.PermissionDenied, status.Code(changePassword()))
+	require.Equal(t, 1, counter.calls("ChangePassword", codes.Unauthenticated))
+	require.Equal(t, 1, counter.calls("RefreshToken", codes.OK))
+
+	// once the session is revoked too, the call fails as the client cannot log in again
+	require.NoError(t, interceptor.Logout(context.Background()))
+	require.Equal(t, codes.Unauthenticated, status.Code(changePassword()))
+	require.Equal(t, 2, counter.calls("ChangePassword", codes.Unauthenticated))
+
+	authClient := dialTestAuthClient(t, serverAddress)
+	_, interceptor = newTestInterceptor(t, authClient, client.WithLogin(func(ctx context.Context) (*client.Tokens, error) {
+		return authClient.Login(ctx, "alice", "alice-password")
+	}))
+	defer interceptor.Close()
+	changePassword = newChangePasswordCall(t, serverAddress, interceptor)
+
+	require.NoError(t, interceptor.Logout(context.Background()))
+	require.Equal(t, codes.PermissionDenied, status.Code(changePassword()))
+	require.Equal(t, 3, counter.calls("Login", codes.OK))
+}
+
+func TestAuthInterceptorClientRetriesRefreshWithBackoff(t *testing.T) {
+	t.Parallel()
+
+	jwtManager := service.NewJWTManager(testSecretKey, time.Second)
+	counter := &callCounter{counts: make(map[string]int)}
+	serverAddress := startTestServer(t,
+		withUsers(newTestUser(t, "alice", service.UserRole)),
+		withJWTManager(jwtManager),
+		withUnaryInterceptor(counter.count),
+	)
+	authClient := dialTestAuthClient(t, serverAddress)
+	tokens, err := authClient.Login(context.Background(), "alice", "alice-password")
+	require.NoError(t, err)
+
+	// every refresh fails, and is retried until the client is closed
+	authMethods, err := client.AuthMethods(pb.AuthService_ServiceDesc.ServiceName)
+	require.NoError(t, err)
+	interceptor, err := client.NewAuthInterceptorClient(
+		authClient,
+		&client.Tokens{AccessToken: tokens.AccessToken, RefreshToken: "invalid"},
+		authMethods,
+		client.WithRefreshBackoff(50*time.Millisecond, 200*time.Millisecond),
+	)
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return counter.calls("RefreshToken", codes.Unauthenticated) >= 4
+	}, 3*time.Second, 10*time.Millisecond)
+
+	interceptor.Close()
+	time.Sleep(50 * time.Millisecond)
+	failures := counter.calls("RefreshToken", codes.Unauthenticated)
+	time.Sleep(500 * time.Millisecond)
+	require.Equal(t, failures, counter.calls("RefreshToken", codes.Unauthenticated))
+}
+
+// callCounter counts the results of the calls served by a test server.
+type callCounter struct {
+	mutex  sync.Mutex
+	counts map[string]int
+}
+
+func (counter *callCounter) count(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	res, err := handler(ctx, req)
+
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+	counter.counts[info.FullMethod+" "+status.Code(err).String()]++
+	return res, err
+}
+
+// calls returns how many calls to the auth service method ended with the code.
+func (counter *callCounter) calls(method string, code codes.Code) int {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+	return counter.counts["/techschool.pcbook.AuthService/"+method+" "+code.String()]
+}
+
+// dialTestAuthClient returns the auth client of the client package, where newTestAuthClient returns the generated one.
+func dialTestAuthClient(t *testing.T, serverAddress string) *client.AuthClient {
+	conn, err := grpc.Dial(serverAddress, grpc.WithInsecure())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return client.NewAuthClient(conn)
+}
+
+// newTestInterceptor logs alice in and returns the tokens, and an interceptor renewing them.
+func newTestInterceptor(
+	t *testing.T,
+	authClient *client.AuthClient,
+	options ...client.AuthInterceptorClientOption,
+) (*client.Tokens, *client.AuthInterceptorClient) {
+	tokens, err := authClient.Login(context.Background(), "alice", "alice-password")
+	require.NoError(t, err)
+
+	authMethods, err := client.AuthMethods(pb.AuthService_ServiceDesc.ServiceName)
+	require.NoError(t, err)
+
+	interceptor, err := client.NewAuthInterceptorClient(authClient, tokens, authMethods, options...)
+	require.NoError(t, err)
+	return tokens, interceptor
+}
+
+// newChangePasswordCall returns a call needing a token, which fails with PermissionDenied once authenticated.
+func newChangePasswordCall(t *testing.T, serverAddress string, interceptor *client.AuthInterceptorClient) func() error {
+	conn, err := grpc.Dial(serverAddress, grpc.WithInsecure(), grpc.WithUnaryInterceptor(interceptor.Unary()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	authService := pb.NewAuthServiceClient(conn)
+	return func() error {
+		_, err := authService.ChangePassword(context.Background(), &pb.ChangePasswordRequest{
+			OldPassword: "wrong-password",
+			NewPassword: "new-password",
+		})
+		return err
+	}
+}
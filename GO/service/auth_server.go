@@ -2,42 +2,738 @@ package service
 
 import (
 	"context"
+	"errors"
+	"net"
 	pb "pcbook/generateProto"
+	"regexp"
+	"strconv"
+	"time"
 
+	"github.com/google/uuid"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	minPasswordLength    = 8
+	maxAPIKeyNameLength  = 64
+	defaultAuditPageSize = 100
+	maxAuditPageSize     = 1000
+)
+
+// unknownUser stands in for users that don't exist. No password matches its hash.
+var unknownUser = &User{
+	HashedPassword: "$2a$10$Y1Fj0H0amzM40DfaRy.2dOsWTnTQyPzKn2yeGqlX129FZLwhAsNL6",
+}
+
+var (
+	userNamePattern   = regexp.MustCompile(`^[a-zA-Z0-9_.-]{3,32}$`)
+	fullMethodPattern = regexp.MustCompile(`^/[^/]+/[^/]+$`)
 )
 
 type AuthServer struct {
 	pb.UnimplementedAuthServiceServer
-	userStore  UserStore
-	jwtManager *JWTManager
+	userStore            UserStore
+	jwtManager           *JWTManager
+	refreshTokenStore    RefreshTokenStore
+	refreshTokenDuration time.Duration
+	apiKeyStore          APIKeyStore
+	loginLimiter         *LoginLimiter
+	roles                *Roles
+	tenantID             string
+	auditLog             AuditLog
+	otpChallenges        *otpChallenges
+	now                  func() time.Time
+}
+
+type AuthServerOption func(*AuthServer)
+
+// WithRoles sets the roles that can be given to users and API keys, and the scopes their tokens carry.
+func WithRoles(roles *Roles) AuthServerOption {
+	return func(server *AuthServer) {
+		server.roles = roles
+	}
 }
 
-func NewAuthServer(userStore UserStore, jwtManager *JWTManager) *AuthServer {
-	return &AuthServer{
-		userStore:  userStore,
-		jwtManager: jwtManager,
+// WithTenant makes the server issue tokens and API keys for the tenant whose users are in its user store.
+func WithTenant(tenantID string) AuthServerOption {
+	return func(server *AuthServer) {
+		server.tenantID = tenantID
 	}
 }
 
+// WithAuditLog lets admins query the records of their tenant in the audit log.
+func WithAuditLog(auditLog AuditLog) AuthServerOption {
+	return func(server *AuthServer) {
+		server.auditLog = auditLog
+	}
+}
+
+// WithClock replaces the clock that one-time passwords and login challenges are checked against.
+func WithClock(now func() time.Time) AuthServerOption {
+	return func(server *AuthServer) {
+		server.now = now
+	}
+}
+
+// WithLoginLimiter replaces the default throttling of failed logins.
+func WithLoginLimiter(limiter *LoginLimiter) AuthServerOption {
+	return func(server *AuthServer) {
+		server.loginLimiter = limiter
+	}
+}
+
+func NewAuthServer(
+	userStore UserStore,
+	jwtManager *JWTManager,
+	refreshTokenStore RefreshTokenStore,
+	refreshTokenDuration time.Duration,
+	apiKeyStore APIKeyStore,
+	options ...AuthServerOption,
+) *AuthServer {
+	server := &AuthServer{
+		userStore:            userStore,
+		jwtManager:           jwtManager,
+		refreshTokenStore:    refreshTokenStore,
+		refreshTokenDuration: refreshTokenDuration,
+		apiKeyStore:          apiKeyStore,
+		loginLimiter:         NewLoginLimiter(DefaultLoginLimiterConfig),
+		roles:                DefaultRoles,
+		tenantID:             DefaultTenant,
+		otpChallenges:        newOTPChallenges(),
+		now:                  time.Now,
+	}
+	for _, option := range options {
+		option(server)
+	}
+	return server
+}
+
 func (s *AuthServer) Login(ctx context.Context, req *pb.LoginRequest) (*pb.LoginResponse, error) {
+	// attempts are throttled per username against guessing one password,
+	// and per peer against trying one password on many accounts
+	userKey := "user:" + req.GetUsername()
+	limiterKeys := []string{userKey}
+	if p, ok := peer.FromContext(ctx); ok {
+		limiterKeys = append(limiterKeys, "peer:"+peerHost(p.Addr))
+	}
+
+	wait := s.loginLimiter.Wait(limiterKeys...)
+	if wait > 0 {
+		return nil, retryLaterError(wait, "too many failed login attempts, retry in %v", wait.Round(time.Second))
+	}
+	defer s.loginLimiter.Release(limiterKeys...)
+
 	user, err := s.userStore.Find(req.GetUsername())
-	if err != nil {
+	if err != nil && !errors.Is(err, ErrUserNotFound) {
 		return nil, status.Errorf(codes.Internal, "cannot find user: %v", err)
 	}
-	if user == nil || !user.IsCorrectPassword(req.GetPassword()) {
+	if user == nil {
+		// hash the password anyway, so the response time doesn't tell which usernames exist
+		user = unknownUser
+	}
+	if !user.IsCorrectPassword(req.GetPassword()) || user == unknownUser {
+		s.loginLimiter.Failure(limiterKeys...)
 		return nil, status.Errorf(codes.NotFound, "invalid username or password")
 	}
 
-	token, err := s.jwtManager.GenerateToken(user.UserName, user.Role)
+	if user.TOTPEnabled {
+		// failures are only forgotten once the one-time password is verified too
+		challenge, err := s.otpChallenges.issue(user.UserName, s.now())
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "cannot generate otp challenge: %v", err)
+		}
+		return &pb.LoginResponse{OtpChallenge: challenge}, nil
+	}
+	// the failures of the peer stay, logging into one's own account must not reset the throttling of guesses at others
+	s.loginLimiter.Success(userKey)
+
+	accessToken, refreshToken, err := s.issueTokens(user)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "cannot generate token: %v", err)
+		return nil, err
 	}
 
 	res := &pb.LoginResponse{
-		AccessToken: token,
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+	}
+
+	return res, nil
+}
+
+func (s *AuthServer) VerifyOTP(ctx context.Context, req *pb.VerifyOTPRequest) (*pb.VerifyOTPResponse, error) {
+	userName, ok := s.otpChallenges.attempt(req.GetOtpChallenge(), s.now())
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "otp challenge is invalid or has expired, log in again")
+	}
+
+	limiterKeys := []string{"user:" + userName}
+	wait := s.loginLimiter.Wait(limiterKeys...)
+	if wait > 0 {
+		return nil, retryLaterError(wait, "too many failed login attempts, retry in %v", wait.Round(time.Second))
+	}
+	defer s.loginLimiter.Release(limiterKeys...)
+
+	// the code is used up in the same step it is verified, so concurrent calls cannot both accept it
+	invalidOTP := status.Errorf(codes.Unauthenticated, "invalid one-time password")
+	user, err := s.userStore.Modify(userName, func(user *User) error {
+		if !user.VerifyOTP(req.GetCode(), s.now()) {
+			return invalidOTP
+		}
+		return nil
+	})
+	if err == invalidOTP {
+		s.loginLimiter.Failure(limiterKeys...)
+		return nil, err
+	}
+	if errors.Is(err, ErrUserNotFound) {
+		return nil, status.Errorf(codes.Unauthenticated, "user %s no longer exists", userName)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot update user: %v", err)
+	}
+	s.otpChallenges.complete(req.GetOtpChallenge())
+	s.loginLimiter.Success(limiterKeys...)
+
+	accessToken, refreshToken, err := s.issueTokens(user)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &pb.VerifyOTPResponse{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+	}
+
+	return res, nil
+}
+
+func (s *AuthServer) RefreshToken(ctx context.Context, req *pb.RefreshTokenRequest) (*pb.RefreshTokenResponse, error) {
+	// the old refresh token is consumed, so a stolen token can only be used once
+	session, err := s.takeRefreshToken(req.GetRefreshToken())
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := s.userStore.Find(session.UserName)
+	if errors.Is(err, ErrUserNotFound) {
+		return nil, status.Errorf(codes.Unauthenticated, "user %s no longer exists", session.UserName)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find user: %v", err)
+	}
+
+	accessToken, refreshToken, err := s.issueTokens(user)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &pb.RefreshTokenResponse{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+	}
+
+	return res, nil
+}
+
+func (s *AuthServer) Logout(ctx context.Context, req *pb.LogoutRequest) (*pb.LogoutResponse, error) {
+	session, err := s.takeRefreshToken(req.GetRefreshToken())
+	if err != nil {
+		return nil, err
+	}
+
+	// the access token issued with the session must not outlive it
+	s.jwtManager.RevokeToken(session.AccessTokenID, session.AccessTokenExpires)
+
+	return &pb.LogoutResponse{}, nil
+}
+
+func (s *AuthServer) GetJWKS(ctx context.Context, req *pb.GetJWKSRequest) (*pb.GetJWKSResponse, error) {
+	return &pb.GetJWKSResponse{Keys: s.jwtManager.PublicKeys()}, nil
+}
+
+func (s *AuthServer) Register(ctx context.Context, req *pb.RegisterRequest) (*pb.RegisterResponse, error) {
+	// self-service accounts never get more than the user role
+	user, err := s.createUser(req.GetUsername(), req.GetPassword(), UserRole)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.RegisterResponse{User: toPBUser(user)}, nil
+}
+
+func (s *AuthServer) ChangePassword(ctx context.Context, req *pb.ChangePasswordRequest) (*pb.ChangePasswordResponse, error) {
+	claims, ok := ClaimsFromContext(ctx)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "changing password requires an authenticated user")
+	}
+
+	user, err := s.findUser(claims.UserName)
+	if err != nil {
+		return nil, err
+	}
+	if !user.IsCorrectPassword(req.GetOldPassword()) {
+		return nil, status.Errorf(codes.PermissionDenied, "old password is incorrect")
+	}
+
+	err = validatePassword(req.GetNewPassword())
+	if err != nil {
+		return nil, err
+	}
+
+	// the passwords are hashed before the user is modified, to keep the store unlocked meanwhile
+	changed := user.Clone()
+	err = changed.SetPassword(req.GetNewPassword())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot set password: %v", err)
+	}
+
+	_, err = s.userStore.Modify(user.UserName, func(stored *User) error {
+		if stored.HashedPassword != user.HashedPassword {
+			return status.Errorf(codes.Aborted, "the password was changed meanwhile, retry with the new one")
+		}
+		stored.HashedPassword = changed.HashedPassword
+		return nil
+	})
+	if err != nil {
+		return nil, userStoreError("cannot update user", err)
+	}
+
+	// a stolen session must not outlive the password, the caller logs in again with the new one
+	err = s.revokeSessions(user.UserName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.ChangePasswordResponse{}, nil
+}
+
+func (s *AuthServer) EnrollTOTP(ctx context.Context, req *pb.EnrollTOTPRequest) (*pb.EnrollTOTPResponse, error) {
+	claims, ok := ClaimsFromContext(ctx)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "enrolling two-factor authentication requires an authenticated user")
+	}
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot generate totp secret: %v", err)
+	}
+	recoveryCodes, recoveryCodeHashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot generate recovery codes: %v", err)
+	}
+
+	// the new secret is only required at login once the user proves their app has it,
+	// until then the current one stays required
+	user, err := s.userStore.Modify(claims.UserName, func(user *User) error {
+		if user.TOTPEnabled && !user.VerifyOTP(req.GetCode(), s.now()) {
+			return status.Errorf(codes.PermissionDenied, "a current one-time password is required to replace the secret")
+		}
+		user.PendingTOTPSecret = secret
+		user.PendingRecoveryCodeHashes = recoveryCodeHashes
+		return nil
+	})
+	if err != nil {
+		return nil, userStoreError("cannot update user", err)
+	}
+
+	account := user.UserName
+	if s.tenantID != DefaultTenant {
+		account += "@" + s.tenantID
+	}
+
+	res := &pb.EnrollTOTPResponse{
+		Secret:        totpEncoding.EncodeToString(secret),
+		OtpauthUri:    totpURI(account, secret),
+		RecoveryCodes: recoveryCodes,
 	}
 
 	return res, nil
 }
+
+func (s *AuthServer) ConfirmTOTP(ctx context.Context, req *pb.ConfirmTOTPRequest) (*pb.ConfirmTOTPResponse, error) {
+	claims, ok := ClaimsFromContext(ctx)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "confirming two-factor authentication requires an authenticated user")
+	}
+
+	_, err := s.userStore.Modify(claims.UserName, func(user *User) error {
+		if len(user.PendingTOTPSecret) == 0 {
+			return status.Errorf(codes.FailedPrecondition, "no two-factor authentication is waiting for confirmation")
+		}
+		if !user.ConfirmTOTP(req.GetCode(), s.now()) {
+			return status.Errorf(codes.InvalidArgument, "invalid one-time password")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, userStoreError("cannot update user", err)
+	}
+
+	return &pb.ConfirmTOTPResponse{}, nil
+}
+
+func (s *AuthServer) CreateUser(ctx context.Context, req *pb.CreateUserRequest) (*pb.CreateUserResponse, error) {
+	if !s.roles.Has(req.GetRole()) {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown role: %s", req.GetRole())
+	}
+
+	user, err := s.createUser(req.GetUsername(), req.GetPassword(), req.GetRole())
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.CreateUserResponse{User: toPBUser(user)}, nil
+}
+
+func (s *AuthServer) DeleteUser(ctx context.Context, req *pb.DeleteUserRequest) (*pb.DeleteUserResponse, error) {
+	if isCaller(ctx, req.GetUsername()) {
+		return nil, status.Errorf(codes.FailedPrecondition, "cannot delete your own account")
+	}
+
+	err := s.userStore.Delete(req.GetUsername())
+	if err != nil {
+		return nil, userStoreError("cannot delete user", err)
+	}
+	err = s.revokeSessions(req.GetUsername())
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.DeleteUserResponse{}, nil
+}
+
+func (s *AuthServer) SetUserRole(ctx context.Context, req *pb.SetUserRoleRequest) (*pb.SetUserRoleResponse, error) {
+	if !s.roles.Has(req.GetRole()) {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown role: %s", req.GetRole())
+	}
+	if isCaller(ctx, req.GetUsername()) {
+		return nil, status.Errorf(codes.FailedPrecondition, "cannot change your own role")
+	}
+
+	user, err := s.userStore.Modify(req.GetUsername(), func(user *User) error {
+		user.Role = req.GetRole()
+		return nil
+	})
+	if err != nil {
+		return nil, userStoreError("cannot update user", err)
+	}
+	// the tokens issued until now carry the scopes of the previous role
+	err = s.revokeSessions(user.UserName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.SetUserRoleResponse{User: toPBUser(user)}, nil
+}
+
+func (s *AuthServer) ListUsers(ctx context.Context, req *pb.ListUsersRequest) (*pb.ListUsersResponse, error) {
+	users, err := s.userStore.List()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot list users: %v", err)
+	}
+
+	res := &pb.ListUsersResponse{}
+	for _, user := range users {
+		res.Users = append(res.Users, toPBUser(user))
+	}
+
+	return res, nil
+}
+
+func (s *AuthServer) CreateApiKey(ctx context.Context, req *pb.CreateApiKeyRequest) (*pb.CreateApiKeyResponse, error) {
+	if len(req.GetName()) == 0 || len(req.GetName()) > maxAPIKeyNameLength {
+		return nil, status.Errorf(codes.InvalidArgument, "name must have 1 to %d characters", maxAPIKeyNameLength)
+	}
+	if !s.roles.Has(req.GetRole()) {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown role: %s", req.GetRole())
+	}
+	for _, method := range req.GetAllowedMethods() {
+		if !fullMethodPattern.MatchString(method) {
+			return nil, status.Errorf(codes.InvalidArgument, "allowed method %q is not a full method name", method)
+		}
+	}
+
+	now := time.Now()
+	var expiresAt time.Time
+	if req.GetExpiresAt() != nil {
+		expiresAt = req.GetExpiresAt().AsTime()
+		if !expiresAt.After(now) {
+			return nil, status.Errorf(codes.InvalidArgument, "expiry time must be in the future")
+		}
+	}
+
+	secret, hash, err := newAPIKeySecret()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot generate api key: %v", err)
+	}
+
+	key := &APIKey{
+		ID:             uuid.New().String(),
+		TenantID:       s.tenantID,
+		Name:           req.GetName(),
+		Role:           req.GetRole(),
+		Hash:           hash,
+		AllowedMethods: req.GetAllowedMethods(),
+		CreatedAt:      now,
+		ExpiresAt:      expiresAt,
+	}
+	err = s.apiKeyStore.Save(key)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot save api key: %v", err)
+	}
+
+	res := &pb.CreateApiKeyResponse{
+		Key:    toPBAPIKey(key),
+		ApiKey: secret,
+	}
+
+	return res, nil
+}
+
+func (s *AuthServer) RevokeApiKey(ctx context.Context, req *pb.RevokeApiKeyRequest) (*pb.RevokeApiKeyResponse, error) {
+	err := s.apiKeyStore.Delete(s.tenantID, req.GetId())
+	if errors.Is(err, ErrAPIKeyNotFound) {
+		return nil, status.Errorf(codes.NotFound, "api key %s doesn't exist", req.GetId())
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot delete api key: %v", err)
+	}
+
+	return &pb.RevokeApiKeyResponse{}, nil
+}
+
+func (s *AuthServer) ListApiKeys(ctx context.Context, req *pb.ListApiKeysRequest) (*pb.ListApiKeysResponse, error) {
+	keys, err := s.apiKeyStore.List(s.tenantID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot list api keys: %v", err)
+	}
+
+	res := &pb.ListApiKeysResponse{}
+	for _, key := range keys {
+		res.Keys = append(res.Keys, toPBAPIKey(key))
+	}
+
+	return res, nil
+}
+
+func (s *AuthServer) QueryAuditLog(ctx context.Context, req *pb.QueryAuditLogRequest) (*pb.QueryAuditLogResponse, error) {
+	if s.auditLog == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "audit log is not enabled")
+	}
+
+	filter := AuditFilter{
+		TenantID: s.tenantID,
+		UserName: req.GetUserName(),
+	}
+	if req.StartTime != nil {
+		filter.Start = req.GetStartTime().AsTime()
+	}
+	if req.EndTime != nil {
+		filter.End = req.GetEndTime().AsTime()
+	}
+	if !filter.Start.IsZero() && !filter.End.IsZero() && filter.End.Before(filter.Start) {
+		return nil, status.Errorf(codes.InvalidArgument, "end time is before start time")
+	}
+
+	pageSize := int(req.GetPageSize())
+	if pageSize == 0 {
+		pageSize = defaultAuditPageSize
+	}
+	if pageSize > maxAuditPageSize {
+		pageSize = maxAuditPageSize
+	}
+
+	// the page token is the sequence number of the last record returned
+	var after uint64
+	if len(req.GetPageToken()) > 0 {
+		var err error
+		after, err = strconv.ParseUint(req.GetPageToken(), 10, 64)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid page token: %s", req.GetPageToken())
+		}
+	}
+
+	records, more, err := s.auditLog.Query(filter, after, pageSize)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot query audit log: %v", err)
+	}
+
+	res := &pb.QueryAuditLogResponse{Records: records}
+	if more {
+		res.NextPageToken = strconv.FormatUint(records[len(records)-1].GetSequence(), 10)
+	}
+	return res, nil
+}
+
+func (s *AuthServer) createUser(userName string, password string, role string) (*User, error) {
+	if !userNamePattern.MatchString(userName) {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"username must have 3 to 32 letters, digits, dots, dashes or underscores")
+	}
+
+	err := validatePassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := NewUser(userName, password, role)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot create user: %v", err)
+	}
+
+	err = s.userStore.Save(user)
+	if err != nil {
+		return nil, userStoreError("cannot save user", err)
+	}
+
+	return user, nil
+}
+
+func (s *AuthServer) findUser(userName string) (*User, error) {
+	user, err := s.userStore.Find(userName)
+	if err != nil {
+		return nil, userStoreError("cannot find user", err)
+	}
+	return user, nil
+}
+
+// issueTokens returns a new access token and a new refresh token for the user.
+func (s *AuthServer) issueTokens(user *User) (string, string, error) {
+	accessToken, claims, err := s.jwtManager.generateToken(UserClaims{
+		TenantID: s.tenantID,
+		UserName: user.UserName,
+		Role:     user.Role,
+		Scopes:   s.roles.Scopes(user.Role),
+	})
+	if err != nil {
+		return "", "", status.Errorf(codes.Internal, "cannot generate access token: %v", err)
+	}
+
+	refreshToken, hash, err := newRefreshToken()
+	if err != nil {
+		return "", "", status.Errorf(codes.Internal, "cannot generate refresh token: %v", err)
+	}
+
+	err = s.refreshTokenStore.Save(&RefreshToken{
+		Hash:               hash,
+		UserName:           user.UserName,
+		ExpiresAt:          time.Now().Add(s.refreshTokenDuration),
+		AccessTokenID:      claims.Id,
+		AccessTokenExpires: time.Unix(claims.ExpiresAt, 0),
+	})
+	if err != nil {
+		return "", "", status.Errorf(codes.Internal, "cannot save refresh token: %v", err)
+	}
+
+	return accessToken, refreshToken, nil
+}
+
+// revokeSessions revokes the refresh tokens of the user, and the access tokens issued with them.
+func (s *AuthServer) revokeSessions(userName string) error {
+	sessions, err := s.refreshTokenStore.TakeUser(userName)
+	if err != nil {
+		return status.Errorf(codes.Internal, "cannot revoke refresh tokens: %v", err)
+	}
+
+	for _, session := range sessions {
+		s.jwtManager.RevokeToken(session.AccessTokenID, session.AccessTokenExpires)
+	}
+	return nil
+}
+
+func (s *AuthServer) takeRefreshToken(refreshToken string) (*RefreshToken, error) {
+	if len(refreshToken) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "refresh token is not provided")
+	}
+
+	session, err := s.refreshTokenStore.Take(hashRefreshToken(refreshToken))
+	if errors.Is(err, ErrRefreshTokenNotFound) {
+		return nil, status.Errorf(codes.Unauthenticated, "refresh token is invalid or has been revoked")
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find refresh token: %v", err)
+	}
+	if !time.Now().Before(session.ExpiresAt) {
+		return nil, status.Errorf(codes.Unauthenticated, "refresh token has expired")
+	}
+
+	return session, nil
+}
+
+// peerHost returns the host of a peer address, without the port that changes with every connection.
+func peerHost(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// retryLaterError returns a ResourceExhausted error telling the client when to retry.
+func retryLaterError(wait time.Duration, format string, args ...interface{}) error {
+	st := status.Newf(codes.ResourceExhausted, format, args...)
+	detailed, err := st.WithDetails(&errdetails.RetryInfo{
+		RetryDelay: durationpb.New(wait),
+	})
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+func validatePassword(password string) error {
+	if len(password) < minPasswordLength {
+		return status.Errorf(codes.InvalidArgument, "password must have at least %d characters", minPasswordLength)
+	}
+	return nil
+}
+
+func isCaller(ctx context.Context, userName string) bool {
+	claims, ok := ClaimsFromContext(ctx)
+	return ok && claims.UserName == userName
+}
+
+func userStoreError(message string, err error) error {
+	// the status of a failed modification is kept
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	code := codes.Internal
+	switch {
+	case errors.Is(err, ErrUserNotFound):
+		code = codes.NotFound
+	case errors.Is(err, ErrUserAlreadyExists):
+		code = codes.AlreadyExists
+	}
+	return status.Errorf(code, "%s: %v", message, err)
+}
+
+func toPBAPIKey(key *APIKey) *pb.ApiKeyInfo {
+	info := &pb.ApiKeyInfo{
+		Id:             key.ID,
+		Name:           key.Name,
+		Role:           key.Role,
+		AllowedMethods: key.AllowedMethods,
+		CreatedAt:      timestamppb.New(key.CreatedAt),
+	}
+	if !key.ExpiresAt.IsZero() {
+		info.ExpiresAt = timestamppb.New(key.ExpiresAt)
+	}
+	if !key.LastUsedAt.IsZero() {
+		info.LastUsedAt = timestamppb.New(key.LastUsedAt)
+	}
+	return info
+}
+
+func toPBUser(user *User) *pb.UserInfo {
+	return &pb.UserInfo{
+		Username: user.UserName,
+		Role:     user.Role,
+	}
+}
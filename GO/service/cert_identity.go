@@ -0,0 +1,60 @@
+package service
+
+import (
+	"context"
+	"crypto/x509"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// CertIdentity is the role, and the tenant, granted to the holder of a client certificate.
+type CertIdentity struct {
+	Role     string
+	TenantID string
+}
+
+// CertIdentities maps the identity in a client certificate, a SAN URI or the subject common name, to a role.
+type CertIdentities map[string]CertIdentity
+
+// authenticate returns the claims of the caller identified by a verified client certificate, if any.
+func (identities CertIdentities) authenticate(ctx context.Context) (*UserClaims, bool) {
+	cert, ok := verifiedClientCert(ctx)
+	if !ok {
+		return nil, false
+	}
+
+	// SAN URIs such as SPIFFE ids name a workload more precisely than the common name
+	names := []string{}
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	names = append(names, cert.Subject.CommonName)
+
+	for _, name := range names {
+		identity, ok := identities[name]
+		if ok && len(name) > 0 {
+			return &UserClaims{TenantID: identity.TenantID, UserName: name, Role: identity.Role}, true
+		}
+	}
+	return nil, false
+}
+
+// verifiedClientCert returns the leaf certificate of the caller, if the TLS handshake verified it.
+func verifiedClientCert(ctx context.Context) (*x509.Certificate, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil, false
+	}
+
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return nil, false
+	}
+
+	chains := tlsInfo.State.VerifiedChains
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return nil, false
+	}
+	return chains[0][0], true
+}
@@ -0,0 +1,158 @@
+package service_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/url"
+	"pcbook/authpolicy"
+	"pcbook/sample"
+	"pcbook/service"
+	"testing"
+	"time"
+
+	pb "pcbook/generateProto"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestAuthInterceptorCertIdentities(t *testing.T) {
+	t.Parallel()
+
+	ca := newTestCA(t)
+	serverCert := ca.issue(t, "server", nil, x509.ExtKeyUsageServerAuth)
+	inventoryCert := ca.issue(t, "inventory", []string{"spiffe://pcbook/inventory"}, x509.ExtKeyUsageClientAuth)
+	reporterCert := ca.issue(t, "reporter.pcbook.com", nil, x509.ExtKeyUsageClientAuth)
+	unknownCert := ca.issue(t, "unknown", []string{"spiffe://pcbook/unknown"}, x509.ExtKeyUsageClientAuth)
+
+	policies, err := authpolicy.Load(pb.LaptopService_ServiceDesc.ServiceName)
+	require.NoError(t, err)
+	interceptor := service.NewAuthInterceptor(
+		service.NewJWTManager(testSecretKey, time.Minute),
+		policies,
+		service.WithCertIdentities(service.CertIdentities{
+			"spiffe://pcbook/inventory": {Role: service.AdminRole},
+			"reporter.pcbook.com":       {Role: service.UserRole},
+		}),
+	)
+
+	serverCreds := credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool,
+	})
+	grpcServer := grpc.NewServer(
+		grpc.Creds(serverCreds),
+		grpc.UnaryInterceptor(interceptor.Unary()),
+		grpc.StreamInterceptor(interceptor.Stream()),
+	)
+	laptopServer := service.NewLaptopServer(service.NewInMemoryLaptopStore(), nil, nil)
+	pb.RegisterLaptopServiceServer(grpcServer, laptopServer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	newClient := func(cert tls.Certificate) pb.LaptopServiceClient {
+		creds := credentials.NewTLS(&tls.Config{
+			Certificates: []tls.Certificate{cert},
+			RootCAs:      ca.pool,
+			ServerName:   "server",
+		})
+		conn, err := grpc.Dial(listener.Addr().String(), grpc.WithTransportCredentials(creds))
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return pb.NewLaptopServiceClient(conn)
+	}
+
+	createLaptop := func(ctx context.Context, laptopClient pb.LaptopServiceClient) error {
+		_, err := laptopClient.CreateLaptop(ctx, &pb.CreateLaptopRequest{Laptop: sample.NewLaptop()})
+		return err
+	}
+
+	// the SAN URI maps to the admin role
+	err = createLaptop(context.Background(), newClient(inventoryCert))
+	require.NoError(t, err)
+
+	// the common name maps to the user role, which can't create laptops
+	err = createLaptop(context.Background(), newClient(reporterCert))
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	err = createLaptop(context.Background(), newClient(unknownCert))
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// an access token takes precedence over the certificate
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "invalid")
+	err = createLaptop(ctx, newClient(inventoryCert))
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	err = createLaptop(contextWithTestUser(t, "admin", service.AdminRole), newClient(unknownCert))
+	require.NoError(t, err)
+}
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+func (ca *testCA) issue(t *testing.T, commonName string, uris []string, usage x509.ExtKeyUsage) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	for _, uri := range uris {
+		parsed, err := url.Parse(uri)
+		require.NoError(t, err)
+		template.URIs = append(template.URIs, parsed)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
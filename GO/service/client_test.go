@@ -0,0 +1,351 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"path/filepath"
+	"pcbook/authpolicy"
+	"pcbook/client"
+	"pcbook/sample"
+	"pcbook/service"
+	"sync"
+	"testing"
+	"time"
+
+	pb "pcbook/generateProto"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestClientSharesOneConnection(t *testing.T) {
+	t.Parallel()
+
+	userStore := service.NewInMemoryUserStore()
+	require.NoError(t, userStore.Save(newTestUser(t, "vendor", service.VendorRole)))
+	listener := &countingListener{}
+	startTestServer(t,
+		withUserStore(userStore),
+		withJWTManager(service.NewJWTManager(testSecretKey, 2*time.Second)),
+		withCountingListener(listener),
+	)
+
+	pcbook, err := client.New(listener.Addr().String(),
+		client.WithDialOptions(grpc.WithInsecure()),
+		client.WithPassword("vendor", "vendor-password"),
+		client.WithAuthInterceptorOptions(client.WithRefreshMargin(time.Second)),
+	)
+	require.NoError(t, err)
+	defer pcbook.Close()
+
+	laptop := sample.NewLaptop()
+	_, err = pcbook.Laptop().CreateLaptop(context.Background(), laptop)
+	require.NoError(t, err)
+
+	// the first token has expired, the laptop calls go on with the tokens renewed over the same connection
+	time.Sleep(2500 * time.Millisecond)
+	it, err := pcbook.Laptop().SearchLaptop(context.Background(), &pb.Filter{MaxPriceUsd: math.MaxFloat64})
+	require.NoError(t, err)
+	laptops, err := it.All()
+	require.NoError(t, err)
+	require.Len(t, laptops, 1)
+	require.NoError(t, pcbook.Laptop().DeleteLaptop(context.Background(), laptop.Id))
+
+	// the auth service methods needing a token get it too
+	authService := pb.NewAuthServiceClient(pcbook.Conn())
+	_, err = authService.ChangePassword(context.Background(), &pb.ChangePasswordRequest{
+		OldPassword: "wrong-password",
+		NewPassword: "new-password",
+	})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	require.NoError(t, pcbook.Logout(context.Background()))
+	require.Equal(t, 1, listener.accepted())
+
+	// the password isn't kept to log in again once the session is revoked
+	_, err = pcbook.Laptop().CreateLaptop(context.Background(), sample.NewLaptop())
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// without credentials, the client only makes public calls
+	anonymous, err := client.New(listener.Addr().String(), client.WithDialOptions(grpc.WithInsecure()))
+	require.NoError(t, err)
+	defer anonymous.Close()
+
+	_, err = anonymous.Laptop().CreateLaptop(context.Background(), sample.NewLaptop())
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = anonymous.Laptop().GetLaptop(context.Background(), laptop.Id)
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = client.New(listener.Addr().String(),
+		client.WithDialOptions(grpc.WithInsecure()),
+		client.WithPassword("vendor", "wrong-password"),
+	)
+	require.Equal(t, codes.NotFound, status.Code(errors.Unwrap(err)))
+}
+
+// countingListener counts the connections accepted by a server.
+type countingListener struct {
+	net.Listener
+
+	mutex sync.Mutex
+	count int
+}
+
+func (listener *countingListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err == nil {
+		listener.mutex.Lock()
+		listener.count++
+		listener.mutex.Unlock()
+	}
+	return conn, err
+}
+
+func (listener *countingListener) accepted() int {
+	listener.mutex.Lock()
+	defer listener.mutex.Unlock()
+	return listener.count
+}
+
+// testServer is the setup of a server started by startTestServer.
+type testServer struct {
+	userStore    service.UserStore
+	users        []*service.User
+	laptopStore  service.LaptopStore
+	imageStore   service.ImageStore
+	ratingStore  service.RatingStore
+	jwtManager   *service.JWTManager
+	authOptions  []service.AuthServerOption
+	auditLog     service.AuditLog
+	imageFolder  string
+	tenants      map[string][]*service.User
+	faults       *faultInjector
+	interceptors []grpc.UnaryServerInterceptor
+	listener     *countingListener
+	withoutAuth  bool
+}
+
+// testServerOption changes the setup of a server started by startTestServer.
+type testServerOption func(server *testServer)
+
+func withUserStore(userStore service.UserStore) testServerOption {
+	return func(server *testServer) {
+		server.userStore = userStore
+	}
+}
+
+// withUsers saves the users in the user store of the server.
+func withUsers(users ...*service.User) testServerOption {
+	return func(server *testServer) {
+		server.users = append(server.users, users...)
+	}
+}
+
+func withLaptopStore(laptopStore service.LaptopStore) testServerOption {
+	return func(server *testServer) {
+		server.laptopStore = laptopStore
+	}
+}
+
+func withImageStore(imageStore service.ImageStore) testServerOption {
+	return func(server *testServer) {
+		server.imageStore = imageStore
+	}
+}
+
+func withRatingStore(ratingStore service.RatingStore) testServerOption {
+	return func(server *testServer) {
+		server.ratingStore = ratingStore
+	}
+}
+
+// withAuthServerOptions configures the auth server, e.g. its clock or its login limiter.
+func withAuthServerOptions(options ...service.AuthServerOption) testServerOption {
+	return func(server *testServer) {
+		server.authOptions = append(server.authOptions, options...)
+	}
+}
+
+// withJWTManager issues and verifies the tokens with jwtManager, instead of one issuing tokens valid for a minute.
+func withJWTManager(jwtManager *service.JWTManager) testServerOption {
+	return func(server *testServer) {
+		server.jwtManager = jwtManager
+	}
+}
+
+// withAuditLog records the logins and the authorization decisions in auditLog.
+func withAuditLog(auditLog service.AuditLog) testServerOption {
+	return func(server *testServer) {
+		server.auditLog = auditLog
+	}
+}
+
+// withTenants serves each tenant with its own stores holding its users, and its images in a subfolder of imageFolder.
+func withTenants(imageFolder string, users map[string][]*service.User) testServerOption {
+	return func(server *testServer) {
+		server.imageFolder = imageFolder
+		server.tenants = users
+	}
+}
+
+// withFaults makes the calls fail as set up in the injector, before they are authorized.
+func withFaults(injector *faultInjector) testServerOption {
+	return func(server *testServer) {
+		server.faults = injector
+	}
+}
+
+// withUnaryInterceptor runs interceptor on the unary calls, before they are authorized.
+func withUnaryInterceptor(interceptor grpc.UnaryServerInterceptor) testServerOption {
+	return func(server *testServer) {
+		server.interceptors = append(server.interceptors, interceptor)
+	}
+}
+
+// withCountingListener serves the connections accepted by listener, so that it counts them.
+func withCountingListener(listener *countingListener) testServerOption {
+	return func(server *testServer) {
+		server.listener = listener
+	}
+}
+
+// withoutAuth serves every call without checking its credentials.
+func withoutAuth() testServerOption {
+	return func(server *testServer) {
+		server.withoutAuth = true
+	}
+}
+
+// startTestServer serves the auth, laptop and review services, and returns its address.
+// The server is stopped when the test ends.
+func startTestServer(t *testing.T, options ...testServerOption) string {
+	server := &testServer{
+		userStore:   service.NewInMemoryUserStore(),
+		laptopStore: service.NewInMemoryLaptopStore(),
+		imageStore:  service.NewContentAddressedImageStore(t.TempDir(), 0),
+		ratingStore: service.NewInMemoryRatingStore(),
+		jwtManager:  service.NewJWTManager(testSecretKey, time.Minute),
+	}
+	for _, option := range options {
+		option(server)
+	}
+	for _, user := range server.users {
+		require.NoError(t, server.userStore.Save(user))
+	}
+
+	// the interceptor must share the jwt manager and the API key store of the auth server
+	apiKeyStore := service.NewInMemoryAPIKeyStore()
+	authOptions := server.authOptions
+	interceptorOptions := []service.AuthInterceptorOption{service.WithAPIKeys(apiKeyStore)}
+	if server.auditLog != nil {
+		authOptions = append(authOptions, service.WithAuditLog(server.auditLog))
+		interceptorOptions = append(interceptorOptions, service.WithInterceptorAuditLog(server.auditLog))
+	}
+
+	unaryInterceptors := []grpc.UnaryServerInterceptor{}
+	streamInterceptors := []grpc.StreamServerInterceptor{}
+	if server.faults != nil {
+		unaryInterceptors = append(unaryInterceptors, server.faults.unary)
+		streamInterceptors = append(streamInterceptors, server.faults.stream)
+	}
+	unaryInterceptors = append(unaryInterceptors, server.interceptors...)
+	if !server.withoutAuth {
+		policies, err := authpolicy.Load(
+			pb.AuthService_ServiceDesc.ServiceName,
+			pb.LaptopService_ServiceDesc.ServiceName,
+			pb.ReviewService_ServiceDesc.ServiceName,
+		)
+		require.NoError(t, err)
+		interceptor := service.NewAuthInterceptor(server.jwtManager, policies, interceptorOptions...)
+		unaryInterceptors = append(unaryInterceptors, interceptor.Unary())
+		streamInterceptors = append(streamInterceptors, interceptor.Stream())
+	}
+	grpcServer := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(unaryInterceptors...),
+		grpc.ChainStreamInterceptor(streamInterceptors...),
+	)
+
+	if server.tenants == nil {
+		authServer := service.NewAuthServer(
+			server.userStore,
+			server.jwtManager,
+			service.NewInMemoryRefreshTokenStore(),
+			time.Hour,
+			apiKeyStore,
+			authOptions...,
+		)
+		laptopServer := service.NewLaptopServer(server.laptopStore, server.imageStore, server.ratingStore)
+		reviewServer := service.NewReviewServer(
+			service.NewInMemoryReviewStore(),
+			server.laptopStore,
+			server.ratingStore,
+			service.DefaultScoreRange,
+		)
+		pb.RegisterAuthServiceServer(grpcServer, authServer)
+		pb.RegisterLaptopServiceServer(grpcServer, laptopServer)
+		pb.RegisterReviewServiceServer(grpcServer, reviewServer)
+	} else {
+		registerTestTenants(t, grpcServer, server, apiKeyStore, authOptions)
+	}
+
+	listener, err := net.Listen("tcp", ":0")
+	require.NoError(t, err, "cannot start test server")
+	if server.listener != nil {
+		server.listener.Listener = listener
+		listener = server.listener
+	}
+
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	return listener.Addr().String()
+}
+
+// registerTestTenants registers the auth and laptop servers of every tenant of the test server.
+func registerTestTenants(
+	t *testing.T,
+	grpcServer *grpc.Server,
+	server *testServer,
+	apiKeyStore service.APIKeyStore,
+	authOptions []service.AuthServerOption,
+) {
+	tenantIDs := []string{}
+	for tenantID := range server.tenants {
+		tenantIDs = append(tenantIDs, tenantID)
+	}
+
+	authServers, err := service.NewTenants(tenantIDs, func(tenantID string) (*service.AuthServer, error) {
+		userStore := service.NewInMemoryUserStore()
+		for _, user := range server.tenants[tenantID] {
+			err := userStore.Save(user)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return service.NewAuthServer(
+			userStore,
+			server.jwtManager,
+			service.NewInMemoryRefreshTokenStore(),
+			time.Hour,
+			apiKeyStore,
+			append([]service.AuthServerOption{service.WithTenant(tenantID)}, authOptions...)...,
+		), nil
+	})
+	require.NoError(t, err)
+
+	laptopServers, err := service.NewTenants(tenantIDs, func(tenantID string) (*service.LaptopServer, error) {
+		return service.NewLaptopServer(
+			service.NewInMemoryLaptopStore(),
+			service.NewContentAddressedImageStore(filepath.Join(server.imageFolder, tenantID), 0),
+			service.NewInMemoryRatingStore(),
+		), nil
+	})
+	require.NoError(t, err)
+
+	service.RegisterTenantService(grpcServer, &pb.AuthService_ServiceDesc, authServers)
+	service.RegisterTenantService(grpcServer, &pb.LaptopService_ServiceDesc, laptopServers)
+}
@@ -0,0 +1,253 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// ImageBlob is a single image file on disk, shared by every laptop that uploaded the same content.
+type ImageBlob struct {
+	Path string
+	Type string
+	Size int
+	// Refs maps the ID of each laptop referencing this blob to the image ID it was given.
+	Refs map[string]string
+}
+
+// ContentAddressedImageStore stores image blobs keyed by their SHA-256 checksum,
+// so identical uploads are written to disk only once.
+type ContentAddressedImageStore struct {
+	mutex       sync.Mutex
+	imageFolder string
+	maxImages   int
+	images      map[string]*ImageInfo
+	blobs       map[string]*ImageBlob
+	counts      map[string]int
+}
+
+// NewContentAddressedImageStore returns a store keeping at most maxImages images per laptop, or any number if maxImages is 0.
+func NewContentAddressedImageStore(imageFolder string, maxImages int) *ContentAddressedImageStore {
+	return &ContentAddressedImageStore{
+		imageFolder: imageFolder,
+		maxImages:   maxImages,
+		images:      make(map[string]*ImageInfo),
+		blobs:       make(map[string]*ImageBlob),
+		counts:      make(map[string]int),
+	}
+}
+
+func Checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (store *ContentAddressedImageStore) Save(laptopID, imageType string, imageData bytes.Buffer) (string, error) {
+	data := imageData.Bytes()
+	checksum := Checksum(data)
+
+	store.mutex.Lock()
+	blob := store.blobs[checksum]
+	if blob != nil {
+		if imageID, ok := blob.Refs[laptopID]; ok {
+			store.mutex.Unlock()
+			return imageID, nil
+		}
+	}
+	full := store.isFull(laptopID)
+	store.mutex.Unlock()
+
+	if full {
+		return "", ErrTooManyImages
+	}
+
+	// write to a temporary file first so that concurrent uploads of the same content never see a partial blob
+	var tmpPath string
+	if blob == nil {
+		path, err := store.writeTempFile(data)
+		if err != nil {
+			return "", err
+		}
+		tmpPath = path
+		defer os.Remove(tmpPath)
+	}
+
+	imageID, err := uuid.NewRandom()
+	if err != nil {
+		return "", fmt.Errorf("cannot generate image ID: %w", err)
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	blob = store.blobs[checksum]
+	if blob != nil {
+		if existingID, ok := blob.Refs[laptopID]; ok {
+			return existingID, nil
+		}
+	}
+	if store.isFull(laptopID) {
+		return "", ErrTooManyImages
+	}
+
+	if blob == nil {
+		// the blob was garbage collected since we last looked
+		if tmpPath == "" {
+			tmpPath, err = store.writeTempFile(data)
+			if err != nil {
+				return "", err
+			}
+			defer os.Remove(tmpPath)
+		}
+
+		imagePath := fmt.Sprintf("%s/%s%s", store.imageFolder, checksum, imageType)
+		err = os.Rename(tmpPath, imagePath)
+		if err != nil {
+			return "", fmt.Errorf("cannot move image file: %w", err)
+		}
+		log.Print("image path: ", imagePath)
+
+		blob = &ImageBlob{
+			Path: imagePath,
+			Type: imageType,
+			Size: len(data),
+			Refs: make(map[string]string),
+		}
+		store.blobs[checksum] = blob
+	}
+
+	blob.Refs[laptopID] = imageID.String()
+	store.counts[laptopID]++
+	store.images[imageID.String()] = &ImageInfo{
+		LaptopID: laptopID,
+		Type:     imageType,
+		Path:     blob.Path,
+		Checksum: checksum,
+	}
+
+	return imageID.String(), nil
+}
+
+func (store *ContentAddressedImageStore) writeTempFile(data []byte) (string, error) {
+	// the folder of a tenant is created with its first image
+	err := os.MkdirAll(store.imageFolder, 0755)
+	if err != nil {
+		return "", fmt.Errorf("cannot create image folder: %w", err)
+	}
+
+	file, err := os.CreateTemp(store.imageFolder, "upload-*")
+	if err != nil {
+		return "", fmt.Errorf("cannot create image file: %w", err)
+	}
+	defer file.Close()
+
+	_, err = file.Write(data)
+	if err != nil {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("cannot write image data to file: %w", err)
+	}
+
+	return file.Name(), nil
+}
+
+// Find returns the image with the given ID, or nil if it doesn't exist.
+func (store *ContentAddressedImageStore) Find(imageID string) (*ImageInfo, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	image := store.images[imageID]
+	if image == nil {
+		return nil, nil
+	}
+
+	other := *image
+	return &other, nil
+}
+
+// RefCount returns how many laptops reference the blob with the given checksum.
+func (store *ContentAddressedImageStore) RefCount(checksum string) int {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	blob := store.blobs[checksum]
+	if blob == nil {
+		return 0
+	}
+	return len(blob.Refs)
+}
+
+// Delete drops the reference from an image to its blob.
+// The blob stays on disk until the next GarbageCollect.
+func (store *ContentAddressedImageStore) Delete(imageID string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	image := store.images[imageID]
+	if image == nil {
+		return ErrImageNotFound
+	}
+
+	delete(store.images, imageID)
+	if blob := store.blobs[image.Checksum]; blob != nil {
+		delete(blob.Refs, image.LaptopID)
+	}
+	store.counts[image.LaptopID]--
+	return nil
+}
+
+// DeleteLaptop drops the references from every image of the laptop to their blobs.
+// The blobs no longer referenced stay on disk until the next GarbageCollect.
+func (store *ContentAddressedImageStore) DeleteLaptop(laptopID string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for imageID, image := range store.images {
+		if image.LaptopID != laptopID {
+			continue
+		}
+
+		delete(store.images, imageID)
+		if blob := store.blobs[image.Checksum]; blob != nil {
+			delete(blob.Refs, laptopID)
+		}
+	}
+
+	delete(store.counts, laptopID)
+	return nil
+}
+
+// isFull must be called with the mutex held.
+func (store *ContentAddressedImageStore) isFull(laptopID string) bool {
+	return store.maxImages > 0 && store.counts[laptopID] >= store.maxImages
+}
+
+// GarbageCollect removes every blob that is no longer referenced by any laptop
+// and returns the number of blobs removed.
+func (store *ContentAddressedImageStore) GarbageCollect() (int, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	removed := 0
+	for checksum, blob := range store.blobs {
+		if len(blob.Refs) > 0 {
+			continue
+		}
+
+		err := os.Remove(blob.Path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return removed, fmt.Errorf("cannot remove image file: %w", err)
+		}
+
+		delete(store.blobs, checksum)
+		removed++
+	}
+
+	return removed, nil
+}
@@ -0,0 +1,175 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	pb "pcbook/generateProto"
+	"pcbook/serializer"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// FileRatingStore keeps ratings in memory and writes a snapshot of them to a file after every change,
+// so that they survive restarts.
+type FileRatingStore struct {
+	*InMemoryRatingStore
+	filename string
+}
+
+// NewFileRatingStore loads the ratings saved in filename, if the file exists.
+func NewFileRatingStore(filename string) (*FileRatingStore, error) {
+	store := &FileRatingStore{
+		InMemoryRatingStore: NewInMemoryRatingStore(),
+		filename:            filename,
+	}
+
+	snapshot := &pb.RatingSnapshot{}
+	err := serializer.ReadProtobufFromBinaryFile(snapshot, filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot load ratings: %w", err)
+	}
+
+	for _, record := range snapshot.GetRatings() {
+		store.put(&UserRating{
+			LaptopID: record.GetLaptopId(),
+			UserName: record.GetUserName(),
+			Score:    record.GetScore(),
+			RatedAt:  record.GetRatedAt().AsTime(),
+		})
+	}
+
+	return store, nil
+}
+
+func (store *FileRatingStore) Add(laptopID string, userName string, score float64) (*Rating, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	rating, previous := store.put(&UserRating{
+		LaptopID: laptopID,
+		UserName: userName,
+		Score:    score,
+		RatedAt:  time.Now(),
+	})
+
+	err := store.save()
+	if err != nil {
+		// keep memory consistent with the file
+		if previous != nil {
+			store.put(previous)
+		} else {
+			store.remove(laptopID, userName)
+		}
+		return nil, err
+	}
+
+	return rating, nil
+}
+
+func (store *FileRatingStore) Remove(laptopID string, userName string) (*Rating, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	rating, previous, err := store.remove(laptopID, userName)
+	if err != nil {
+		return nil, err
+	}
+
+	err = store.save()
+	if err != nil {
+		store.put(previous)
+		return nil, err
+	}
+
+	return rating, nil
+}
+
+func (store *FileRatingStore) RemoveLaptop(laptopID string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	removed := store.removeLaptop(laptopID)
+	if len(removed) == 0 {
+		return nil
+	}
+
+	err := store.save()
+	if err != nil {
+		for _, rating := range removed {
+			store.put(rating)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// save must be called with the mutex held.
+func (store *FileRatingStore) save() error {
+	snapshot := &pb.RatingSnapshot{}
+	for _, rating := range store.all() {
+		snapshot.Ratings = append(snapshot.Ratings, &pb.RatingRecord{
+			LaptopId: rating.LaptopID,
+			UserName: rating.UserName,
+			Score:    rating.Score,
+			RatedAt:  timestamppb.New(rating.RatedAt),
+		})
+	}
+
+	data, err := proto.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("cannot save ratings: %w", err)
+	}
+
+	// write to a temporary file first so that a crash never leaves a truncated snapshot,
+	// synced before the rename so that the renamed file never misses its data
+	tmpFilename := store.filename + ".tmp"
+	file, err := os.OpenFile(tmpFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("cannot save ratings: %w", err)
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpFilename)
+		return fmt.Errorf("cannot save ratings: %w", err)
+	}
+
+	err = os.Rename(tmpFilename, store.filename)
+	if err != nil {
+		return fmt.Errorf("cannot save ratings: %w", err)
+	}
+
+	// the rename itself is only durable once the directory is synced. The snapshot is in place already,
+	// so a failure isn't returned, which would undo the change in memory only.
+	err = syncDir(filepath.Dir(store.filename))
+	if err != nil {
+		log.Printf("cannot sync ratings directory: %v", err)
+	}
+
+	return nil
+}
+
+// syncDir makes the creation, removal and renaming of the files of a directory durable.
+func syncDir(dirname string) error {
+	dir, err := os.Open(dirname)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
@@ -2,6 +2,7 @@ package service
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -10,30 +11,48 @@ import (
 	"github.com/google/uuid"
 )
 
+var (
+	ErrImageNotFound = errors.New("image not found")
+	ErrTooManyImages = errors.New("laptop has too many images")
+)
+
 type ImageStore interface {
 	Save(LaptopID, imageType string, imageData bytes.Buffer) (string, error)
+	Find(imageID string) (*ImageInfo, error)
+	Delete(imageID string) error
+	// DeleteLaptop drops every image of the laptop.
+	DeleteLaptop(laptopID string) error
 }
 
 type ImageInfo struct {
 	LaptopID string
 	Type     string
 	Path     string
+	Checksum string
 }
 
 type DiskImageStore struct {
 	mutex       sync.Mutex
 	imageFolder string
+	maxImages   int
 	images      map[string]*ImageInfo
+	counts      map[string]int
 }
 
-func NewDiskImageStore(imageFolder string) *DiskImageStore {
+// NewDiskImageStore returns a store keeping at most maxImages images per laptop, or any number if maxImages is 0.
+func NewDiskImageStore(imageFolder string, maxImages int) *DiskImageStore {
 	return &DiskImageStore{
 		imageFolder: imageFolder,
+		maxImages:   maxImages,
 		images:      make(map[string]*ImageInfo),
+		counts:      make(map[string]int),
 	}
 }
 
 func (store *DiskImageStore) Save(LaptopID, imageType string, imageData bytes.Buffer) (string, error) {
+	if store.isFull(LaptopID) {
+		return "", ErrTooManyImages
+	}
 
 	imageID, err := uuid.NewRandom()
 	if err != nil {
@@ -56,11 +75,76 @@ func (store *DiskImageStore) Save(LaptopID, imageType string, imageData bytes.Bu
 	store.mutex.Lock()
 	defer store.mutex.Unlock()
 
+	if store.maxImages > 0 && store.counts[LaptopID] >= store.maxImages {
+		os.Remove(image_path)
+		return "", ErrTooManyImages
+	}
+
 	store.images[imageID.String()] = &ImageInfo{
 		LaptopID: LaptopID,
 		Type:     imageType,
 		Path:     image_path,
 	}
+	store.counts[LaptopID]++
 
 	return imageID.String(), nil
 }
+
+func (store *DiskImageStore) isFull(laptopID string) bool {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.maxImages > 0 && store.counts[laptopID] >= store.maxImages
+}
+
+func (store *DiskImageStore) Find(imageID string) (*ImageInfo, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	image := store.images[imageID]
+	if image == nil {
+		return nil, nil
+	}
+
+	other := *image
+	return &other, nil
+}
+
+func (store *DiskImageStore) Delete(imageID string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	image := store.images[imageID]
+	if image == nil {
+		return ErrImageNotFound
+	}
+
+	err := os.Remove(image.Path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("cannot remove image file: %w", err)
+	}
+
+	delete(store.images, imageID)
+	store.counts[image.LaptopID]--
+	return nil
+}
+
+func (store *DiskImageStore) DeleteLaptop(laptopID string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for imageID, image := range store.images {
+		if image.LaptopID != laptopID {
+			continue
+		}
+
+		err := os.Remove(image.Path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("cannot remove image file: %w", err)
+		}
+		delete(store.images, imageID)
+	}
+
+	delete(store.counts, laptopID)
+	return nil
+}
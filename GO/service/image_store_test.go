@@ -0,0 +1,85 @@
+package service_test
+
+import (
+	"bytes"
+	"os"
+	"pcbook/service"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestContentAddressedImageStore(t *testing.T) {
+	t.Parallel()
+
+	imageFolder := t.TempDir()
+	store := service.NewContentAddressedImageStore(imageFolder, 0)
+
+	data := []byte("same vendor photo")
+	checksum := service.Checksum(data)
+
+	id1, err := store.Save("laptop-1", ".jpg", *bytes.NewBuffer(data))
+	require.NoError(t, err)
+
+	id2, err := store.Save("laptop-2", ".jpg", *bytes.NewBuffer(data))
+	require.NoError(t, err)
+	require.NotEqual(t, id1, id2)
+
+	again, err := store.Save("laptop-1", ".jpg", *bytes.NewBuffer(data))
+	require.NoError(t, err)
+	require.Equal(t, id1, again)
+
+	require.Equal(t, 2, store.RefCount(checksum))
+
+	entries, err := os.ReadDir(imageFolder)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	image, err := store.Find(id1)
+	require.NoError(t, err)
+	require.Equal(t, checksum, image.Checksum)
+
+	require.NoError(t, store.Delete(id1))
+	removed, err := store.GarbageCollect()
+	require.NoError(t, err)
+	require.Equal(t, 0, removed)
+
+	require.NoError(t, store.Delete(id2))
+	require.ErrorIs(t, store.Delete(id2), service.ErrImageNotFound)
+
+	removed, err = store.GarbageCollect()
+	require.NoError(t, err)
+	require.Equal(t, 1, removed)
+	require.Equal(t, 0, store.RefCount(checksum))
+
+	entries, err = os.ReadDir(imageFolder)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestImageStoreMaxImages(t *testing.T) {
+	t.Parallel()
+
+	stores := map[string]service.ImageStore{
+		"disk":              service.NewDiskImageStore(t.TempDir(), 2),
+		"content_addressed": service.NewContentAddressedImageStore(t.TempDir(), 2),
+	}
+
+	for name, store := range stores {
+		id1, err := store.Save("laptop-1", ".jpg", *bytes.NewBufferString("image 1"))
+		require.NoError(t, err, name)
+
+		_, err = store.Save("laptop-1", ".jpg", *bytes.NewBufferString("image 2"))
+		require.NoError(t, err, name)
+
+		_, err = store.Save("laptop-1", ".jpg", *bytes.NewBufferString("image 3"))
+		require.ErrorIs(t, err, service.ErrTooManyImages, name)
+
+		_, err = store.Save("laptop-2", ".jpg", *bytes.NewBufferString("image 3"))
+		require.NoError(t, err, name)
+
+		require.NoError(t, store.Delete(id1), name)
+		_, err = store.Save("laptop-1", ".jpg", *bytes.NewBufferString("image 3"))
+		require.NoError(t, err, name)
+	}
+}
@@ -0,0 +1,177 @@
+package service
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	pb "pcbook/generateProto"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const minRSAKeyBits = 2048
+
+// JWTKey is a key used to sign or verify tokens. Asymmetric keys are identified by the
+// kid header of the tokens they sign, which is the RFC 7638 thumbprint of the public key.
+type JWTKey struct {
+	ID        string
+	Method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+// NewHMACKey returns a symmetric HS256 key. Tokens signed with it have no kid header.
+func NewHMACKey(secretKey string) *JWTKey {
+	return &JWTKey{
+		Method:    jwt.SigningMethodHS256,
+		signKey:   []byte(secretKey),
+		verifyKey: []byte(secretKey),
+	}
+}
+
+// NewRSAKey returns an RS256 key. If the private key is nil, the key can only verify tokens.
+func NewRSAKey(privateKey *rsa.PrivateKey, publicKey *rsa.PublicKey) (*JWTKey, error) {
+	if privateKey != nil {
+		publicKey = &privateKey.PublicKey
+	}
+	if publicKey.N.BitLen() < minRSAKeyBits {
+		return nil, fmt.Errorf("rsa key must have at least %d bits", minRSAKeyBits)
+	}
+
+	key := &JWTKey{
+		Method:    jwt.SigningMethodRS256,
+		verifyKey: publicKey,
+	}
+	if privateKey != nil {
+		key.signKey = privateKey
+	}
+	return key.withThumbprint()
+}
+
+// NewEdDSAKey returns an Ed25519 key. If the private key is nil, the key can only verify tokens.
+func NewEdDSAKey(privateKey ed25519.PrivateKey, publicKey ed25519.PublicKey) (*JWTKey, error) {
+	if privateKey != nil {
+		publicKey = privateKey.Public().(ed25519.PublicKey)
+	}
+
+	key := &JWTKey{
+		Method:    SigningMethodEdDSA,
+		verifyKey: publicKey,
+	}
+	if privateKey != nil {
+		key.signKey = privateKey
+	}
+	return key.withThumbprint()
+}
+
+// LoadJWTKey reads an RSA or Ed25519 key from a PEM file.
+// A private key can sign and verify tokens, a public key can only verify them.
+func LoadJWTKey(filename string) (*JWTKey, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read key file: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", filename)
+	}
+
+	var parsed interface{}
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		parsed, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type %s in %s", block.Type, filename)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse key in %s: %w", filename, err)
+	}
+
+	switch key := parsed.(type) {
+	case *rsa.PrivateKey:
+		return NewRSAKey(key, nil)
+	case *rsa.PublicKey:
+		return NewRSAKey(nil, key)
+	case ed25519.PrivateKey:
+		return NewEdDSAKey(key, nil)
+	case ed25519.PublicKey:
+		return NewEdDSAKey(nil, key)
+	default:
+		return nil, fmt.Errorf("unsupported key type %T in %s", parsed, filename)
+	}
+}
+
+// CanSign reports whether the key holds private key material.
+func (key *JWTKey) CanSign() bool {
+	return key.signKey != nil
+}
+
+// JWK returns the public part of the key as a JSON web key, or nil for a symmetric key.
+func (key *JWTKey) JWK() *pb.JSONWebKey {
+	var jwk *pb.JSONWebKey
+	switch verifyKey := key.verifyKey.(type) {
+	case *rsa.PublicKey:
+		jwk = &pb.JSONWebKey{
+			Kty: "RSA",
+			N:   base64.RawURLEncoding.EncodeToString(verifyKey.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(verifyKey.E)).Bytes()),
+		}
+	case ed25519.PublicKey:
+		jwk = &pb.JSONWebKey{
+			Kty: "OKP",
+			Crv: "Ed25519",
+			X:   base64.RawURLEncoding.EncodeToString(verifyKey),
+		}
+	default:
+		return nil
+	}
+
+	jwk.Kid = key.ID
+	jwk.Alg = key.Method.Alg()
+	jwk.Use = "sig"
+	return jwk
+}
+
+func (key *JWTKey) withThumbprint() (*JWTKey, error) {
+	jwk := key.JWK()
+
+	// the thumbprint hashes the required members only, in lexicographic order
+	var members interface{}
+	switch jwk.GetKty() {
+	case "RSA":
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{jwk.GetE(), jwk.GetKty(), jwk.GetN()}
+	case "OKP":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{jwk.GetCrv(), jwk.GetKty(), jwk.GetX()}
+	}
+
+	data, err := json.Marshal(members)
+	if err != nil {
+		return nil, fmt.Errorf("cannot compute key thumbprint: %w", err)
+	}
+
+	sum := sha256.Sum256(data)
+	key.ID = base64.RawURLEncoding.EncodeToString(sum[:])
+	return key, nil
+}
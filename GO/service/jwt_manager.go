@@ -2,50 +2,119 @@ package service
 
 import (
 	"fmt"
+	pb "pcbook/generateProto"
+	"sort"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
+	"github.com/google/uuid"
 )
 
 type JWTManager struct {
-	secretKey     string
-	tokenDuration time.Duration
+	signingKey       *JWTKey
+	verificationKeys map[string]*JWTKey
+	tokenDuration    time.Duration
+	revocations      *RevocationList
 }
 
 type UserClaims struct {
 	jwt.StandardClaims
-	UserName string `json:"user_name"`
-	Role     string `json:"role"`
+	TenantID string   `json:"tenant_id,omitempty"`
+	UserName string   `json:"user_name"`
+	Role     string   `json:"role"`
+	Scopes   []string `json:"scopes"`
 }
 
+// HasScope reports whether the claims grant the scope.
+func (claims *UserClaims) HasScope(scope string) bool {
+	for _, granted := range claims.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// NewJWTManager returns a manager that signs and verifies HS256 tokens with a shared secret.
 func NewJWTManager(secretKey string, tokenDuration time.Duration) *JWTManager {
+	key := NewHMACKey(secretKey)
 	return &JWTManager{
-		secretKey:     secretKey,
-		tokenDuration: tokenDuration,
+		signingKey:       key,
+		verificationKeys: map[string]*JWTKey{key.ID: key},
+		tokenDuration:    tokenDuration,
+		revocations:      NewRevocationList(),
 	}
 }
 
-func (manager *JWTManager) GenerateToken(userName string, role string) (string, error) {
-	claims := UserClaims{
-		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: time.Now().Add(manager.tokenDuration).Unix(),
-		},
-		UserName: userName,
-		Role:     role,
+// NewJWTManagerWithKeys returns a manager that signs tokens with the signing key, and accepts
+// tokens signed by it or by any of the verification keys, e.g. keys being rotated out.
+func NewJWTManagerWithKeys(
+	signingKey *JWTKey,
+	tokenDuration time.Duration,
+	verificationKeys ...*JWTKey,
+) (*JWTManager, error) {
+	if !signingKey.CanSign() {
+		return nil, fmt.Errorf("signing key %s has no private key", signingKey.ID)
+	}
+
+	manager := &JWTManager{
+		signingKey:       signingKey,
+		verificationKeys: map[string]*JWTKey{signingKey.ID: signingKey},
+		tokenDuration:    tokenDuration,
+		revocations:      NewRevocationList(),
+	}
+	for _, key := range verificationKeys {
+		if manager.verificationKeys[key.ID] != nil {
+			return nil, fmt.Errorf("duplicate verification key %s", key.ID)
+		}
+		manager.verificationKeys[key.ID] = key
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(manager.secretKey))
+	return manager, nil
+}
+
+// GenerateToken signs an access token for the identity in the claims.
+// The id, issue and expiry times of the token are set by the manager.
+func (manager *JWTManager) GenerateToken(identity UserClaims) (string, error) {
+	token, _, err := manager.generateToken(identity)
+	return token, err
+}
+
+// generateToken also returns the claims of the new token, so that its jti can be revoked later.
+func (manager *JWTManager) generateToken(identity UserClaims) (string, *UserClaims, error) {
+	now := time.Now()
+	claims := &identity
+	claims.StandardClaims = jwt.StandardClaims{
+		Id:        uuid.New().String(),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(manager.tokenDuration).Unix(),
+	}
+
+	token := jwt.NewWithClaims(manager.signingKey.Method, claims)
+	if len(manager.signingKey.ID) > 0 {
+		token.Header["kid"] = manager.signingKey.ID
+	}
+	signed, err := token.SignedString(manager.signingKey.signKey)
+	if err != nil {
+		return "", nil, err
+	}
+	return signed, claims, nil
 }
 
 func (manager *JWTManager) VerifyToken(accessToken string) (*UserClaims, error) {
 	token, err := jwt.ParseWithClaims(accessToken, &UserClaims{}, func(token *jwt.Token) (interface{}, error) {
-		_, ok := token.Method.(*jwt.SigningMethodHMAC)
-		if !ok {
+		keyID, _ := token.Header["kid"].(string)
+		key := manager.verificationKeys[keyID]
+		if key == nil {
+			return nil, fmt.Errorf("unknown signing key: %s", keyID)
+		}
+
+		// the algorithm is bound to the key, so a token can't pick a weaker one
+		if token.Method.Alg() != key.Method.Alg() {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
 
-		return []byte(manager.secretKey), nil
+		return key.verifyKey, nil
 	})
 	if err != nil {
 		return nil, err
@@ -56,5 +125,33 @@ func (manager *JWTManager) VerifyToken(accessToken string) (*UserClaims, error)
 		return nil, fmt.Errorf("cannot convert claims to UserClaims")
 	}
 
+	if len(claims.Id) == 0 {
+		return nil, fmt.Errorf("token has no jti claim")
+	}
+	if manager.revocations.IsRevoked(claims.Id) {
+		return nil, fmt.Errorf("token %s has been revoked", claims.Id)
+	}
+
 	return claims, nil
 }
+
+// PublicKeys returns the public keys that verify tokens, as a JSON web key set.
+func (manager *JWTManager) PublicKeys() []*pb.JSONWebKey {
+	keys := make([]*pb.JSONWebKey, 0, len(manager.verificationKeys))
+	for _, key := range manager.verificationKeys {
+		jwk := key.JWK()
+		if jwk != nil {
+			keys = append(keys, jwk)
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].GetKid() < keys[j].GetKid()
+	})
+	return keys
+}
+
+// RevokeToken rejects the access token with the given jti until it expires.
+func (manager *JWTManager) RevokeToken(tokenID string, expiresAt time.Time) {
+	manager.revocations.Revoke(tokenID, expiresAt)
+}
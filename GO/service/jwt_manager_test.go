@@ -0,0 +1,158 @@
+package service_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"pcbook/service"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJWTManagerAsymmetricKeys(t *testing.T) {
+	t.Parallel()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	for _, privateKey := range []interface{}{rsaKey, edKey} {
+		key, err := service.LoadJWTKey(writeTestPEM(t, "PRIVATE KEY", privateKey))
+		require.NoError(t, err)
+		require.True(t, key.CanSign())
+
+		manager, err := service.NewJWTManagerWithKeys(key, time.Minute)
+		require.NoError(t, err)
+
+		token, err := manager.GenerateToken(service.UserClaims{UserName: "alice", Role: service.UserRole})
+		require.NoError(t, err)
+
+		claims, err := manager.VerifyToken(token)
+		require.NoError(t, err)
+		require.Equal(t, "alice", claims.UserName)
+
+		// a service holding only the public key can verify but not mint tokens
+		publicKeyFile := writeTestPEM(t, "PUBLIC KEY", publicKeyOf(privateKey))
+		publicKey, err := service.LoadJWTKey(publicKeyFile)
+		require.NoError(t, err)
+		require.False(t, publicKey.CanSign())
+		require.Equal(t, key.ID, publicKey.ID)
+
+		_, err = service.NewJWTManagerWithKeys(publicKey, time.Minute)
+		require.Error(t, err)
+
+		jwks := manager.PublicKeys()
+		require.Len(t, jwks, 1)
+		require.Equal(t, key.ID, jwks[0].GetKid())
+		require.Equal(t, key.Method.Alg(), jwks[0].GetAlg())
+	}
+}
+
+func TestJWTManagerKeyRotation(t *testing.T) {
+	t.Parallel()
+
+	oldKey := newTestEdDSAKey(t)
+	newKey := newTestEdDSAKey(t)
+
+	oldManager, err := service.NewJWTManagerWithKeys(oldKey, time.Minute)
+	require.NoError(t, err)
+	oldToken, err := oldManager.GenerateToken(service.UserClaims{UserName: "alice", Role: service.UserRole})
+	require.NoError(t, err)
+
+	_, err = service.NewJWTManagerWithKeys(newKey, time.Minute, newKey)
+	require.Error(t, err, "duplicate key ids must be rejected")
+
+	manager, err := service.NewJWTManagerWithKeys(newKey, time.Minute, oldKey)
+	require.NoError(t, err)
+
+	_, err = manager.VerifyToken(oldToken)
+	require.NoError(t, err)
+
+	newToken, err := manager.GenerateToken(service.UserClaims{UserName: "alice", Role: service.UserRole})
+	require.NoError(t, err)
+	_, err = oldManager.VerifyToken(newToken)
+	require.Error(t, err)
+
+	jwks := manager.PublicKeys()
+	require.Len(t, jwks, 2)
+
+	// once the old key is retired, its tokens are rejected
+	rotated, err := service.NewJWTManagerWithKeys(newKey, time.Minute)
+	require.NoError(t, err)
+	_, err = rotated.VerifyToken(oldToken)
+	require.Error(t, err)
+}
+
+func TestJWTManagerRejectsAlgorithmConfusion(t *testing.T) {
+	t.Parallel()
+
+	key := newTestEdDSAKey(t)
+	manager, err := service.NewJWTManagerWithKeys(key, time.Minute)
+	require.NoError(t, err)
+
+	// an HS256 token that names the Ed25519 key, signed with its public key as the secret
+	claims := &service.UserClaims{
+		StandardClaims: jwt.StandardClaims{
+			Id:        "forged",
+			ExpiresAt: time.Now().Add(time.Minute).Unix(),
+		},
+		UserName: "mallory",
+		Role:     service.AdminRole,
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = key.ID
+	forged, err := token.SignedString([]byte(key.JWK().GetX()))
+	require.NoError(t, err)
+
+	_, err = manager.VerifyToken(forged)
+	require.Error(t, err)
+
+	// tokens signed with the shared secret have no kid, so they're rejected too
+	hmacToken, err := service.NewJWTManager(testSecretKey, time.Minute).GenerateToken(service.UserClaims{UserName: "mallory", Role: service.AdminRole})
+	require.NoError(t, err)
+	_, err = manager.VerifyToken(hmacToken)
+	require.Error(t, err)
+}
+
+func newTestEdDSAKey(t *testing.T) *service.JWTKey {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	key, err := service.NewEdDSAKey(privateKey, nil)
+	require.NoError(t, err)
+	return key
+}
+
+func publicKeyOf(privateKey interface{}) interface{} {
+	switch key := privateKey.(type) {
+	case *rsa.PrivateKey:
+		return &key.PublicKey
+	case ed25519.PrivateKey:
+		return key.Public()
+	}
+	return nil
+}
+
+func writeTestPEM(t *testing.T, blockType string, key interface{}) string {
+	var data []byte
+	var err error
+	if blockType == "PRIVATE KEY" {
+		data, err = x509.MarshalPKCS8PrivateKey(key)
+	} else {
+		data, err = x509.MarshalPKIXPublicKey(key)
+	}
+	require.NoError(t, err)
+
+	filename := filepath.Join(t.TempDir(), "key.pem")
+	err = os.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: data}), 0600)
+	require.NoError(t, err)
+	return filename
+}
@@ -1,25 +1,36 @@
 package service_test
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"math"
 	"net"
+	"os"
+	"path/filepath"
+	"pcbook/client"
 	"pcbook/sample"
 	"pcbook/serializer"
 	"pcbook/service"
 	"testing"
+	"time"
 
 	pb "pcbook/generateProto"
 
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 func TestLaptopClientCreateLaptop(t *testing.T) {
 	t.Parallel()
 
 	laptopStore := service.NewInMemoryLaptopStore()
-	serverAddress := startTestLaptopServer(t, laptopStore, nil, nil)
+	serverAddress := startTestServer(t, withLaptopStore(laptopStore))
 	laptopClient := newTestLaptopClient(t, serverAddress)
 
 	laptop := sample.NewLaptop()
@@ -28,7 +39,7 @@ func TestLaptopClientCreateLaptop(t *testing.T) {
 	req := &pb.CreateLaptopRequest{
 		Laptop: laptop,
 	}
-	res, err := laptopClient.CreateLaptop(context.Background(), req)
+	res, err := laptopClient.CreateLaptop(contextWithTestUser(t, "admin", "admin"), req)
 
 	require.NoError(t, err)
 	require.NotNil(t, res.Id)
@@ -88,7 +99,7 @@ func TestLaptopClientSearchLaptop(t *testing.T) {
 		require.NoError(t, err)
 	}
 
-	serverAddress := startTestLaptopServer(t, laptopStore, nil, nil)
+	serverAddress := startTestServer(t, withLaptopStore(laptopStore))
 	laptopClient := newTestLaptopClient(t, serverAddress)
 
 	req := &pb.SearchLaptopRequest{
@@ -119,61 +130,722 @@ func TestClientRateLaptop(t *testing.T) {
 	err := laptopStore.Save(laptop)
 	require.NoError(t, err)
 
-	serverAddress := startTestLaptopServer(t, laptopStore, nil, ratingStore)
+	serverAddress := startTestServer(t, withLaptopStore(laptopStore), withRatingStore(ratingStore))
 	laptopClient := newTestLaptopClient(t, serverAddress)
 
-	stream, err := laptopClient.RateLaptop(context.Background())
-	require.NoError(t, err)
-
 	scores := []float64{8, 7.5, 10}
 	avarage := []float64{8, 7.75, 8.5}
 	n := len(scores)
 
 	for i := 0; i < n; i++ {
+		ctx := contextWithTestUser(t, fmt.Sprintf("user%d", i), "user")
+		stream, err := laptopClient.RateLaptop(ctx)
+		require.NoError(t, err)
+
 		req := &pb.RateLaptopRequest{
 			LaptopId: laptop.Id,
 			Score:    scores[i],
 		}
-		err := stream.Send(req)
+		err = stream.Send(req)
+		require.NoError(t, err)
+
+		err = stream.CloseSend()
+		require.NoError(t, err)
+
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, laptop.Id, res.LaptopId)
+		require.True(t, res.Ok)
+		require.Equal(t, uint32(i+1), res.RatedCount)
+		require.Equal(t, avarage[i], res.AverageCore)
+
+		_, err = stream.Recv()
+		require.Equal(t, io.EOF, err)
+	}
+}
+
+func TestClientRateLaptopOneVotePerUser(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	ratingStore := service.NewInMemoryRatingStore()
+
+	laptop := sample.NewLaptop()
+	err := laptopStore.Save(laptop)
+	require.NoError(t, err)
+
+	serverAddress := startTestServer(t, withLaptopStore(laptopStore), withRatingStore(ratingStore))
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	_, err = laptopClient.GetMyRatings(context.Background(), &pb.GetMyRatingsRequest{})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	ctx1 := contextWithTestUser(t, "user1", "user")
+	ctx2 := contextWithTestUser(t, "user2", "user")
+
+	stream, err := laptopClient.RateLaptop(ctx1)
+	require.NoError(t, err)
+
+	scores := []float64{8, 6, 9}
+	for _, score := range scores {
+		err = stream.Send(&pb.RateLaptopRequest{LaptopId: laptop.Id, Score: score})
+		require.NoError(t, err)
+
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, uint32(1), res.RatedCount)
+		require.Equal(t, score, res.AverageCore)
+	}
+	require.NoError(t, stream.CloseSend())
+
+	stream, err = laptopClient.RateLaptop(ctx2)
+	require.NoError(t, err)
+	err = stream.Send(&pb.RateLaptopRequest{LaptopId: laptop.Id, Score: 5})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), res.RatedCount)
+	require.Equal(t, 7.0, res.AverageCore)
+	require.NoError(t, stream.CloseSend())
+
+	myRatings, err := laptopClient.GetMyRatings(ctx1, &pb.GetMyRatingsRequest{})
+	require.NoError(t, err)
+	require.Len(t, myRatings.GetRatings(), 1)
+	require.Equal(t, laptop.Id, myRatings.GetRatings()[0].GetLaptopId())
+	require.Equal(t, 9.0, myRatings.GetRatings()[0].GetScore())
+
+	retracted, err := laptopClient.RetractRating(ctx1, &pb.RetractRatingRequest{LaptopId: laptop.Id})
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), retracted.RatedCount)
+	require.Equal(t, 5.0, retracted.AverageCore)
+
+	_, err = laptopClient.RetractRating(ctx1, &pb.RetractRatingRequest{LaptopId: laptop.Id})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	myRatings, err = laptopClient.GetMyRatings(ctx1, &pb.GetMyRatingsRequest{})
+	require.NoError(t, err)
+	require.Empty(t, myRatings.GetRatings())
+}
+
+func TestClientRateLaptopInvalidEntries(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	ratingStore := service.NewInMemoryRatingStore()
+
+	laptop := sample.NewLaptop()
+	err := laptopStore.Save(laptop)
+	require.NoError(t, err)
+
+	serverAddress := startTestServer(t, withLaptopStore(laptopStore), withRatingStore(ratingStore))
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	stream, err := laptopClient.RateLaptop(contextWithTestUser(t, "user1", "user"))
+	require.NoError(t, err)
+
+	requests := []struct {
+		laptopID string
+		score    float64
+		code     codes.Code
+	}{
+		{laptopID: laptop.Id, score: 7, code: codes.OK},
+		{laptopID: laptop.Id, score: math.NaN(), code: codes.InvalidArgument},
+		{laptopID: laptop.Id, score: -1, code: codes.InvalidArgument},
+		{laptopID: laptop.Id, score: 1e9, code: codes.InvalidArgument},
+		{laptopID: sample.RandomID(), score: 5, code: codes.NotFound},
+		{laptopID: laptop.Id, score: 10, code: codes.OK},
+	}
+
+	for _, req := range requests {
+		err := stream.Send(&pb.RateLaptopRequest{LaptopId: req.laptopID, Score: req.score})
+		require.NoError(t, err)
+	}
+	require.NoError(t, stream.CloseSend())
+
+	for _, req := range requests {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, req.laptopID, res.GetLaptopId())
+		require.Equal(t, req.code == codes.OK, res.GetOk())
+		require.Equal(t, req.code, codes.Code(res.GetErrorCode()))
+		if req.code != codes.OK {
+			require.NotEmpty(t, res.GetErrorMessage())
+		}
+	}
+
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+
+	scores, err := laptopScores(ratingStore, laptop.Id)
+	require.NoError(t, err)
+	require.Equal(t, []float64{10}, scores)
+}
+
+func TestClientTopRatedLaptops(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	ratingStore := service.NewInMemoryRatingStore()
+
+	oneVote := sample.NewLaptop()
+	manyVotes := sample.NewLaptop()
+	unrated := sample.NewLaptop()
+	// unrated laptops all have the prior as average, they are ranked by ID
+	unrated.Id = "ffffffff-0000-0000-0000-000000000002"
+	otherUnrated := sample.NewLaptop()
+	otherUnrated.Id = "ffffffff-0000-0000-0000-000000000001"
+	// rated at the prior mean, it ties with the unrated laptops but has more ratings
+	atPrior := sample.NewLaptop()
+	atPrior.Id = "ffffffff-0000-0000-0000-000000000003"
+	for _, laptop := range []*pb.Laptop{oneVote, manyVotes, unrated, otherUnrated, atPrior} {
+		err := laptopStore.Save(laptop)
 		require.NoError(t, err)
 	}
 
-	err = stream.CloseSend()
+	_, err := ratingStore.Add(oneVote.Id, "user", 10)
+	require.NoError(t, err)
+	for i := 0; i < 50; i++ {
+		_, err := ratingStore.Add(manyVotes.Id, fmt.Sprintf("user%d", i), 9.4)
+		require.NoError(t, err)
+	}
+	for _, userName := range []string{"user1", "user2"} {
+		_, err := ratingStore.Add(atPrior.Id, userName, service.DefaultRatingPrior.Mean)
+		require.NoError(t, err)
+	}
+
+	serverAddress := startTestServer(t, withLaptopStore(laptopStore), withRatingStore(ratingStore))
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	summary, err := laptopClient.GetRatingSummary(context.Background(), &pb.GetRatingSummaryRequest{LaptopId: oneVote.Id})
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), summary.GetSummary().GetRatedCount())
+	require.Equal(t, 10.0, summary.GetSummary().GetAverageScore())
+	require.Less(t, summary.GetSummary().GetBayesianAverage(), 10.0)
+
+	_, err = laptopClient.GetRatingSummary(context.Background(), &pb.GetRatingSummaryRequest{LaptopId: sample.RandomID()})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	stream, err := laptopClient.TopRatedLaptops(context.Background(), &pb.TopRatedLaptopsRequest{})
 	require.NoError(t, err)
 
-	for resCount := 0; ; resCount++ {
+	ranked := []string{}
+	for {
 		res, err := stream.Recv()
 		if err == io.EOF {
-			require.Equal(t, n, resCount)
-			return
+			break
 		}
 		require.NoError(t, err)
-		require.Equal(t, laptop.Id, res.LaptopId)
-		require.Equal(t, uint32(resCount+1), res.RatedCount)
-		require.Equal(t, avarage[resCount], res.AverageCore)
+		ranked = append(ranked, res.GetLaptop().GetId())
 	}
+	require.Equal(t, []string{manyVotes.Id, oneVote.Id, atPrior.Id, otherUnrated.Id, unrated.Id}, ranked)
 
+	stream, err = laptopClient.TopRatedLaptops(context.Background(), &pb.TopRatedLaptopsRequest{Limit: 1})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, manyVotes.Id, res.GetLaptop().GetId())
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
 }
 
-func startTestLaptopServer(
-	t *testing.T,
-	laptopStore service.LaptopStore,
-	imageStore service.ImageStore, ratingStore service.RatingStore) string {
+func TestClientUploadImageChecksum(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	imageStore := service.NewContentAddressedImageStore(t.TempDir(), 0)
 
-	laptopServer := service.NewLaptopServer(laptopStore, imageStore, ratingStore)
+	laptop := sample.NewLaptop()
+	err := laptopStore.Save(laptop)
+	require.NoError(t, err)
 
-	grpcServer := grpc.NewServer()
+	serverAddress := startTestServer(t, withLaptopStore(laptopStore), withImageStore(imageStore))
+	laptopClient := newTestLaptopClient(t, serverAddress)
 
-	pb.RegisterLaptopServiceServer(grpcServer, laptopServer)
+	data := []byte("image data")
 
-	listener, err := net.Listen("tcp", ":0")
+	testCases := []struct {
+		name     string
+		checksum string
+		code     codes.Code
+	}{
+		{name: "no_checksum", checksum: "", code: codes.OK},
+		{name: "valid_checksum", checksum: service.Checksum(data), code: codes.OK},
+		{name: "invalid_checksum", checksum: service.Checksum([]byte("other data")), code: codes.InvalidArgument},
+	}
+
+	for _, tc := range testCases {
+		stream, err := laptopClient.UploadImage(contextWithTestUser(t, "admin", "admin"))
+		require.NoError(t, err)
+
+		err = stream.Send(&pb.UploadImageRequest{
+			Data: &pb.UploadImageRequest_ImageInfo{
+				ImageInfo: &pb.ImageInfo{
+					LaptopId:  laptop.Id,
+					ImageType: ".jpg",
+					Checksum:  tc.checksum,
+				},
+			},
+		})
+		require.NoError(t, err)
+
+		err = stream.Send(&pb.UploadImageRequest{
+			Data: &pb.UploadImageRequest_ChunkData{ChunkData: data},
+		})
+		require.NoError(t, err)
+
+		res, err := stream.CloseAndRecv()
+		require.Equal(t, tc.code, status.Code(err), tc.name)
+		if tc.code == codes.OK {
+			require.Equal(t, uint32(len(data)), res.GetSize())
+		}
+	}
+}
+
+func TestClientPrimaryImage(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	imageStore := service.NewContentAddressedImageStore(t.TempDir(), 0)
+
+	laptop := sample.NewLaptop()
+	err := laptopStore.Save(laptop)
+	require.NoError(t, err)
+
+	serverAddress := startTestServer(t, withLaptopStore(laptopStore), withImageStore(imageStore))
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	imageID1 := uploadTestImage(t, laptopClient, laptop.Id, []byte("image 1"))
+	imageID2 := uploadTestImage(t, laptopClient, laptop.Id, []byte("image 2"))
+
+	found, err := laptopStore.Find(laptop.Id)
+	require.NoError(t, err)
+	require.Equal(t, imageID1, found.PrimaryImageId)
+
+	_, err = laptopClient.SetPrimaryImage(contextWithTestUser(t, "admin", "admin"), &pb.SetPrimaryImageRequest{
+		LaptopId: laptop.Id,
+		ImageId:  imageID2,
+	})
+	require.NoError(t, err)
+
+	stream, err := laptopClient.SearchLaptop(context.Background(), &pb.SearchLaptopRequest{
+		Filter: &pb.Filter{MaxPriceUsd: laptop.PriceUsd},
+	})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, imageID2, res.GetLaptop().GetPrimaryImageId())
+
+	_, err = laptopClient.SetPrimaryImage(contextWithTestUser(t, "admin", "admin"), &pb.SetPrimaryImageRequest{
+		LaptopId: laptop.Id,
+		ImageId:  "unknown",
+	})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = laptopClient.DeleteImage(contextWithTestUser(t, "admin", "admin"), &pb.DeleteImageRequest{
+		LaptopId: laptop.Id,
+		ImageId:  imageID2,
+	})
+	require.NoError(t, err)
+
+	found, err = laptopStore.Find(laptop.Id)
+	require.NoError(t, err)
+	require.Empty(t, found.PrimaryImageId)
+
+	_, err = laptopClient.DeleteImage(contextWithTestUser(t, "admin", "admin"), &pb.DeleteImageRequest{
+		LaptopId: laptop.Id,
+		ImageId:  imageID2,
+	})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestClientLaptopOwnership(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	imageStore := service.NewContentAddressedImageStore(t.TempDir(), 0)
+	serverAddress := startTestServer(t, withLaptopStore(laptopStore), withImageStore(imageStore))
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	vendor1 := contextWithTestUser(t, "vendor1", service.VendorRole)
+	vendor2 := contextWithTestUser(t, "vendor2", service.VendorRole)
+	admin := contextWithTestUser(t, "admin", service.AdminRole)
+
+	// the owner in the request is ignored
+	laptop := sample.NewLaptop()
+	laptop.Owner = "vendor2"
+	_, err := laptopClient.CreateLaptop(vendor1, &pb.CreateLaptopRequest{Laptop: laptop})
+	require.NoError(t, err)
+
+	_, err = laptopClient.CreateLaptop(vendor2, &pb.CreateLaptopRequest{Laptop: sample.NewLaptop()})
+	require.NoError(t, err)
+
+	found, err := laptopStore.Find(laptop.Id)
+	require.NoError(t, err)
+	require.Equal(t, "vendor1", found.GetOwner())
+
+	imageID, err := uploadTestImageAs(vendor1, laptopClient, laptop.Id, []byte("vendor1 image"))
+	require.NoError(t, err)
+
+	_, err = uploadTestImageAs(vendor2, laptopClient, laptop.Id, []byte("vendor2 image"))
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = laptopClient.SetPrimaryImage(vendor2, &pb.SetPrimaryImageRequest{LaptopId: laptop.Id, ImageId: imageID})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = laptopClient.DeleteImage(vendor2, &pb.DeleteImageRequest{LaptopId: laptop.Id, ImageId: imageID})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// admins manage every laptop
+	_, err = uploadTestImageAs(admin, laptopClient, laptop.Id, []byte("admin image"))
+	require.NoError(t, err)
+
+	_, err = laptopClient.DeleteImage(vendor1, &pb.DeleteImageRequest{LaptopId: laptop.Id, ImageId: imageID})
+	require.NoError(t, err)
+
+	stream, err := laptopClient.SearchLaptop(vendor1, &pb.SearchLaptopRequest{
+		Filter: &pb.Filter{Owner: "vendor1"},
+	})
+	require.NoError(t, err)
+
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, laptop.Id, res.GetLaptop().GetId())
+
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+}
+
+func TestLaptopClientSDK(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	imageStore := service.NewContentAddressedImageStore(t.TempDir(), 0)
+	ratingStore := service.NewInMemoryRatingStore()
+	serverAddress := startTestServer(t, withLaptopStore(laptopStore), withImageStore(imageStore), withRatingStore(ratingStore))
+
+	conn, err := grpc.Dial(serverAddress, grpc.WithInsecure())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	laptopClient := client.NewLaptopClient(conn, client.WithUploadChunkSize(4))
+	admin := contextWithTestUser(t, "admin", "admin")
+	anyLaptop := &pb.Filter{MaxPriceUsd: math.MaxFloat64}
+
+	laptops := []*pb.Laptop{sample.NewLaptop(), sample.NewLaptop(), sample.NewLaptop()}
+	for _, laptop := range laptops {
+		id, err := laptopClient.CreateLaptop(admin, laptop)
+		require.NoError(t, err)
+		require.Equal(t, laptop.Id, id)
+	}
+
+	// the errors of the server keep their status
+	_, err = laptopClient.CreateLaptop(admin, laptops[0])
+	require.Equal(t, codes.AlreadyExists, status.Code(err))
+	var rpcErr *client.RPCError
+	require.ErrorAs(t, err, &rpcErr)
+	require.Equal(t, "CreateLaptop", rpcErr.Method)
+
+	_, err = laptopClient.CreateLaptop(context.Background(), sample.NewLaptop())
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	it, err := laptopClient.SearchLaptop(context.Background(), anyLaptop)
+	require.NoError(t, err)
+	found, err := it.All()
+	require.NoError(t, err)
+	require.Len(t, found, 3)
+
+	// closing the iterator early ends the stream
+	it, err = laptopClient.SearchLaptop(context.Background(), anyLaptop)
+	require.NoError(t, err)
+	require.True(t, it.Next())
+	it.Close()
+	require.False(t, it.Next())
+	require.NoError(t, it.Err())
+
+	imagePath := filepath.Join(t.TempDir(), "laptop.jpg")
+	require.NoError(t, os.WriteFile(imagePath, []byte("image data"), 0644))
+	image, err := laptopClient.UploadImage(admin, laptops[0].Id, imagePath)
+	require.NoError(t, err)
+	require.Equal(t, uint32(10), image.GetSize())
+	require.NoError(t, laptopClient.SetPrimaryImage(admin, laptops[0].Id, image.GetId()))
+
+	_, err = laptopClient.UploadImage(admin, laptops[0].Id, filepath.Join(t.TempDir(), "missing.jpg"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+	require.False(t, errors.As(err, &rpcErr))
+
+	user := contextWithTestUser(t, "user1", "user")
+	ratings, err := laptopClient.RateLaptop(user, []string{laptops[0].Id, sample.RandomID(), laptops[1].Id}, []float64{8, 5, 6})
+	require.NoError(t, err)
+	require.Len(t, ratings, 3)
+	require.NoError(t, ratings[0].Err)
+	require.Equal(t, uint32(1), ratings[0].RatedCount)
+	require.Equal(t, codes.NotFound, status.Code(ratings[1].Err))
+	require.Equal(t, 6.0, ratings[2].AverageScore)
+
+	_, err = laptopClient.RateLaptop(user, []string{laptops[0].Id}, nil)
+	require.Error(t, err)
+
+	myRatings, err := laptopClient.GetMyRatings(user)
+	require.NoError(t, err)
+	require.Len(t, myRatings, 2)
+
+	top, err := laptopClient.TopRatedLaptops(context.Background(), anyLaptop, 1)
+	require.NoError(t, err)
+	topRated, err := top.All()
+	require.NoError(t, err)
+	require.Len(t, topRated, 1)
+	require.Equal(t, laptops[0].Id, topRated[0].Laptop.GetId())
+	require.Equal(t, uint32(1), topRated[0].Summary.GetRatedCount())
+
+	rating, err := laptopClient.RetractRating(user, laptops[0].Id)
+	require.NoError(t, err)
+	require.Zero(t, rating.RatedCount)
+
+	summary, err := laptopClient.GetRatingSummary(context.Background(), laptops[1].Id)
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), summary.GetRatedCount())
+}
+
+func TestClientGetDeleteLaptopAndDownloadImage(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	imageStore := service.NewContentAddressedImageStore(t.TempDir(), 0)
+	ratingStore := service.NewInMemoryRatingStore()
+	serverAddress := startTestServer(t, withLaptopStore(laptopStore), withImageStore(imageStore), withRatingStore(ratingStore))
+
+	conn, err := grpc.Dial(serverAddress, grpc.WithInsecure())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	laptopClient := client.NewLaptopClient(conn)
+	vendor1 := contextWithTestUser(t, "vendor1", "vendor")
+	vendor2 := contextWithTestUser(t, "vendor2", "vendor")
+
+	laptop := sample.NewLaptop()
+	_, err = laptopClient.CreateLaptop(vendor1, laptop)
+	require.NoError(t, err)
+
+	found, err := laptopClient.GetLaptop(context.Background(), laptop.Id)
+	require.NoError(t, err)
+	require.Equal(t, "vendor1", found.GetOwner())
+	_, err = laptopClient.GetLaptop(context.Background(), sample.RandomID())
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// the image is larger than a download chunk
+	data := make([]byte, 100<<10)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	imagePath := filepath.Join(t.TempDir(), "laptop.png")
+	require.NoError(t, os.WriteFile(imagePath, data, 0644))
+	image, err := laptopClient.UploadImage(vendor1, laptop.Id, imagePath)
+	require.NoError(t, err)
 
-	require.NoError(t, err, "cannot start test laptop server")
+	downloaded := &bytes.Buffer{}
+	info, err := laptopClient.DownloadImage(context.Background(), laptop.Id, image.GetId(), downloaded)
+	require.NoError(t, err)
+	require.Equal(t, ".png", info.GetImageType())
+	require.Equal(t, service.Checksum(data), info.GetChecksum())
+	require.Equal(t, data, downloaded.Bytes())
+
+	_, err = laptopClient.DownloadImage(context.Background(), sample.RandomID(), image.GetId(), io.Discard)
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// only the owner, or an admin, deletes a laptop
+	err = laptopClient.DeleteLaptop(vendor2, laptop.Id)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	err = laptopClient.DeleteLaptop(context.Background(), laptop.Id)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	_, err = ratingStore.Add(laptop.Id, "alice", 8)
+	require.NoError(t, err)
+	require.NoError(t, laptopClient.DeleteLaptop(vendor1, laptop.Id))
+	_, err = laptopClient.GetLaptop(context.Background(), laptop.Id)
+	require.Equal(t, codes.NotFound, status.Code(err))
+	err = laptopClient.DeleteLaptop(contextWithTestUser(t, "admin", "admin"), laptop.Id)
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// a laptop created again with the same ID starts without images or ratings
+	require.Zero(t, imageStore.RefCount(service.Checksum(data)))
+	_, err = laptopClient.CreateLaptop(vendor1, laptop)
+	require.NoError(t, err)
+	_, err = laptopClient.DownloadImage(context.Background(), laptop.Id, image.GetId(), io.Discard)
+	require.Equal(t, codes.NotFound, status.Code(err))
+	summary, err := laptopClient.GetRatingSummary(context.Background(), laptop.Id)
+	require.NoError(t, err)
+	require.Zero(t, summary.GetRatedCount())
+}
+
+// blockingLaptopServer never answers a search until the call is canceled.
+type blockingLaptopServer struct {
+	pb.UnimplementedLaptopServiceServer
+}
+
+func (blockingLaptopServer) SearchLaptop(req *pb.SearchLaptopRequest, stream pb.LaptopService_SearchLaptopServer) error {
+	<-stream.Context().Done()
+	return stream.Context().Err()
+}
+
+func TestLaptopClientCallTimeout(t *testing.T) {
+	t.Parallel()
 
+	grpcServer := grpc.NewServer()
+	pb.RegisterLaptopServiceServer(grpcServer, blockingLaptopServer{})
+	listener, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
 	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	laptopClient := client.NewLaptopClient(conn, client.WithCallTimeout(100*time.Millisecond))
+
+	it, err := laptopClient.SearchLaptop(context.Background(), &pb.Filter{})
+	require.NoError(t, err)
+	require.False(t, it.Next())
+	require.Equal(t, codes.DeadlineExceeded, status.Code(it.Err()))
+
+	// the deadline of the caller wins over the call timeout
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	it, err = laptopClient.SearchLaptop(ctx, &pb.Filter{})
+	require.NoError(t, err)
+	require.False(t, it.Next())
+	require.Equal(t, codes.DeadlineExceeded, status.Code(it.Err()))
+	require.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+
+	_, err = laptopClient.CreateLaptop(context.Background(), sample.NewLaptop())
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+func TestClientUploadDirectory(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	imageStore := service.NewContentAddressedImageStore(t.TempDir(), 0)
+
+	laptop := sample.NewLaptop()
+	err := laptopStore.Save(laptop)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	for i := 0; i < 5; i++ {
+		data := []byte(fmt.Sprintf("image data number %d", i))
+		err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("image-%d.jpg", i)), data, 0644)
+		require.NoError(t, err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not an image"), 0644)
+	require.NoError(t, err)
 
-	return listener.Addr().String()
+	serverAddress := startTestServer(t, withLaptopStore(laptopStore), withImageStore(imageStore))
+	conn, err := grpc.Dial(serverAddress, grpc.WithInsecure())
+	require.NoError(t, err)
+	laptopClient := client.NewLaptopClient(conn)
+
+	progress := make(chan client.UploadProgress, 100)
+	options := client.UploadOptions{
+		Concurrency: 2,
+		ChunkSize:   4,
+		MaxRetries:  2,
+		Progress: func(p client.UploadProgress) {
+			progress <- p
+		},
+	}
+
+	results, err := laptopClient.UploadDirectory(contextWithTestUser(t, "admin", "admin"), laptop.Id, dir, options)
+	require.NoError(t, err)
+	require.Len(t, results, 5)
+	close(progress)
+
+	for _, result := range results {
+		require.NoError(t, result.Err)
+		require.NotEmpty(t, result.ImageID)
+		require.Equal(t, 1, result.Attempts)
+	}
+
+	sent := map[string]int64{}
+	for p := range progress {
+		require.LessOrEqual(t, p.SentBytes, p.TotalBytes)
+		sent[p.Job.ImagePath] = p.SentBytes
+	}
+	require.Len(t, sent, 5)
+
+	options.Progress = nil
+	results = laptopClient.UploadImages(contextWithTestUser(t, "admin", "admin"), []client.UploadJob{
+		{LaptopID: sample.RandomID(), ImagePath: filepath.Join(dir, "image-0.jpg")},
+		{LaptopID: laptop.Id, ImagePath: filepath.Join(dir, "missing.jpg")},
+	}, options)
+	require.Len(t, results, 2)
+	require.Equal(t, codes.InvalidArgument, status.Code(results[0].Err))
+	require.Equal(t, 1, results[0].Attempts)
+	require.Error(t, results[1].Err)
+
+	// an upload failing with Unavailable is retried, and the retry succeeds
+	faults := newFaultInjector(map[string]fault{
+		"UploadImage": {failures: 1},
+	})
+	conn, err = grpc.Dial(startTestServer(t, withLaptopStore(laptopStore), withFaults(faults)), grpc.WithInsecure())
+	require.NoError(t, err)
+	laptopClient = client.NewLaptopClient(conn)
+	options.Concurrency = 1
+	options.RetryBackoff = time.Millisecond
+	results = laptopClient.UploadImages(contextWithTestUser(t, "admin", "admin"), []client.UploadJob{
+		{LaptopID: laptop.Id, ImagePath: filepath.Join(dir, "image-0.jpg")},
+	}, options)
+	require.Len(t, results, 1)
+	require.NoError(t, results[0].Err)
+	require.NotEmpty(t, results[0].ImageID)
+	require.Equal(t, 2, results[0].Attempts)
+	require.Equal(t, 2, faults.callCount("UploadImage"))
+}
+
+func uploadTestImage(t *testing.T, laptopClient pb.LaptopServiceClient, laptopID string, data []byte) string {
+	imageID, err := uploadTestImageAs(contextWithTestUser(t, "admin", "admin"), laptopClient, laptopID, data)
+	require.NoError(t, err)
+	return imageID
+}
+
+func uploadTestImageAs(ctx context.Context, laptopClient pb.LaptopServiceClient, laptopID string, data []byte) (string, error) {
+	stream, err := laptopClient.UploadImage(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	// a rejected upload makes Send fail with io.EOF, the status comes with CloseAndRecv
+	err = stream.Send(&pb.UploadImageRequest{
+		Data: &pb.UploadImageRequest_ImageInfo{
+			ImageInfo: &pb.ImageInfo{
+				LaptopId:  laptopID,
+				ImageType: ".jpg",
+			},
+		},
+	})
+	if err == nil {
+		stream.Send(&pb.UploadImageRequest{
+			Data: &pb.UploadImageRequest_ChunkData{ChunkData: data},
+		})
+	}
 
+	res, err := stream.CloseAndRecv()
+	if err != nil {
+		return "", err
+	}
+	return res.GetId(), nil
+}
+
+const testSecretKey = "secret"
+
+func contextWithTestUser(t *testing.T, userName string, role string) context.Context {
+	jwtManager := service.NewJWTManager(testSecretKey, time.Minute)
+	token, err := jwtManager.GenerateToken(service.UserClaims{
+		UserName: userName,
+		Role:     role,
+		Scopes:   service.DefaultRoles.Scopes(role),
+	})
+	require.NoError(t, err)
+
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", token)
 }
 
 func newTestLaptopClient(t *testing.T, serverAddress string) pb.LaptopServiceClient {
@@ -193,3 +865,27 @@ func requireSameLaptop(t *testing.T, expected *pb.Laptop, actual *pb.Laptop) {
 
 	require.Equal(t, json1, json2)
 }
+
+func TestAuthInterceptorDeniesUndeclaredMethods(t *testing.T) {
+	t.Parallel()
+
+	laptopServer := service.NewLaptopServer(service.NewInMemoryLaptopStore(), nil, nil)
+	jwtManager := service.NewJWTManager(testSecretKey, time.Minute)
+	interceptor := service.NewAuthInterceptor(jwtManager, map[string]*pb.AuthPolicy{})
+
+	grpcServer := grpc.NewServer(
+		grpc.UnaryInterceptor(interceptor.Unary()),
+		grpc.StreamInterceptor(interceptor.Stream()),
+	)
+	pb.RegisterLaptopServiceServer(grpcServer, laptopServer)
+
+	listener, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	laptopClient := newTestLaptopClient(t, listener.Addr().String())
+
+	_, err = laptopClient.CreateLaptop(contextWithTestUser(t, "admin", "admin"), &pb.CreateLaptopRequest{Laptop: sample.NewLaptop()})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
@@ -6,28 +6,92 @@ import (
 	"errors"
 	"io"
 	"log"
+	"math"
+	"os"
 	pb "pcbook/generateProto"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
-const maxImageSize = 1 << 20 // 1MB
+const (
+	maxImageSize      = 1 << 20 // 1MB
+	downloadChunkSize = 32 << 10
+)
 
 type LaptopServer struct {
 	pb.UnimplementedLaptopServiceServer
 	laptopStore LaptopStore
 	imageStore  ImageStore
 	ratingStore RatingStore
+	ratingPrior RatingPrior
+	scoreRange  ScoreRange
+	// halfLife enables time-decayed rating averages when it is positive
+	halfLife time.Duration
+}
+
+// ScoreRange is the inclusive range of accepted rating scores.
+type ScoreRange struct {
+	Min float64
+	Max float64
+}
+
+var DefaultScoreRange = ScoreRange{
+	Min: 1,
+	Max: 10,
+}
+
+func (scoreRange ScoreRange) Contains(score float64) bool {
+	return !math.IsNaN(score) && score >= scoreRange.Min && score <= scoreRange.Max
+}
+
+type LaptopServerOption func(server *LaptopServer)
+
+// WithScoreRange sets the range of scores accepted by RateLaptop.
+func WithScoreRange(scoreRange ScoreRange) LaptopServerOption {
+	return func(server *LaptopServer) {
+		server.scoreRange = scoreRange
+	}
+}
+
+// WithRatingHalfLife makes RateLaptop return an average in which a rating
+// loses half of its weight every halfLife. A zero halfLife disables decay.
+func WithRatingHalfLife(halfLife time.Duration) LaptopServerOption {
+	return func(server *LaptopServer) {
+		server.halfLife = halfLife
+	}
+}
+
+// WithRatingPrior sets the prior used to compute the Bayesian average of ratings.
+func WithRatingPrior(prior RatingPrior) LaptopServerOption {
+	return func(server *LaptopServer) {
+		server.ratingPrior = prior
+	}
 }
 
-func NewLaptopServer(laptopStore LaptopStore, imageStore ImageStore, ratingStore RatingStore) *LaptopServer {
-	return &LaptopServer{
+func NewLaptopServer(
+	laptopStore LaptopStore,
+	imageStore ImageStore,
+	ratingStore RatingStore,
+	options ...LaptopServerOption,
+) *LaptopServer {
+	server := &LaptopServer{
 		laptopStore: laptopStore,
 		imageStore:  imageStore,
 		ratingStore: ratingStore,
+		ratingPrior: DefaultRatingPrior,
+		scoreRange:  DefaultScoreRange,
 	}
+
+	for _, option := range options {
+		option(server)
+	}
+
+	return server
 }
 
 func (s *LaptopServer) CreateLaptop(
@@ -40,6 +104,12 @@ func (s *LaptopServer) CreateLaptop(
 	laptop := req.GetLaptop()
 	log.Print("Received a request to create a laptop with ID: ", laptop.Id)
 
+	// the owner is the caller, whatever the request says
+	laptop.Owner = ""
+	if claims, ok := ClaimsFromContext(ctx); ok {
+		laptop.Owner = claims.UserName
+	}
+
 	if len(laptop.Id) > 0 {
 		_, err := uuid.Parse(laptop.Id)
 		if err != nil {
@@ -111,6 +181,70 @@ func (server *LaptopServer) SearchLaptop(
 	return nil
 }
 
+func (server *LaptopServer) GetLaptop(
+	ctx context.Context,
+	req *pb.GetLaptopRequest,
+) (*pb.GetLaptopResponse, error) {
+	laptopID := req.GetId()
+	log.Print("receive a get-laptop request with id: ", laptopID)
+
+	laptop, err := server.laptopStore.Find(laptopID)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot find laptop: %v", err))
+	}
+	if laptop == nil {
+		return nil, logError(status.Errorf(codes.NotFound, "laptop id %s doesn't exist", laptopID))
+	}
+
+	return &pb.GetLaptopResponse{Laptop: laptop}, nil
+}
+
+// DeleteLaptop removes a laptop from the catalog, with its images and ratings.
+func (server *LaptopServer) DeleteLaptop(
+	ctx context.Context,
+	req *pb.DeleteLaptopRequest,
+) (*pb.DeleteLaptopResponse, error) {
+	laptopID := req.GetId()
+	log.Print("receive a delete-laptop request with id: ", laptopID)
+
+	laptop, err := server.laptopStore.Find(laptopID)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot find laptop: %v", err))
+	}
+	if laptop == nil {
+		return nil, logError(status.Errorf(codes.NotFound, "laptop id %s doesn't exist", laptopID))
+	}
+	err = authorizeLaptopOwner(ctx, laptop)
+	if err != nil {
+		return nil, err
+	}
+
+	err = server.laptopStore.Delete(laptopID)
+	if err != nil {
+		code := codes.Internal
+		if errors.Is(err, ErrNotFound) {
+			code = codes.NotFound
+		}
+		return nil, logError(status.Errorf(code, "cannot delete laptop: %v", err))
+	}
+
+	// a laptop created again with the same ID must not inherit the images and ratings of the deleted one
+	if server.imageStore != nil {
+		err = server.imageStore.DeleteLaptop(laptopID)
+		if err != nil {
+			return nil, logError(status.Errorf(codes.Internal, "cannot delete laptop images: %v", err))
+		}
+	}
+	if server.ratingStore != nil {
+		err = server.ratingStore.RemoveLaptop(laptopID)
+		if err != nil {
+			return nil, logError(status.Errorf(codes.Internal, "cannot delete laptop ratings: %v", err))
+		}
+	}
+
+	return &pb.DeleteLaptopResponse{}, nil
+}
+
 func (server *LaptopServer) UploadImage(stream pb.LaptopService_UploadImageServer) error {
 	req, err := stream.Recv()
 	if err != nil {
@@ -119,6 +253,7 @@ func (server *LaptopServer) UploadImage(stream pb.LaptopService_UploadImageServe
 
 	laptopID := req.GetImageInfo().GetLaptopId()
 	imageType := req.GetImageInfo().GetImageType()
+	checksum := req.GetImageInfo().GetChecksum()
 	log.Printf("receive an upload-image request for laptop %s with image type %s", laptopID, imageType)
 
 	laptop, err := server.laptopStore.Find(laptopID)
@@ -128,6 +263,10 @@ func (server *LaptopServer) UploadImage(stream pb.LaptopService_UploadImageServe
 	if laptop == nil {
 		return logError(status.Errorf(codes.InvalidArgument, "laptop id %s doesn't exist", laptopID))
 	}
+	err = authorizeLaptopOwner(stream.Context(), laptop)
+	if err != nil {
+		return err
+	}
 
 	imageData := bytes.Buffer{}
 	imageSize := 0
@@ -165,9 +304,25 @@ func (server *LaptopServer) UploadImage(stream pb.LaptopService_UploadImageServe
 		}
 	}
 
+	if len(checksum) > 0 && !strings.EqualFold(checksum, Checksum(imageData.Bytes())) {
+		return logError(status.Errorf(codes.InvalidArgument, "image checksum doesn't match: %s", checksum))
+	}
+
 	imageID, err := server.imageStore.Save(laptopID, imageType, imageData)
 	if err != nil {
-		return logError(status.Errorf(codes.Internal, "cannot save image to the store: %v", err))
+		code := codes.Internal
+		if errors.Is(err, ErrTooManyImages) {
+			code = codes.FailedPrecondition
+		}
+		return logError(status.Errorf(code, "cannot save image to the store: %v", err))
+	}
+
+	// the first uploaded image is shown in listings until another one is picked
+	if len(laptop.GetPrimaryImageId()) == 0 {
+		err = server.laptopStore.SetPrimaryImage(laptopID, imageID)
+		if err != nil {
+			return logError(status.Errorf(codes.Internal, "cannot set primary image: %v", err))
+		}
 	}
 
 	res := &pb.UploadImageResponse{
@@ -184,7 +339,171 @@ func (server *LaptopServer) UploadImage(stream pb.LaptopService_UploadImageServe
 	return nil
 }
 
+func (server *LaptopServer) SetPrimaryImage(
+	ctx context.Context,
+	req *pb.SetPrimaryImageRequest,
+) (*pb.SetPrimaryImageResponse, error) {
+	laptopID := req.GetLaptopId()
+	imageID := req.GetImageId()
+	log.Printf("receive a set-primary-image request for laptop %s with image %s", laptopID, imageID)
+
+	_, err := server.findLaptopImage(ctx, laptopID, imageID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = server.laptopStore.SetPrimaryImage(laptopID, imageID)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot set primary image: %v", err))
+	}
+
+	return &pb.SetPrimaryImageResponse{}, nil
+}
+
+func (server *LaptopServer) DeleteImage(
+	ctx context.Context,
+	req *pb.DeleteImageRequest,
+) (*pb.DeleteImageResponse, error) {
+	laptopID := req.GetLaptopId()
+	imageID := req.GetImageId()
+	log.Printf("receive a delete-image request for laptop %s with image %s", laptopID, imageID)
+
+	laptop, err := server.findLaptopImage(ctx, laptopID, imageID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = server.imageStore.Delete(imageID)
+	if err != nil {
+		code := codes.Internal
+		if errors.Is(err, ErrImageNotFound) {
+			code = codes.NotFound
+		}
+		return nil, logError(status.Errorf(code, "cannot delete image: %v", err))
+	}
+
+	if laptop.GetPrimaryImageId() == imageID {
+		err = server.laptopStore.SetPrimaryImage(laptopID, "")
+		if err != nil {
+			return nil, logError(status.Errorf(codes.Internal, "cannot clear primary image: %v", err))
+		}
+	}
+
+	return &pb.DeleteImageResponse{}, nil
+}
+
+// DownloadImage sends the info of the image, then its data in chunks.
+func (server *LaptopServer) DownloadImage(
+	req *pb.DownloadImageRequest,
+	stream pb.LaptopService_DownloadImageServer,
+) error {
+	laptopID := req.GetLaptopId()
+	imageID := req.GetImageId()
+	log.Printf("receive a download-image request for laptop %s with image %s", laptopID, imageID)
+
+	image, err := server.imageStore.Find(imageID)
+	if err != nil {
+		return logError(status.Errorf(codes.Internal, "cannot find image: %v", err))
+	}
+	if image == nil || image.LaptopID != laptopID {
+		return logError(status.Errorf(codes.NotFound, "image id %s doesn't exist for laptop %s", imageID, laptopID))
+	}
+
+	file, err := os.Open(image.Path)
+	if err != nil {
+		return logError(status.Errorf(codes.Internal, "cannot open image file: %v", err))
+	}
+	defer file.Close()
+
+	res := &pb.DownloadImageResponse{
+		Data: &pb.DownloadImageResponse_ImageInfo{
+			ImageInfo: &pb.ImageInfo{
+				LaptopId:  laptopID,
+				ImageType: image.Type,
+				Checksum:  image.Checksum,
+			},
+		},
+	}
+	err = stream.Send(res)
+	if err != nil {
+		return logError(status.Errorf(codes.Unknown, "cannot send image info: %v", err))
+	}
+
+	buffer := make([]byte, downloadChunkSize)
+	for {
+		err := contextError(stream.Context())
+		if err != nil {
+			return err
+		}
+
+		n, err := file.Read(buffer)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return logError(status.Errorf(codes.Internal, "cannot read image file: %v", err))
+		}
+
+		res := &pb.DownloadImageResponse{
+			Data: &pb.DownloadImageResponse_ChunkData{
+				ChunkData: buffer[:n],
+			},
+		}
+		err = stream.Send(res)
+		if err != nil {
+			return logError(status.Errorf(codes.Unknown, "cannot send chunk data: %v", err))
+		}
+	}
+}
+
+// findLaptopImage returns the laptop if the image exists and belongs to it, and the caller may manage the laptop.
+func (server *LaptopServer) findLaptopImage(ctx context.Context, laptopID, imageID string) (*pb.Laptop, error) {
+	laptop, err := server.laptopStore.Find(laptopID)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot find laptop: %v", err))
+	}
+	if laptop == nil {
+		return nil, logError(status.Errorf(codes.NotFound, "laptop id %s doesn't exist", laptopID))
+	}
+	err = authorizeLaptopOwner(ctx, laptop)
+	if err != nil {
+		return nil, err
+	}
+
+	image, err := server.imageStore.Find(imageID)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot find image: %v", err))
+	}
+	if image == nil || image.LaptopID != laptopID {
+		return nil, logError(status.Errorf(codes.NotFound, "image id %s doesn't exist for laptop %s", imageID, laptopID))
+	}
+
+	return laptop, nil
+}
+
+// authorizeLaptopOwner checks that the caller owns the laptop, or may manage every laptop.
+func authorizeLaptopOwner(ctx context.Context, laptop *pb.Laptop) error {
+	claims, ok := ClaimsFromContext(ctx)
+	if !ok {
+		return logError(status.Errorf(codes.Unauthenticated, "managing a laptop requires an authenticated user"))
+	}
+	if claims.HasScope(ScopeLaptopsAdmin) {
+		return nil
+	}
+
+	// laptops without an owner were created before ownership was recorded, only admins manage them
+	if len(laptop.GetOwner()) == 0 || laptop.GetOwner() != claims.UserName {
+		return logError(status.Errorf(codes.PermissionDenied, "laptop %s doesn't belong to %s", laptop.GetId(), claims.UserName))
+	}
+	return nil
+}
+
 func (server *LaptopServer) RateLaptop(stream pb.LaptopService_RateLaptopServer) error {
+	claims, ok := ClaimsFromContext(stream.Context())
+	if !ok {
+		return logError(status.Errorf(codes.Unauthenticated, "rating requires an authenticated user"))
+	}
+
 	for {
 		err := contextError(stream.Context())
 		if err != nil {
@@ -200,38 +519,251 @@ func (server *LaptopServer) RateLaptop(stream pb.LaptopService_RateLaptopServer)
 			return logError(status.Errorf(codes.Unknown, "cannot receive stream request: %v", err))
 		}
 
-		laptopID := req.GetLaptopId()
-		score := req.GetScore()
-		log.Printf("receive a rate-laptop request with id: %s, score: %f", laptopID, score)
-
-		found, err := server.laptopStore.Find(laptopID)
+		res, err := server.rateLaptop(claims.UserName, req)
 		if err != nil {
-			return logError(status.Errorf(codes.Internal, "cannot find laptop: %v", err))
-		}
-		if found == nil {
-			return logError(status.Errorf(codes.NotFound, "laptop id %s doesn't exist", laptopID))
+			st := status.Convert(err)
+			if st.Code() == codes.Internal {
+				return err
+			}
+
+			// a bad entry must not abort the rest of a bulk rating upload
+			res = &pb.RateLaptopResponse{
+				LaptopId:     req.GetLaptopId(),
+				Ok:           false,
+				ErrorCode:    int32(st.Code()),
+				ErrorMessage: st.Message(),
+			}
 		}
 
-		rating, err := server.ratingStore.Add(laptopID, score)
+		err = stream.Send(res)
 		if err != nil {
-			return logError(status.Errorf(codes.Internal, "cannot add rating to store: %v", err))
+			return logError(status.Errorf(codes.Unknown, "cannot send response: %v", err))
 		}
 
-		res := &pb.RateLaptopResponse{
-			LaptopId:    laptopID,
-			RatedCount:  rating.Count,
-			AverageCore: rating.Sum / float64(rating.Count),
+	}
+	return nil
+}
+
+func (server *LaptopServer) rateLaptop(userName string, req *pb.RateLaptopRequest) (*pb.RateLaptopResponse, error) {
+	laptopID := req.GetLaptopId()
+	score := req.GetScore()
+	log.Printf("receive a rate-laptop request with id: %s, score: %f", laptopID, score)
+
+	if !server.scoreRange.Contains(score) {
+		return nil, logError(status.Errorf(codes.InvalidArgument,
+			"score %v is not between %v and %v", score, server.scoreRange.Min, server.scoreRange.Max))
+	}
+
+	found, err := server.laptopStore.Find(laptopID)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot find laptop: %v", err))
+	}
+	if found == nil {
+		return nil, logError(status.Errorf(codes.NotFound, "laptop id %s doesn't exist", laptopID))
+	}
+
+	rating, err := server.ratingStore.Add(laptopID, userName, score)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot add rating to store: %v", err))
+	}
+
+	average, err := server.averageScore(laptopID, rating)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &pb.RateLaptopResponse{
+		LaptopId:    laptopID,
+		RatedCount:  rating.Count,
+		AverageCore: average,
+		Ok:          true,
+	}
+	return res, nil
+}
+
+// averageScore returns the plain average of the rating, or its time-decayed average if decay is enabled.
+func (server *LaptopServer) averageScore(laptopID string, rating *Rating) (float64, error) {
+	if server.halfLife <= 0 {
+		return rating.Average(), nil
+	}
+
+	ratings, err := server.ratingStore.FindByLaptop(laptopID)
+	if err != nil {
+		return 0, logError(status.Errorf(codes.Internal, "cannot find laptop ratings: %v", err))
+	}
+
+	return DecayedAverage(ratings, server.halfLife, time.Now()), nil
+}
+
+func (server *LaptopServer) GetMyRatings(
+	ctx context.Context,
+	req *pb.GetMyRatingsRequest,
+) (*pb.GetMyRatingsResponse, error) {
+	claims, ok := ClaimsFromContext(ctx)
+	if !ok {
+		return nil, logError(status.Errorf(codes.Unauthenticated, "ratings require an authenticated user"))
+	}
+
+	ratings, err := server.ratingStore.FindByUser(claims.UserName)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot find ratings: %v", err))
+	}
+
+	res := &pb.GetMyRatingsResponse{}
+	for _, rating := range ratings {
+		res.Ratings = append(res.Ratings, &pb.UserRating{
+			LaptopId: rating.LaptopID,
+			Score:    rating.Score,
+		})
+	}
+
+	return res, nil
+}
+
+func (server *LaptopServer) RetractRating(
+	ctx context.Context,
+	req *pb.RetractRatingRequest,
+) (*pb.RetractRatingResponse, error) {
+	claims, ok := ClaimsFromContext(ctx)
+	if !ok {
+		return nil, logError(status.Errorf(codes.Unauthenticated, "ratings require an authenticated user"))
+	}
+
+	laptopID := req.GetLaptopId()
+	log.Printf("receive a retract-rating request for laptop %s from user %s", laptopID, claims.UserName)
+
+	rating, err := server.ratingStore.Remove(laptopID, claims.UserName)
+	if err != nil {
+		code := codes.Internal
+		if errors.Is(err, ErrRatingNotFound) {
+			code = codes.NotFound
 		}
+		return nil, logError(status.Errorf(code, "cannot retract rating: %v", err))
+	}
 
-		err = stream.Send(res)
+	average, err := server.averageScore(laptopID, rating)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &pb.RetractRatingResponse{
+		LaptopId:    laptopID,
+		RatedCount:  rating.Count,
+		AverageCore: average,
+	}
+	return res, nil
+}
+
+func (server *LaptopServer) GetRatingSummary(
+	ctx context.Context,
+	req *pb.GetRatingSummaryRequest,
+) (*pb.GetRatingSummaryResponse, error) {
+	laptopID := req.GetLaptopId()
+	log.Printf("receive a get-rating-summary request for laptop %s", laptopID)
+
+	laptop, err := server.laptopStore.Find(laptopID)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot find laptop: %v", err))
+	}
+	if laptop == nil {
+		return nil, logError(status.Errorf(codes.NotFound, "laptop id %s doesn't exist", laptopID))
+	}
+
+	summary, err := server.ratingSummary(laptopID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.GetRatingSummaryResponse{Summary: summary}, nil
+}
+
+func (server *LaptopServer) TopRatedLaptops(
+	req *pb.TopRatedLaptopsRequest,
+	stream pb.LaptopService_TopRatedLaptopsServer,
+) error {
+	filter := req.GetFilter()
+	log.Printf("receive a top-rated-laptops request with filter: %v", filter)
+
+	results := []*pb.TopRatedLaptopsResponse{}
+	err := server.laptopStore.Search(
+		stream.Context(),
+		filter,
+		func(laptop *pb.Laptop) error {
+			summary, err := server.ratingSummary(laptop.GetId())
+			if err != nil {
+				return err
+			}
+
+			results = append(results, &pb.TopRatedLaptopsResponse{
+				Laptop:  laptop,
+				Summary: summary,
+			})
+			return nil
+		},
+	)
+	if err != nil {
+		return logError(status.Errorf(codes.Internal, "unexpected error: %v", err))
+	}
+
+	// ties are ranked by the number of ratings, then by ID, so that the order and the limit are deterministic
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i].GetSummary(), results[j].GetSummary()
+		if a.GetBayesianAverage() != b.GetBayesianAverage() {
+			return a.GetBayesianAverage() > b.GetBayesianAverage()
+		}
+		if a.GetRatedCount() != b.GetRatedCount() {
+			return a.GetRatedCount() > b.GetRatedCount()
+		}
+		return results[i].GetLaptop().GetId() < results[j].GetLaptop().GetId()
+	})
+
+	limit := int(req.GetLimit())
+	if limit > 0 && limit < len(results) {
+		results = results[:limit]
+	}
+
+	for _, res := range results {
+		err := stream.Send(res)
 		if err != nil {
 			return logError(status.Errorf(codes.Unknown, "cannot send response: %v", err))
 		}
-
 	}
+
 	return nil
 }
 
+func (server *LaptopServer) ratingSummary(laptopID string) (*pb.RatingSummary, error) {
+	ratings, err := server.ratingStore.FindByLaptop(laptopID)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot find laptop ratings: %v", err))
+	}
+
+	scores := make([]float64, len(ratings))
+	for i, rating := range ratings {
+		scores[i] = rating.Score
+	}
+
+	summary := SummarizeRatings(scores, server.ratingPrior)
+
+	res := &pb.RatingSummary{
+		LaptopId:          laptopID,
+		RatedCount:        summary.Count,
+		AverageScore:      summary.Average,
+		MedianScore:       summary.Median,
+		StandardDeviation: summary.StdDev,
+		BayesianAverage:   summary.BayesianAverage,
+	}
+	for _, bucket := range summary.Histogram {
+		res.Histogram = append(res.Histogram, &pb.ScoreBucket{
+			MinScore: bucket.MinScore,
+			MaxScore: bucket.MaxScore,
+			Count:    bucket.Count,
+		})
+	}
+
+	return res, nil
+}
+
 func contextError(ctx context.Context) error {
 	switch ctx.Err() {
 	case context.Canceled:
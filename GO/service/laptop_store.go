@@ -11,12 +11,17 @@ import (
 	"github.com/jinzhu/copier"
 )
 
-var ErrAlreadyExists = errors.New("laptop already exists")
+var (
+	ErrAlreadyExists = errors.New("laptop already exists")
+	ErrNotFound      = errors.New("laptop not found")
+)
 
 type LaptopStore interface {
 	Save(laptop *pb.Laptop) error
 	Find(id string) (*pb.Laptop, error)
 	Search(ctx context.Context, filter *pb.Filter, found func(laptop *pb.Laptop) error) error
+	SetPrimaryImage(laptopID, imageID string) error
+	Delete(id string) error
 }
 
 type InMemoryLaptopStore struct {
@@ -61,6 +66,31 @@ func (store *InMemoryLaptopStore) Find(id string) (*pb.Laptop, error) {
 	return deepCopy(laptop)
 }
 
+func (store *InMemoryLaptopStore) SetPrimaryImage(laptopID, imageID string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	laptop := store.data[laptopID]
+	if laptop == nil {
+		return ErrNotFound
+	}
+
+	laptop.PrimaryImageId = imageID
+	return nil
+}
+
+func (store *InMemoryLaptopStore) Delete(id string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.data[id] == nil {
+		return ErrNotFound
+	}
+
+	delete(store.data, id)
+	return nil
+}
+
 func (store *InMemoryLaptopStore) Search(
 	ctx context.Context,
 	filter *pb.Filter,
@@ -92,8 +122,9 @@ func (store *InMemoryLaptopStore) Search(
 	return nil
 }
 
+// isQualified tells whether the laptop matches the filter. An unset max price sets no limit.
 func isQualified(filter *pb.Filter, laptop *pb.Laptop) bool {
-	if laptop.GetPriceUsd() > filter.GetMaxPriceUsd() {
+	if filter.GetMaxPriceUsd() > 0 && laptop.GetPriceUsd() > filter.GetMaxPriceUsd() {
 		return false
 	}
 
@@ -109,6 +140,10 @@ func isQualified(filter *pb.Filter, laptop *pb.Laptop) bool {
 		return false
 	}
 
+	if len(filter.GetOwner()) > 0 && laptop.GetOwner() != filter.GetOwner() {
+		return false
+	}
+
 	return true
 }
 
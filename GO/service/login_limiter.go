@@ -0,0 +1,183 @@
+package service
+
+import (
+	"sync"
+	"time"
+)
+
+// LoginLimiterConfig controls how failed logins are throttled.
+type LoginLimiterConfig struct {
+	// BaseDelay is the wait after the first failure, doubled after each further failure
+	BaseDelay time.Duration
+	// MaxDelay caps the wait between attempts before the lockout
+	MaxDelay time.Duration
+	// MaxFailures is the number of consecutive failures that locks the key out
+	MaxFailures int
+	// LockoutDuration is how long a key stays locked out
+	LockoutDuration time.Duration
+	// ResetAfter is how long after its last failure a key's failures are forgotten
+	ResetAfter time.Duration
+	// MaxConcurrent is the number of attempts of a key checked at the same time, 0 for no limit.
+	// Further attempts wait BaseDelay, so that parallel guesses cannot outrun the recorded failures.
+	MaxConcurrent int
+}
+
+var DefaultLoginLimiterConfig = LoginLimiterConfig{
+	BaseDelay:       time.Second,
+	MaxDelay:        30 * time.Second,
+	MaxFailures:     10,
+	LockoutDuration: 15 * time.Minute,
+	ResetAfter:      time.Hour,
+	MaxConcurrent:   4,
+}
+
+// LoginLimiter tracks failed logins per key, e.g. per username and per peer address,
+// and tells how long a key must wait before its next attempt.
+type LoginLimiter struct {
+	config   LoginLimiterConfig
+	mutex    sync.Mutex
+	attempts map[string]*loginAttempts
+}
+
+type loginAttempts struct {
+	failures     int
+	lastFailure  time.Time
+	blockedUntil time.Time
+	inFlight     int
+}
+
+func NewLoginLimiter(config LoginLimiterConfig) *LoginLimiter {
+	return &LoginLimiter{
+		config:   config,
+		attempts: make(map[string]*loginAttempts),
+	}
+}
+
+// Wait returns how long the caller must wait before trying to log in with any of the keys.
+// When it returns 0, an attempt is reserved for the keys until the caller releases it with Release,
+// after recording its outcome.
+func (limiter *LoginLimiter) Wait(keys ...string) time.Duration {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := time.Now()
+	wait := time.Duration(0)
+	for _, key := range keys {
+		attempts := limiter.attempts[key]
+		if attempts == nil {
+			continue
+		}
+		if attempts.blockedUntil.Sub(now) > wait {
+			wait = attempts.blockedUntil.Sub(now)
+		}
+		if limiter.config.MaxConcurrent > 0 && attempts.inFlight >= limiter.config.MaxConcurrent && wait < limiter.concurrentDelay() {
+			wait = limiter.concurrentDelay()
+		}
+	}
+	if wait > 0 {
+		return wait
+	}
+
+	for _, key := range keys {
+		attempts := limiter.attempts[key]
+		if attempts == nil {
+			attempts = &loginAttempts{}
+			limiter.attempts[key] = attempts
+		}
+		attempts.inFlight++
+	}
+	return 0
+}
+
+// concurrentDelay is the wait of an attempt made while too many others are checked.
+func (limiter *LoginLimiter) concurrentDelay() time.Duration {
+	if limiter.config.BaseDelay > 0 {
+		return limiter.config.BaseDelay
+	}
+	return time.Second
+}
+
+// Release ends an attempt reserved by Wait.
+func (limiter *LoginLimiter) Release(keys ...string) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	for _, key := range keys {
+		attempts := limiter.attempts[key]
+		if attempts == nil {
+			continue
+		}
+		attempts.inFlight--
+		if attempts.inFlight <= 0 && attempts.failures == 0 {
+			delete(limiter.attempts, key)
+		}
+	}
+}
+
+// Failure records a failed login for the keys.
+func (limiter *LoginLimiter) Failure(keys ...string) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := time.Now()
+	limiter.prune(now)
+
+	for _, key := range keys {
+		attempts := limiter.attempts[key]
+		if attempts == nil {
+			attempts = &loginAttempts{}
+			limiter.attempts[key] = attempts
+		}
+
+		// failures after a lockout start a new series
+		if attempts.failures >= limiter.config.MaxFailures {
+			attempts.failures = 0
+		}
+
+		attempts.failures++
+		attempts.lastFailure = now
+		attempts.blockedUntil = now.Add(limiter.delay(attempts.failures))
+	}
+}
+
+// Success forgets the failures of the keys, whose attempts stay reserved until released.
+func (limiter *LoginLimiter) Success(keys ...string) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	for _, key := range keys {
+		attempts := limiter.attempts[key]
+		if attempts == nil {
+			continue
+		}
+		if attempts.inFlight > 0 {
+			*attempts = loginAttempts{inFlight: attempts.inFlight}
+		} else {
+			delete(limiter.attempts, key)
+		}
+	}
+}
+
+func (limiter *LoginLimiter) delay(failures int) time.Duration {
+	if failures >= limiter.config.MaxFailures {
+		return limiter.config.LockoutDuration
+	}
+
+	delay := limiter.config.BaseDelay
+	for i := 1; i < failures && delay < limiter.config.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > limiter.config.MaxDelay {
+		delay = limiter.config.MaxDelay
+	}
+	return delay
+}
+
+// prune drops the keys that are neither blocked nor failed recently, to bound memory.
+func (limiter *LoginLimiter) prune(now time.Time) {
+	for key, attempts := range limiter.attempts {
+		if attempts.inFlight == 0 && now.After(attempts.blockedUntil) && now.Sub(attempts.lastFailure) > limiter.config.ResetAfter {
+			delete(limiter.attempts, key)
+		}
+	}
+}
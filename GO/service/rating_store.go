@@ -1,9 +1,25 @@
 package service
 
-import "sync"
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrRatingNotFound = errors.New("rating not found")
 
 type RatingStore interface {
-	Add(laptopID string, score float64) (*Rating, error)
+	// Add saves the user's score for a laptop, replacing any score the user gave before.
+	Add(laptopID string, userName string, score float64) (*Rating, error)
+	// Remove retracts the user's score for a laptop.
+	Remove(laptopID string, userName string) (*Rating, error)
+	// RemoveLaptop retracts every score given to a laptop.
+	RemoveLaptop(laptopID string) error
+	// FindByUser returns every score the user has given.
+	FindByUser(userName string) ([]*UserRating, error)
+	// FindByLaptop returns every score given to a laptop.
+	FindByLaptop(laptopID string) ([]*UserRating, error)
 }
 
 type Rating struct {
@@ -11,32 +27,164 @@ type Rating struct {
 	Sum   float64
 }
 
+type UserRating struct {
+	LaptopID string
+	UserName string
+	Score    float64
+	RatedAt  time.Time
+}
+
+func (rating *Rating) Average() float64 {
+	if rating.Count == 0 {
+		return 0
+	}
+	return rating.Sum / float64(rating.Count)
+}
+
 type InMemoryRatingStore struct {
-	mutex sync.RWMutex
-	data  map[string]*Rating
+	mutex   sync.RWMutex
+	data    map[string]*Rating
+	ratings map[string]map[string]*UserRating
 }
 
 func NewInMemoryRatingStore() *InMemoryRatingStore {
 	return &InMemoryRatingStore{
-		data: make(map[string]*Rating),
+		data:    make(map[string]*Rating),
+		ratings: make(map[string]map[string]*UserRating),
 	}
 }
 
-func (store *InMemoryRatingStore) Add(laptopID string, score float64) (*Rating, error) {
+func (store *InMemoryRatingStore) Add(laptopID string, userName string, score float64) (*Rating, error) {
 	store.mutex.Lock()
 	defer store.mutex.Unlock()
 
-	rating := store.data[laptopID]
+	rating, _ := store.put(&UserRating{
+		LaptopID: laptopID,
+		UserName: userName,
+		Score:    score,
+		RatedAt:  time.Now(),
+	})
+	return rating, nil
+}
+
+// put must be called with the mutex held. It returns the new aggregate and the rating it replaced, if any.
+func (store *InMemoryRatingStore) put(userRating *UserRating) (*Rating, *UserRating) {
+	ratings := store.ratings[userRating.LaptopID]
+	if ratings == nil {
+		ratings = make(map[string]*UserRating)
+		store.ratings[userRating.LaptopID] = ratings
+	}
+
+	rating := store.data[userRating.LaptopID]
 	if rating == nil {
-		rating = &Rating{
-			Count: 1,
-			Sum:   score,
-		}
+		rating = &Rating{}
+		store.data[userRating.LaptopID] = rating
+	}
+
+	previous := ratings[userRating.UserName]
+	if previous != nil {
+		rating.Sum += userRating.Score - previous.Score
 	} else {
 		rating.Count++
-		rating.Sum += score
+		rating.Sum += userRating.Score
 	}
 
-	store.data[laptopID] = rating
-	return rating, nil
+	other := *userRating
+	ratings[userRating.UserName] = &other
+
+	aggregate := *rating
+	return &aggregate, previous
+}
+
+func (store *InMemoryRatingStore) Remove(laptopID string, userName string) (*Rating, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	rating, _, err := store.remove(laptopID, userName)
+	return rating, err
+}
+
+// remove must be called with the mutex held. It returns the new aggregate and the removed rating.
+func (store *InMemoryRatingStore) remove(laptopID string, userName string) (*Rating, *UserRating, error) {
+	previous := store.ratings[laptopID][userName]
+	if previous == nil {
+		return nil, nil, ErrRatingNotFound
+	}
+	delete(store.ratings[laptopID], userName)
+
+	rating := store.data[laptopID]
+	rating.Count--
+	rating.Sum -= previous.Score
+	if rating.Count == 0 {
+		// avoid carrying floating point residue into the next rating
+		rating.Sum = 0
+	}
+
+	aggregate := *rating
+	return &aggregate, previous, nil
+}
+
+func (store *InMemoryRatingStore) RemoveLaptop(laptopID string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.removeLaptop(laptopID)
+	return nil
+}
+
+// removeLaptop must be called with the mutex held. It returns the removed ratings.
+func (store *InMemoryRatingStore) removeLaptop(laptopID string) map[string]*UserRating {
+	removed := store.ratings[laptopID]
+	delete(store.ratings, laptopID)
+	delete(store.data, laptopID)
+	return removed
+}
+
+func (store *InMemoryRatingStore) FindByUser(userName string) ([]*UserRating, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	ratings := []*UserRating{}
+	for _, laptopRatings := range store.ratings {
+		rating := laptopRatings[userName]
+		if rating == nil {
+			continue
+		}
+		other := *rating
+		ratings = append(ratings, &other)
+	}
+
+	sort.Slice(ratings, func(i, j int) bool {
+		return ratings[i].LaptopID < ratings[j].LaptopID
+	})
+
+	return ratings, nil
+}
+
+func (store *InMemoryRatingStore) FindByLaptop(laptopID string) ([]*UserRating, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	ratings := make([]*UserRating, 0, len(store.ratings[laptopID]))
+	for _, rating := range store.ratings[laptopID] {
+		other := *rating
+		ratings = append(ratings, &other)
+	}
+
+	sort.Slice(ratings, func(i, j int) bool {
+		return ratings[i].UserName < ratings[j].UserName
+	})
+
+	return ratings, nil
+}
+
+// all must be called with the mutex held.
+func (store *InMemoryRatingStore) all() []*UserRating {
+	ratings := []*UserRating{}
+	for _, laptopRatings := range store.ratings {
+		for _, rating := range laptopRatings {
+			ratings = append(ratings, rating)
+		}
+	}
+	return ratings
 }
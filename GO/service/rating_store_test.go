@@ -0,0 +1,99 @@
+package service_test
+
+import (
+	"path/filepath"
+	"pcbook/service"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileRatingStore(t *testing.T) {
+	t.Parallel()
+
+	filename := filepath.Join(t.TempDir(), "ratings.pb")
+
+	store, err := service.NewFileRatingStore(filename)
+	require.NoError(t, err)
+
+	_, err = store.Add("laptop-1", "user1", 8)
+	require.NoError(t, err)
+	_, err = store.Add("laptop-1", "user2", 6)
+	require.NoError(t, err)
+	_, err = store.Add("laptop-2", "user1", 9)
+	require.NoError(t, err)
+
+	rating, err := store.Add("laptop-1", "user1", 10)
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), rating.Count)
+	require.Equal(t, 8.0, rating.Average())
+
+	rating, err = store.Remove("laptop-2", "user1")
+	require.NoError(t, err)
+	require.Equal(t, uint32(0), rating.Count)
+
+	reloaded, err := service.NewFileRatingStore(filename)
+	require.NoError(t, err)
+
+	scores, err := laptopScores(reloaded, "laptop-1")
+	require.NoError(t, err)
+	require.Equal(t, []float64{10, 6}, scores)
+
+	ratings, err := reloaded.FindByUser("user1")
+	require.NoError(t, err)
+	require.Len(t, ratings, 1)
+	require.False(t, ratings[0].RatedAt.IsZero())
+
+	rating, err = reloaded.Add("laptop-1", "user3", 5)
+	require.NoError(t, err)
+	require.Equal(t, uint32(3), rating.Count)
+	require.Equal(t, 7.0, rating.Average())
+
+	require.NoError(t, reloaded.RemoveLaptop("laptop-1"))
+	reloaded, err = service.NewFileRatingStore(filename)
+	require.NoError(t, err)
+	scores, err = laptopScores(reloaded, "laptop-1")
+	require.NoError(t, err)
+	require.Empty(t, scores)
+}
+
+func TestDecayedAverage(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	halfLife := 30 * 24 * time.Hour
+
+	ratings := []*service.UserRating{
+		{Score: 10, RatedAt: now},
+		{Score: 4, RatedAt: now.Add(-halfLife)},
+		{Score: 1, RatedAt: now.Add(-100 * halfLife)},
+	}
+
+	average := service.DecayedAverage(ratings, halfLife, now)
+	require.InDelta(t, (10+0.5*4)/1.5, average, 1e-6)
+
+	require.Equal(t, 0.0, service.DecayedAverage(nil, halfLife, now))
+
+	// ratings thousands of half-lives old still average, rather than all weighing 0
+	old := now.Add(-4000 * 24 * time.Hour)
+	ratings = []*service.UserRating{
+		{Score: 9, RatedAt: old},
+		{Score: 7, RatedAt: old.Add(-24 * time.Hour)},
+	}
+	average = service.DecayedAverage(ratings, 24*time.Hour, now)
+	require.InDelta(t, (9+0.5*7)/1.5, average, 1e-6)
+}
+
+func laptopScores(store service.RatingStore, laptopID string) ([]float64, error) {
+	ratings, err := store.FindByLaptop(laptopID)
+	if err != nil {
+		return nil, err
+	}
+
+	scores := make([]float64, len(ratings))
+	for i, rating := range ratings {
+		scores[i] = rating.Score
+	}
+	return scores, nil
+}
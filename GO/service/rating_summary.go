@@ -0,0 +1,121 @@
+package service
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// RatingPrior damps the average of laptops with few ratings towards Mean,
+// as if every laptop had already received Weight ratings of Mean.
+type RatingPrior struct {
+	Mean   float64
+	Weight float64
+}
+
+var DefaultRatingPrior = RatingPrior{
+	Mean:   5.5,
+	Weight: 10,
+}
+
+type ScoreBucket struct {
+	MinScore float64
+	MaxScore float64
+	Count    uint32
+}
+
+type RatingSummary struct {
+	Count           uint32
+	Average         float64
+	Median          float64
+	StdDev          float64
+	BayesianAverage float64
+	// Histogram holds the non-empty buckets of width 1, ordered by score.
+	Histogram []ScoreBucket
+}
+
+// SummarizeRatings computes the statistics of a laptop's scores.
+func SummarizeRatings(scores []float64, prior RatingPrior) *RatingSummary {
+	summary := &RatingSummary{
+		Count:           uint32(len(scores)),
+		BayesianAverage: prior.Mean,
+	}
+
+	n := len(scores)
+	if n == 0 {
+		return summary
+	}
+
+	sorted := make([]float64, n)
+	copy(sorted, scores)
+	sort.Float64s(sorted)
+
+	sum := 0.0
+	for _, score := range sorted {
+		sum += score
+
+		bucket := math.Floor(score)
+		last := len(summary.Histogram) - 1
+		if last >= 0 && summary.Histogram[last].MinScore == bucket {
+			summary.Histogram[last].Count++
+		} else {
+			summary.Histogram = append(summary.Histogram, ScoreBucket{
+				MinScore: bucket,
+				MaxScore: bucket + 1,
+				Count:    1,
+			})
+		}
+	}
+
+	summary.Average = sum / float64(n)
+
+	if n%2 == 1 {
+		summary.Median = sorted[n/2]
+	} else {
+		summary.Median = (sorted[n/2-1] + sorted[n/2]) / 2
+	}
+
+	variance := 0.0
+	for _, score := range sorted {
+		variance += (score - summary.Average) * (score - summary.Average)
+	}
+	summary.StdDev = math.Sqrt(variance / float64(n))
+
+	summary.BayesianAverage = (prior.Weight*prior.Mean + sum) / (prior.Weight + float64(n))
+
+	return summary
+}
+
+// DecayedAverage weighs every score by 0.5^(age/halfLife),
+// so a rating given halfLife ago counts half as much as one given now.
+// The ages are measured from the newest rating: scaling every weight alike doesn't change the average,
+// and the newest rating weighing 1 keeps the weights of old ratings from all underflowing to 0.
+func DecayedAverage(ratings []*UserRating, halfLife time.Duration, now time.Time) float64 {
+	newest := time.Time{}
+	for _, rating := range ratings {
+		if rating.RatedAt.After(newest) {
+			newest = rating.RatedAt
+		}
+	}
+	if newest.After(now) {
+		newest = now
+	}
+
+	sum := 0.0
+	weights := 0.0
+	for _, rating := range ratings {
+		age := newest.Sub(rating.RatedAt)
+		if age < 0 {
+			age = 0
+		}
+
+		weight := math.Pow(0.5, float64(age)/float64(halfLife))
+		sum += weight * rating.Score
+		weights += weight
+	}
+
+	if weights == 0 {
+		return 0
+	}
+	return sum / weights
+}
@@ -0,0 +1,36 @@
+package service_test
+
+import (
+	"pcbook/service"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSummarizeRatings(t *testing.T) {
+	t.Parallel()
+
+	prior := service.RatingPrior{Mean: 5, Weight: 2}
+
+	summary := service.SummarizeRatings(nil, prior)
+	require.Equal(t, uint32(0), summary.Count)
+	require.Equal(t, 5.0, summary.BayesianAverage)
+	require.Empty(t, summary.Histogram)
+
+	summary = service.SummarizeRatings([]float64{9, 2, 4, 4, 5, 5, 7, 4.5}, prior)
+	require.Equal(t, uint32(8), summary.Count)
+	require.Equal(t, 5.0625, summary.Average)
+	require.Equal(t, 4.75, summary.Median)
+	require.InDelta(t, 1.9754, summary.StdDev, 1e-4)
+	require.Equal(t, (2*5+40.5)/10, summary.BayesianAverage)
+	require.Equal(t, []service.ScoreBucket{
+		{MinScore: 2, MaxScore: 3, Count: 1},
+		{MinScore: 4, MaxScore: 5, Count: 3},
+		{MinScore: 5, MaxScore: 6, Count: 2},
+		{MinScore: 7, MaxScore: 8, Count: 1},
+		{MinScore: 9, MaxScore: 10, Count: 1},
+	}, summary.Histogram)
+
+	summary = service.SummarizeRatings([]float64{3, 1, 2}, prior)
+	require.Equal(t, 2.0, summary.Median)
+}
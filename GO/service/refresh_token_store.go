@@ -0,0 +1,103 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrRefreshTokenNotFound = errors.New("refresh token not found")
+
+// RefreshToken is a long-lived session issued at login. Only the hash of the token is stored.
+type RefreshToken struct {
+	Hash      string
+	UserName  string
+	ExpiresAt time.Time
+	// AccessTokenID is the jti of the access token issued with this refresh token
+	AccessTokenID      string
+	AccessTokenExpires time.Time
+}
+
+type RefreshTokenStore interface {
+	// Save stores a refresh token
+	Save(token *RefreshToken) error
+	// Take removes the refresh token with the given hash and returns it, so each token can be used only once
+	Take(hash string) (*RefreshToken, error)
+	// TakeUser removes every refresh token of the user and returns them
+	TakeUser(userName string) ([]*RefreshToken, error)
+}
+
+type InMemoryRefreshTokenStore struct {
+	mutex  sync.Mutex
+	tokens map[string]*RefreshToken
+}
+
+func NewInMemoryRefreshTokenStore() *InMemoryRefreshTokenStore {
+	return &InMemoryRefreshTokenStore{
+		tokens: make(map[string]*RefreshToken),
+	}
+}
+
+func (store *InMemoryRefreshTokenStore) Save(token *RefreshToken) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	now := time.Now()
+	for hash, other := range store.tokens {
+		if !now.Before(other.ExpiresAt) {
+			delete(store.tokens, hash)
+		}
+	}
+
+	other := *token
+	store.tokens[token.Hash] = &other
+	return nil
+}
+
+func (store *InMemoryRefreshTokenStore) Take(hash string) (*RefreshToken, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	token := store.tokens[hash]
+	if token == nil {
+		return nil, ErrRefreshTokenNotFound
+	}
+
+	delete(store.tokens, hash)
+	return token, nil
+}
+
+func (store *InMemoryRefreshTokenStore) TakeUser(userName string) ([]*RefreshToken, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	tokens := []*RefreshToken{}
+	for hash, token := range store.tokens {
+		if token.UserName == userName {
+			tokens = append(tokens, token)
+			delete(store.tokens, hash)
+		}
+	}
+	return tokens, nil
+}
+
+// newRefreshToken returns a random opaque token and the hash it is stored under.
+func newRefreshToken() (string, string, error) {
+	data := make([]byte, 32)
+	_, err := rand.Read(data)
+	if err != nil {
+		return "", "", err
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(data)
+	return token, hashRefreshToken(token), nil
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,152 @@
+package service_test
+
+import (
+	pb "pcbook/generateProto"
+	"pcbook/sample"
+	"pcbook/service"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestClientReviews(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	ratingStore := service.NewInMemoryRatingStore()
+
+	laptop := sample.NewLaptop()
+	err := laptopStore.Save(laptop)
+	require.NoError(t, err)
+
+	serverAddress := startTestServer(t, withLaptopStore(laptopStore), withRatingStore(ratingStore))
+	reviewClient := newTestReviewClient(t, serverAddress)
+
+	userCtx := contextWithTestUser(t, "user1", "user")
+	adminCtx := contextWithTestUser(t, "admin1", "admin")
+
+	_, err = reviewClient.SubmitReview(userCtx, &pb.SubmitReviewRequest{
+		LaptopId: laptop.Id,
+		Title:    "great",
+		Body:     "fast and light",
+		Score:    11,
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = reviewClient.SubmitReview(userCtx, &pb.SubmitReviewRequest{
+		LaptopId: sample.RandomID(),
+		Title:    "great",
+		Body:     "fast and light",
+		Score:    9,
+	})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	reviewIDs := []string{}
+	for _, userName := range []string{"user1", "user2", "user3"} {
+		res, err := reviewClient.SubmitReview(contextWithTestUser(t, userName, "user"), &pb.SubmitReviewRequest{
+			LaptopId: laptop.Id,
+			Title:    "review by " + userName,
+			Body:     "fast and light",
+			Score:    8,
+		})
+		require.NoError(t, err)
+		require.Equal(t, pb.Review_PENDING, res.GetReview().GetStatus())
+		require.Equal(t, userName, res.GetReview().GetUserName())
+		reviewIDs = append(reviewIDs, res.GetReview().GetId())
+	}
+
+	// the review is linked to the user's rating
+	res, err := reviewClient.SubmitReview(userCtx, &pb.SubmitReviewRequest{
+		LaptopId: laptop.Id,
+		Title:    "changed my mind",
+		Body:     "battery is bad",
+		Score:    4,
+	})
+	require.NoError(t, err)
+	require.Equal(t, reviewIDs[0], res.GetReview().GetId())
+
+	scores, err := laptopScores(ratingStore, laptop.Id)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []float64{4, 8, 8}, scores)
+
+	list, err := reviewClient.ListReviews(userCtx, &pb.ListReviewsRequest{LaptopId: laptop.Id})
+	require.NoError(t, err)
+	require.Empty(t, list.GetReviews())
+
+	_, err = reviewClient.ModerateReview(userCtx, &pb.ModerateReviewRequest{
+		ReviewId: reviewIDs[0],
+		Action:   pb.ModerateReviewRequest_APPROVE,
+	})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = reviewClient.ModerateReview(adminCtx, &pb.ModerateReviewRequest{
+		ReviewId: sample.RandomID(),
+		Action:   pb.ModerateReviewRequest_APPROVE,
+	})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	actions := []pb.ModerateReviewRequest_Action{
+		pb.ModerateReviewRequest_APPROVE,
+		pb.ModerateReviewRequest_REJECT,
+		pb.ModerateReviewRequest_APPROVE,
+	}
+	for i, action := range actions {
+		_, err := reviewClient.ModerateReview(adminCtx, &pb.ModerateReviewRequest{
+			ReviewId: reviewIDs[i],
+			Action:   action,
+		})
+		require.NoError(t, err)
+	}
+
+	list, err = reviewClient.ListReviews(userCtx, &pb.ListReviewsRequest{LaptopId: laptop.Id, PageSize: 1})
+	require.NoError(t, err)
+	require.Len(t, list.GetReviews(), 1)
+	require.Equal(t, reviewIDs[0], list.GetReviews()[0].GetId())
+	require.NotEmpty(t, list.GetNextPageToken())
+
+	list, err = reviewClient.ListReviews(userCtx, &pb.ListReviewsRequest{
+		LaptopId:  laptop.Id,
+		PageSize:  1,
+		PageToken: list.GetNextPageToken(),
+	})
+	require.NoError(t, err)
+	require.Len(t, list.GetReviews(), 1)
+	require.Equal(t, reviewIDs[2], list.GetReviews()[0].GetId())
+	require.Empty(t, list.GetNextPageToken())
+
+	list, err = reviewClient.ListReviews(adminCtx, &pb.ListReviewsRequest{LaptopId: laptop.Id})
+	require.NoError(t, err)
+	require.Len(t, list.GetReviews(), 3)
+
+	list, err = reviewClient.ListReviews(adminCtx, &pb.ListReviewsRequest{
+		LaptopId: laptop.Id,
+		Statuses: []pb.Review_Status{pb.Review_REJECTED},
+	})
+	require.NoError(t, err)
+	require.Len(t, list.GetReviews(), 1)
+	require.Equal(t, reviewIDs[1], list.GetReviews()[0].GetId())
+
+	// the score of a review follows its author's rating, once retracted or changed
+	_, err = ratingStore.Remove(laptop.Id, "user1")
+	require.NoError(t, err)
+	_, err = ratingStore.Add(laptop.Id, "user3", 6)
+	require.NoError(t, err)
+
+	list, err = reviewClient.ListReviews(adminCtx, &pb.ListReviewsRequest{LaptopId: laptop.Id})
+	require.NoError(t, err)
+	listedScores := []float64{}
+	for _, review := range list.GetReviews() {
+		listedScores = append(listedScores, review.GetScore())
+	}
+	require.Equal(t, []float64{0, 8, 6}, listedScores)
+}
+
+func newTestReviewClient(t *testing.T, serverAddress string) pb.ReviewServiceClient {
+	conn, err := grpc.Dial(serverAddress, grpc.WithInsecure())
+	require.NoError(t, err, "cannot connect to test review server")
+
+	return pb.NewReviewServiceClient(conn)
+}
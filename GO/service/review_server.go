@@ -0,0 +1,196 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	pb "pcbook/generateProto"
+	"strconv"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	maxReviewTitleLength  = 200
+	maxReviewBodyLength   = 10000
+	defaultReviewPageSize = 10
+	maxReviewPageSize     = 100
+)
+
+type ReviewServer struct {
+	pb.UnimplementedReviewServiceServer
+	reviewStore ReviewStore
+	laptopStore LaptopStore
+	ratingStore RatingStore
+	scoreRange  ScoreRange
+}
+
+func NewReviewServer(
+	reviewStore ReviewStore,
+	laptopStore LaptopStore,
+	ratingStore RatingStore,
+	scoreRange ScoreRange,
+) *ReviewServer {
+	return &ReviewServer{
+		reviewStore: reviewStore,
+		laptopStore: laptopStore,
+		ratingStore: ratingStore,
+		scoreRange:  scoreRange,
+	}
+}
+
+func (server *ReviewServer) SubmitReview(
+	ctx context.Context,
+	req *pb.SubmitReviewRequest,
+) (*pb.SubmitReviewResponse, error) {
+	claims, ok := ClaimsFromContext(ctx)
+	if !ok {
+		return nil, logError(status.Errorf(codes.Unauthenticated, "reviews require an authenticated user"))
+	}
+
+	laptopID := req.GetLaptopId()
+	score := req.GetScore()
+	log.Printf("receive a submit-review request for laptop %s from user %s", laptopID, claims.UserName)
+
+	if len(req.GetTitle()) == 0 || len(req.GetTitle()) > maxReviewTitleLength {
+		return nil, logError(status.Errorf(codes.InvalidArgument, "title must have 1 to %d characters", maxReviewTitleLength))
+	}
+	if len(req.GetBody()) == 0 || len(req.GetBody()) > maxReviewBodyLength {
+		return nil, logError(status.Errorf(codes.InvalidArgument, "body must have 1 to %d characters", maxReviewBodyLength))
+	}
+	if !server.scoreRange.Contains(score) {
+		return nil, logError(status.Errorf(codes.InvalidArgument,
+			"score %v is not between %v and %v", score, server.scoreRange.Min, server.scoreRange.Max))
+	}
+
+	laptop, err := server.laptopStore.Find(laptopID)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot find laptop: %v", err))
+	}
+	if laptop == nil {
+		return nil, logError(status.Errorf(codes.NotFound, "laptop id %s doesn't exist", laptopID))
+	}
+
+	// the review score is the user's rating of the laptop
+	_, err = server.ratingStore.Add(laptopID, claims.UserName, score)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot add rating to store: %v", err))
+	}
+
+	review, err := server.reviewStore.Save(&pb.Review{
+		LaptopId: laptopID,
+		UserName: claims.UserName,
+		Title:    req.GetTitle(),
+		Body:     req.GetBody(),
+		Score:    score,
+	})
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot save review: %v", err))
+	}
+
+	return &pb.SubmitReviewResponse{Review: review}, nil
+}
+
+func (server *ReviewServer) ListReviews(
+	ctx context.Context,
+	req *pb.ListReviewsRequest,
+) (*pb.ListReviewsResponse, error) {
+	claims, ok := ClaimsFromContext(ctx)
+	if !ok {
+		return nil, logError(status.Errorf(codes.Unauthenticated, "reviews require an authenticated user"))
+	}
+
+	statuses := req.GetStatuses()
+	if !claims.HasScope(ScopeReviewsModerate) {
+		statuses = []pb.Review_Status{pb.Review_APPROVED}
+	}
+
+	pageSize := int(req.GetPageSize())
+	if pageSize == 0 {
+		pageSize = defaultReviewPageSize
+	}
+	if pageSize > maxReviewPageSize {
+		pageSize = maxReviewPageSize
+	}
+
+	offset := 0
+	if len(req.GetPageToken()) > 0 {
+		var err error
+		offset, err = strconv.Atoi(req.GetPageToken())
+		if err != nil || offset < 0 {
+			return nil, logError(status.Errorf(codes.InvalidArgument, "invalid page token: %s", req.GetPageToken()))
+		}
+	}
+
+	reviews, more, err := server.reviewStore.List(req.GetLaptopId(), statuses, offset, pageSize)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot list reviews: %v", err))
+	}
+	err = server.currentScores(req.GetLaptopId(), reviews...)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &pb.ListReviewsResponse{
+		Reviews: reviews,
+	}
+	if more {
+		res.NextPageToken = strconv.Itoa(offset + len(reviews))
+	}
+
+	return res, nil
+}
+
+func (server *ReviewServer) ModerateReview(
+	ctx context.Context,
+	req *pb.ModerateReviewRequest,
+) (*pb.ModerateReviewResponse, error) {
+	log.Printf("receive a moderate-review request for review %s: %v", req.GetReviewId(), req.GetAction())
+
+	var reviewStatus pb.Review_Status
+	switch req.GetAction() {
+	case pb.ModerateReviewRequest_APPROVE:
+		reviewStatus = pb.Review_APPROVED
+	case pb.ModerateReviewRequest_REJECT:
+		reviewStatus = pb.Review_REJECTED
+	case pb.ModerateReviewRequest_FLAG:
+		reviewStatus = pb.Review_FLAGGED
+	default:
+		return nil, logError(status.Errorf(codes.InvalidArgument, "unknown moderation action: %v", req.GetAction()))
+	}
+
+	review, err := server.reviewStore.SetStatus(req.GetReviewId(), reviewStatus)
+	if err != nil {
+		code := codes.Internal
+		if errors.Is(err, ErrReviewNotFound) {
+			code = codes.NotFound
+		}
+		return nil, logError(status.Errorf(code, "cannot moderate review: %v", err))
+	}
+	err = server.currentScores(review.GetLaptopId(), review)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.ModerateReviewResponse{Review: review}, nil
+}
+
+// currentScores sets the score of each review of the laptop to its author's current rating,
+// which RateLaptop may have changed and RetractRating removed since the review was submitted.
+// The score of a review whose rating was retracted is 0.
+func (server *ReviewServer) currentScores(laptopID string, reviews ...*pb.Review) error {
+	ratings, err := server.ratingStore.FindByLaptop(laptopID)
+	if err != nil {
+		return logError(status.Errorf(codes.Internal, "cannot find ratings: %v", err))
+	}
+
+	scores := make(map[string]float64, len(ratings))
+	for _, rating := range ratings {
+		scores[rating.UserName] = rating.Score
+	}
+	for _, review := range reviews {
+		review.Score = scores[review.GetUserName()]
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	pb "pcbook/generateProto"
+	"sync"
+
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var ErrReviewNotFound = errors.New("review not found")
+
+type ReviewStore interface {
+	// Save stores a user's review of a laptop, replacing the review the user wrote before.
+	// A saved review always goes back to pending moderation.
+	Save(review *pb.Review) (*pb.Review, error)
+	Find(id string) (*pb.Review, error)
+	// List returns up to limit reviews of a laptop in the order they were first submitted,
+	// starting at offset, and whether there are more reviews after them.
+	// An empty statuses slice matches every status.
+	List(laptopID string, statuses []pb.Review_Status, offset int, limit int) ([]*pb.Review, bool, error)
+	SetStatus(id string, status pb.Review_Status) (*pb.Review, error)
+}
+
+type InMemoryReviewStore struct {
+	mutex    sync.RWMutex
+	data     map[string]*pb.Review
+	byLaptop map[string][]string
+	byUser   map[string]string
+}
+
+func NewInMemoryReviewStore() *InMemoryReviewStore {
+	return &InMemoryReviewStore{
+		data:     make(map[string]*pb.Review),
+		byLaptop: make(map[string][]string),
+		byUser:   make(map[string]string),
+	}
+}
+
+func (store *InMemoryReviewStore) Save(review *pb.Review) (*pb.Review, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	other := proto.Clone(review).(*pb.Review)
+	other.Status = pb.Review_PENDING
+	other.UpdatedAt = timestamppb.Now()
+
+	userKey := other.GetLaptopId() + "/" + other.GetUserName()
+	if id, ok := store.byUser[userKey]; ok {
+		previous := store.data[id]
+		other.Id = previous.GetId()
+		other.CreatedAt = previous.GetCreatedAt()
+	} else {
+		id, err := uuid.NewRandom()
+		if err != nil {
+			return nil, fmt.Errorf("cannot generate review ID: %w", err)
+		}
+		other.Id = id.String()
+		other.CreatedAt = other.UpdatedAt
+
+		store.byUser[userKey] = other.Id
+		store.byLaptop[other.GetLaptopId()] = append(store.byLaptop[other.GetLaptopId()], other.Id)
+	}
+
+	store.data[other.Id] = other
+	return proto.Clone(other).(*pb.Review), nil
+}
+
+func (store *InMemoryReviewStore) Find(id string) (*pb.Review, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	review := store.data[id]
+	if review == nil {
+		return nil, nil
+	}
+
+	return proto.Clone(review).(*pb.Review), nil
+}
+
+func (store *InMemoryReviewStore) List(
+	laptopID string,
+	statuses []pb.Review_Status,
+	offset int,
+	limit int,
+) ([]*pb.Review, bool, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	reviews := []*pb.Review{}
+	skipped := 0
+	for _, id := range store.byLaptop[laptopID] {
+		review := store.data[id]
+		if !hasStatus(review, statuses) {
+			continue
+		}
+
+		if skipped < offset {
+			skipped++
+			continue
+		}
+
+		if len(reviews) == limit {
+			return reviews, true, nil
+		}
+		reviews = append(reviews, proto.Clone(review).(*pb.Review))
+	}
+
+	return reviews, false, nil
+}
+
+func (store *InMemoryReviewStore) SetStatus(id string, status pb.Review_Status) (*pb.Review, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	review := store.data[id]
+	if review == nil {
+		return nil, ErrReviewNotFound
+	}
+
+	review.Status = status
+	review.UpdatedAt = timestamppb.Now()
+	return proto.Clone(review).(*pb.Review), nil
+}
+
+func hasStatus(review *pb.Review, statuses []pb.Review_Status) bool {
+	if len(statuses) == 0 {
+		return true
+	}
+
+	for _, status := range statuses {
+		if review.GetStatus() == status {
+			return true
+		}
+	}
+	return false
+}
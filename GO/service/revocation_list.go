@@ -0,0 +1,43 @@
+package service
+
+import (
+	"sync"
+	"time"
+)
+
+// RevocationList keeps the ids of revoked tokens until they would have expired anyway.
+type RevocationList struct {
+	mutex   sync.Mutex
+	revoked map[string]time.Time
+}
+
+func NewRevocationList() *RevocationList {
+	return &RevocationList{
+		revoked: make(map[string]time.Time),
+	}
+}
+
+func (list *RevocationList) Revoke(tokenID string, expiresAt time.Time) {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+
+	list.prune(time.Now())
+	list.revoked[tokenID] = expiresAt
+}
+
+func (list *RevocationList) IsRevoked(tokenID string) bool {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+
+	_, ok := list.revoked[tokenID]
+	return ok
+}
+
+// prune drops the ids of tokens that have expired, since verification rejects them anyway.
+func (list *RevocationList) prune(now time.Time) {
+	for tokenID, expiresAt := range list.revoked {
+		if !now.Before(expiresAt) {
+			delete(list.revoked, tokenID)
+		}
+	}
+}
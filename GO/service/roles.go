@@ -0,0 +1,138 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Permission scopes required by the RPCs, as declared in their auth policies.
+const (
+	ScopeLaptopsWrite    = "laptops:write"
+	ScopeLaptopsAdmin    = "laptops:admin"
+	ScopeImagesWrite     = "images:write"
+	ScopeRatingsRead     = "ratings:read"
+	ScopeRatingsWrite    = "ratings:write"
+	ScopeReviewsRead     = "reviews:read"
+	ScopeReviewsWrite    = "reviews:write"
+	ScopeReviewsModerate = "reviews:moderate"
+	ScopeAccountWrite    = "account:write"
+	ScopeUsersAdmin      = "users:admin"
+	ScopeAuditRead       = "audit:read"
+)
+
+// RoleDefinition grants scopes to a role, in addition to the scopes of the roles it inherits.
+type RoleDefinition struct {
+	Inherits []string `json:"inherits"`
+	Scopes   []string `json:"scopes"`
+}
+
+// Roles maps each role to the scopes it grants.
+type Roles struct {
+	scopes map[string][]string
+}
+
+// DefaultRoles lets users rate and review laptops, vendors also manage their own laptops,
+// and admins manage every laptop and the accounts, and read the audit log.
+var DefaultRoles = mustNewRoles(map[string]RoleDefinition{
+	UserRole: {
+		Scopes: []string{
+			ScopeRatingsRead,
+			ScopeRatingsWrite,
+			ScopeReviewsRead,
+			ScopeReviewsWrite,
+			ScopeAccountWrite,
+		},
+	},
+	VendorRole: {
+		Inherits: []string{UserRole},
+		Scopes: []string{
+			ScopeLaptopsWrite,
+			ScopeImagesWrite,
+		},
+	},
+	AdminRole: {
+		Inherits: []string{VendorRole},
+		Scopes: []string{
+			ScopeLaptopsAdmin,
+			ScopeReviewsModerate,
+			ScopeUsersAdmin,
+			ScopeAuditRead,
+		},
+	},
+})
+
+// NewRoles resolves the inherited scopes of every role.
+// It fails if a role inherits an unknown role or inherits from itself.
+func NewRoles(definitions map[string]RoleDefinition) (*Roles, error) {
+	roles := &Roles{
+		scopes: make(map[string][]string),
+	}
+
+	for name := range definitions {
+		scopes := make(map[string]bool)
+		err := collectScopes(definitions, name, scopes, map[string]bool{})
+		if err != nil {
+			return nil, err
+		}
+
+		roles.scopes[name] = make([]string, 0, len(scopes))
+		for scope := range scopes {
+			roles.scopes[name] = append(roles.scopes[name], scope)
+		}
+		sort.Strings(roles.scopes[name])
+	}
+
+	return roles, nil
+}
+
+func mustNewRoles(definitions map[string]RoleDefinition) *Roles {
+	roles, err := NewRoles(definitions)
+	if err != nil {
+		panic(err)
+	}
+	return roles
+}
+
+func collectScopes(definitions map[string]RoleDefinition, name string, scopes map[string]bool, visiting map[string]bool) error {
+	definition, ok := definitions[name]
+	if !ok {
+		return fmt.Errorf("unknown role: %s", name)
+	}
+	if visiting[name] {
+		return fmt.Errorf("role %s inherits from itself", name)
+	}
+	visiting[name] = true
+	defer delete(visiting, name)
+
+	for _, scope := range definition.Scopes {
+		scopes[scope] = true
+	}
+	for _, parent := range definition.Inherits {
+		err := collectScopes(definitions, parent, scopes, visiting)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Has reports whether the role is defined.
+func (roles *Roles) Has(role string) bool {
+	_, ok := roles.scopes[role]
+	return ok
+}
+
+// Scopes returns the scopes granted to the role, including the inherited ones.
+func (roles *Roles) Scopes(role string) []string {
+	return append([]string(nil), roles.scopes[role]...)
+}
+
+// Names returns the defined roles in alphabetical order.
+func (roles *Roles) Names() []string {
+	names := make([]string, 0, len(roles.scopes))
+	for name := range roles.scopes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
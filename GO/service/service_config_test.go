@@ -0,0 +1,268 @@
+package service_test
+
+import (
+	"context"
+	"math"
+	"path"
+	"pcbook/client"
+	"pcbook/sample"
+	"pcbook/service"
+	"sync"
+	"testing"
+	"time"
+
+	pb "pcbook/generateProto"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestServiceConfigRetries(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	stored := sample.NewLaptop()
+	require.NoError(t, laptopStore.Save(stored))
+
+	faults := newFaultInjector(map[string]fault{
+		"CreateLaptop": {failures: 1, afterHandler: true},
+		"GetLaptop":    {failures: 2},
+		"SearchLaptop": {failures: 2},
+		"DeleteLaptop": {failures: 1},
+	})
+	pcbook, err := client.New(startTestServer(t, withLaptopStore(laptopStore), withFaults(faults), withoutAuth()),
+		client.WithDialOptions(grpc.WithInsecure()),
+	)
+	require.NoError(t, err)
+	defer pcbook.Close()
+	ctx := context.Background()
+
+	// the laptop was saved but the answer was lost, the retry finds it saved under the generated ID
+	laptop := sample.NewLaptop()
+	laptop.Id = ""
+	id, err := pcbook.Laptop().CreateLaptop(ctx, laptop)
+	require.NoError(t, err)
+	require.NotEmpty(t, id)
+	require.Empty(t, laptop.Id)
+	require.Equal(t, 2, faults.callCount("CreateLaptop"))
+	_, err = laptopStore.Find(id)
+	require.NoError(t, err)
+
+	found, err := pcbook.Laptop().GetLaptop(ctx, stored.Id)
+	require.NoError(t, err)
+	require.Equal(t, stored.Id, found.Id)
+	require.Equal(t, 3, faults.callCount("GetLaptop"))
+
+	it, err := pcbook.Laptop().SearchLaptop(ctx, &pb.Filter{MaxPriceUsd: math.MaxFloat64})
+	require.NoError(t, err)
+	laptops, err := it.All()
+	require.NoError(t, err)
+	require.Len(t, laptops, 2)
+	require.Equal(t, 3, faults.callCount("SearchLaptop"))
+
+	// deleting isn't retried
+	err = pcbook.Laptop().DeleteLaptop(ctx, stored.Id)
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	require.Equal(t, 1, faults.callCount("DeleteLaptop"))
+}
+
+func TestServiceConfigOverride(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	stored := sample.NewLaptop()
+	require.NoError(t, laptopStore.Save(stored))
+
+	faults := newFaultInjector(map[string]fault{
+		"GetLaptop":    {failures: 1},
+		"SearchLaptop": {stalls: 1},
+	})
+	pcbook, err := client.New(startTestServer(t, withLaptopStore(laptopStore), withFaults(faults), withoutAuth()),
+		client.WithDialOptions(grpc.WithInsecure()),
+		client.WithServiceConfig(client.ServiceConfig{
+			MaxAttempts: 1,
+			Methods: map[string]client.MethodConfig{
+				"SearchLaptop": {Timeout: 100 * time.Millisecond},
+			},
+		}),
+	)
+	require.NoError(t, err)
+	defer pcbook.Close()
+	ctx := context.Background()
+
+	_, err = pcbook.Laptop().GetLaptop(ctx, stored.Id)
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	require.Equal(t, 1, faults.callCount("GetLaptop"))
+
+	start := time.Now()
+	it, err := pcbook.Laptop().SearchLaptop(ctx, &pb.Filter{MaxPriceUsd: math.MaxFloat64})
+	require.NoError(t, err)
+	_, err = it.All()
+	require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	require.Less(t, time.Since(start), time.Second)
+}
+
+func TestServiceConfigHedging(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	stored := sample.NewLaptop()
+	require.NoError(t, laptopStore.Save(stored))
+
+	faults := newFaultInjector(map[string]fault{
+		"GetLaptop":        {stalls: 1},
+		"GetRatingSummary": {failures: 1},
+	})
+	serviceConfig := client.DefaultServiceConfig()
+	serviceConfig.Methods["GetLaptop"] = client.MethodConfig{Timeout: 5 * time.Second, HedgingDelay: 50 * time.Millisecond}
+	serviceConfig.Methods["GetRatingSummary"] = client.MethodConfig{Timeout: 5 * time.Second, HedgingDelay: time.Minute}
+	pcbook, err := client.New(startTestServer(t, withLaptopStore(laptopStore), withFaults(faults), withoutAuth()),
+		client.WithDialOptions(grpc.WithInsecure()),
+		client.WithServiceConfig(serviceConfig),
+	)
+	require.NoError(t, err)
+	defer pcbook.Close()
+	ctx := context.Background()
+
+	// the first attempt hangs, the hedged one answers
+	start := time.Now()
+	found, err := pcbook.Laptop().GetLaptop(ctx, stored.Id)
+	require.NoError(t, err)
+	require.Equal(t, stored.Id, found.Id)
+	require.Less(t, time.Since(start), time.Second)
+	require.Equal(t, 2, faults.callCount("GetLaptop"))
+
+	// a failed attempt is hedged after the backoff, without waiting for the delay
+	_, err = pcbook.Laptop().GetRatingSummary(ctx, stored.Id)
+	require.NoError(t, err)
+	require.Equal(t, 2, faults.callCount("GetRatingSummary"))
+}
+
+func TestServiceConfigHedgingTimeout(t *testing.T) {
+	t.Parallel()
+
+	faults := newFaultInjector(map[string]fault{
+		"GetLaptop":        {stalls: 4},
+		"GetRatingSummary": {failures: 4},
+	})
+	serviceConfig := client.ServiceConfig{
+		MaxAttempts:    4,
+		InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff:     10 * time.Millisecond,
+		Methods: map[string]client.MethodConfig{
+			"GetLaptop":        {Timeout: 300 * time.Millisecond, HedgingDelay: 200 * time.Millisecond},
+			"GetRatingSummary": {Timeout: 5 * time.Second, Retry: true, HedgingDelay: time.Minute},
+		},
+	}
+	// hedged methods aren't retried by gRPC too
+	require.NotContains(t, serviceConfig.JSON(), "retryPolicy")
+
+	pcbook, err := client.New(startTestServer(t, withFaults(faults), withoutAuth()),
+		client.WithDialOptions(grpc.WithInsecure()),
+		client.WithServiceConfig(serviceConfig),
+	)
+	require.NoError(t, err)
+	defer pcbook.Close()
+	ctx := context.Background()
+
+	// the timeout covers every attempt, the second one is sent before it expires, the third one would be after
+	start := time.Now()
+	_, err = pcbook.Laptop().GetLaptop(ctx, sample.RandomID())
+	require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	require.Less(t, time.Since(start), 400*time.Millisecond)
+	require.Equal(t, 2, faults.callCount("GetLaptop"))
+
+	// every attempt fails, each one once the backoff passed
+	_, err = pcbook.Laptop().GetRatingSummary(ctx, sample.RandomID())
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	require.Equal(t, 4, faults.callCount("GetRatingSummary"))
+}
+
+// fault describes how the first calls of a method fail.
+type fault struct {
+	// stalls is the number of first calls blocking until they are cancelled
+	stalls int
+	// failures is the number of calls after them failing with Unavailable
+	failures int
+	// afterHandler fails the calls once the handler ran, as if the answer was lost
+	afterHandler bool
+}
+
+// faultInjector intercepts the calls to a server to make them fail.
+type faultInjector struct {
+	mutex  sync.Mutex
+	faults map[string]fault
+	calls  map[string]int
+}
+
+func newFaultInjector(faults map[string]fault) *faultInjector {
+	return &faultInjector{
+		faults: faults,
+		calls:  make(map[string]int),
+	}
+}
+
+func (injector *faultInjector) callCount(method string) int {
+	injector.mutex.Lock()
+	defer injector.mutex.Unlock()
+	return injector.calls[method]
+}
+
+// inject counts the call and returns whether it fails, before and after its handler.
+func (injector *faultInjector) inject(ctx context.Context, fullMethod string) (before error, after error) {
+	method := path.Base(fullMethod)
+	injector.mutex.Lock()
+	injector.calls[method]++
+	call := injector.calls[method]
+	fault := injector.faults[method]
+	injector.mutex.Unlock()
+
+	if call <= fault.stalls {
+		<-ctx.Done()
+		return status.Error(codes.Canceled, "stalled call is cancelled"), nil
+	}
+	if call > fault.stalls+fault.failures {
+		return nil, nil
+	}
+	unavailable := status.Errorf(codes.Unavailable, "%s is unavailable", method)
+	if fault.afterHandler {
+		return nil, unavailable
+	}
+	return unavailable, nil
+}
+
+func (injector *faultInjector) unary(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	before, after := injector.inject(ctx, info.FullMethod)
+	if before != nil {
+		return nil, before
+	}
+	res, err := handler(ctx, req)
+	if after != nil {
+		return nil, after
+	}
+	return res, err
+}
+
+func (injector *faultInjector) stream(
+	srv interface{},
+	stream grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	before, after := injector.inject(stream.Context(), info.FullMethod)
+	if before != nil {
+		return before
+	}
+	err := handler(srv, stream)
+	if after != nil {
+		return after
+	}
+	return err
+}
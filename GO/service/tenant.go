@@ -0,0 +1,75 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultTenant is the tenant of callers that don't name one, and of tokens issued before tenants existed.
+const DefaultTenant = "default"
+
+var tenantIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// IsValidTenantID reports whether the id can name a tenant. Tenant ids are also folder names.
+func IsValidTenantID(tenantID string) bool {
+	return tenantIDPattern.MatchString(tenantID)
+}
+
+type tenantKey struct{}
+
+func contextWithTenant(ctx context.Context, tenantID string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenantID)
+}
+
+// TenantFromContext returns the tenant of the call, DefaultTenant if none was resolved.
+func TenantFromContext(ctx context.Context) string {
+	tenantID, ok := ctx.Value(tenantKey{}).(string)
+	if !ok || len(tenantID) == 0 {
+		return DefaultTenant
+	}
+	return tenantID
+}
+
+// Tenants holds a separate server, with its own stores, for each tenant,
+// so that no call can reach the data of another tenant.
+type Tenants[S any] struct {
+	servers map[string]S
+}
+
+// NewTenants creates a server for each of the tenants.
+func NewTenants[S any](tenantIDs []string, newServer func(tenantID string) (S, error)) (*Tenants[S], error) {
+	tenants := &Tenants[S]{
+		servers: make(map[string]S),
+	}
+
+	for _, tenantID := range tenantIDs {
+		if !IsValidTenantID(tenantID) {
+			return nil, fmt.Errorf("invalid tenant id: %q", tenantID)
+		}
+		if _, ok := tenants.servers[tenantID]; ok {
+			return nil, fmt.Errorf("duplicate tenant id: %s", tenantID)
+		}
+
+		server, err := newServer(tenantID)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create server of tenant %s: %w", tenantID, err)
+		}
+		tenants.servers[tenantID] = server
+	}
+
+	return tenants, nil
+}
+
+// For returns the server of the tenant of the call.
+func (tenants *Tenants[S]) For(ctx context.Context) (S, error) {
+	tenantID := TenantFromContext(ctx)
+	server, ok := tenants.servers[tenantID]
+	if !ok {
+		return server, logError(status.Errorf(codes.NotFound, "tenant %s doesn't exist", tenantID))
+	}
+	return server, nil
+}
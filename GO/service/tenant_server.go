@@ -0,0 +1,87 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"google.golang.org/grpc"
+)
+
+// RegisterTenantService registers the service described by desc, routing each call to the server
+// of the caller's tenant, e.g. RegisterTenantService(grpcServer, &pb.LaptopService_ServiceDesc, laptopServers).
+// The routing is derived from the generated descriptor, so the methods added to the service are routed too.
+// The tenant is resolved by the auth interceptor, so the server is only looked up once the interceptors ran.
+func RegisterTenantService[S any](registrar grpc.ServiceRegistrar, desc *grpc.ServiceDesc, tenants *Tenants[S]) {
+	serviceType := reflect.TypeOf(desc.HandlerType).Elem()
+	if !reflect.TypeOf((*S)(nil)).Elem().Implements(serviceType) {
+		panic(fmt.Sprintf("tenant servers of %s don't implement %v", desc.ServiceName, serviceType))
+	}
+
+	routed := *desc
+	routed.Methods = make([]grpc.MethodDesc, len(desc.Methods))
+	for i, method := range desc.Methods {
+		routed.Methods[i] = grpc.MethodDesc{
+			MethodName: method.MethodName,
+			Handler:    tenantUnaryHandler(desc.ServiceName, method.MethodName, serviceType, tenants),
+		}
+	}
+	routed.Streams = make([]grpc.StreamDesc, len(desc.Streams))
+	for i, stream := range desc.Streams {
+		routed.Streams[i] = stream
+		routed.Streams[i].Handler = tenantStreamHandler(stream.Handler, tenants)
+	}
+
+	// the handlers ignore the registered server, it only differs per call
+	registrar.RegisterService(&routed, nil)
+}
+
+// tenantUnaryHandler decodes the request, runs the interceptor, then calls the method on the server of the tenant.
+// The generated handler cannot be reused, as it needs the server before running the interceptor.
+func tenantUnaryHandler[S any](
+	serviceName string,
+	methodName string,
+	serviceType reflect.Type,
+	tenants *Tenants[S],
+) func(interface{}, context.Context, func(interface{}) error, grpc.UnaryServerInterceptor) (interface{}, error) {
+	methodType, _ := serviceType.MethodByName(methodName)
+	requestType := methodType.Type.In(1).Elem()
+	info := &grpc.UnaryServerInfo{FullMethod: "/" + serviceName + "/" + methodName}
+
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		server, err := tenants.For(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		results := reflect.ValueOf(server).MethodByName(methodName).Call([]reflect.Value{
+			reflect.ValueOf(ctx),
+			reflect.ValueOf(req),
+		})
+		err, _ = results[1].Interface().(error)
+		return results[0].Interface(), err
+	}
+
+	return func(_ interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+		req := reflect.New(requestType).Interface()
+		if err := dec(req); err != nil {
+			return nil, err
+		}
+		if interceptor == nil {
+			return handler(ctx, req)
+		}
+		return interceptor(ctx, req, info, handler)
+	}
+}
+
+// tenantStreamHandler calls the generated handler with the server of the tenant.
+// Stream interceptors run before it, with the stream whose context carries the tenant.
+func tenantStreamHandler[S any](handler grpc.StreamHandler, tenants *Tenants[S]) grpc.StreamHandler {
+	return func(_ interface{}, stream grpc.ServerStream) error {
+		server, err := tenants.For(stream.Context())
+		if err != nil {
+			return err
+		}
+		return handler(server, stream)
+	}
+}
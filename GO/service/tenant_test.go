@@ -0,0 +1,168 @@
+package service_test
+
+import (
+	"context"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"pcbook/client"
+	"pcbook/sample"
+	"pcbook/service"
+	"testing"
+	"time"
+
+	pb "pcbook/generateProto"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestTenantIsolation(t *testing.T) {
+	t.Parallel()
+
+	imageFolder := t.TempDir()
+	serverAddress := startTestServer(t, withTenants(imageFolder, map[string][]*service.User{
+		"acme":   {newTestUser(t, "alice", service.VendorRole)},
+		"globex": {newTestUser(t, "bob", service.VendorRole)},
+	}))
+	conn, err := grpc.Dial(serverAddress, grpc.WithInsecure())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	authClient := pb.NewAuthServiceClient(conn)
+	laptopClient := pb.NewLaptopServiceClient(conn)
+
+	login := func(tenantID string, userName string) (context.Context, error) {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), "x-tenant-id", tenantID)
+		res, err := authClient.Login(ctx, &pb.LoginRequest{Username: userName, Password: userName + "-password"})
+		if err != nil {
+			return nil, err
+		}
+		// the token is bound to its tenant, the header isn't needed anymore
+		return metadata.AppendToOutgoingContext(context.Background(), "authorization", res.GetAccessToken()), nil
+	}
+
+	alice, err := login("acme", "alice")
+	require.NoError(t, err)
+	bob, err := login("globex", "bob")
+	require.NoError(t, err)
+
+	_, err = login("globex", "alice")
+	require.Equal(t, codes.NotFound, status.Code(err))
+	require.Contains(t, status.Convert(err).Message(), "invalid username or password")
+
+	_, err = login("initech", "alice")
+	require.Equal(t, codes.NotFound, status.Code(err))
+	require.Contains(t, status.Convert(err).Message(), "tenant initech doesn't exist")
+
+	laptop := sample.NewLaptop()
+	_, err = laptopClient.CreateLaptop(alice, &pb.CreateLaptopRequest{Laptop: laptop})
+	require.NoError(t, err)
+	_, err = uploadTestImageAs(alice, laptopClient, laptop.Id, []byte("acme image"))
+	require.NoError(t, err)
+
+	_, err = laptopClient.GetRatingSummary(alice, &pb.GetRatingSummaryRequest{LaptopId: laptop.Id})
+	require.NoError(t, err)
+
+	// knowing the laptop id doesn't give access to it from another tenant
+	_, err = laptopClient.GetRatingSummary(bob, &pb.GetRatingSummaryRequest{LaptopId: laptop.Id})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = uploadTestImageAs(bob, laptopClient, laptop.Id, []byte("globex image"))
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	stream, err := laptopClient.SearchLaptop(bob, &pb.SearchLaptopRequest{
+		Filter: &pb.Filter{MaxPriceUsd: math.MaxFloat64},
+	})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+
+	_, err = laptopClient.GetLaptop(bob, &pb.GetLaptopRequest{Id: laptop.Id})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// anonymous callers can only name a tenant to log in, their public reads stay in the default tenant
+	anonymous := metadata.AppendToOutgoingContext(context.Background(), "x-tenant-id", "acme")
+	_, err = laptopClient.GetLaptop(anonymous, &pb.GetLaptopRequest{Id: laptop.Id})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	stream, err = laptopClient.SearchLaptop(anonymous, &pb.SearchLaptopRequest{
+		Filter: &pb.Filter{MaxPriceUsd: math.MaxFloat64},
+	})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	_, err = laptopClient.GetLaptop(context.Background(), &pb.GetLaptopRequest{Id: laptop.Id})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// the credentials of a tenant cannot be used for another one
+	_, err = laptopClient.GetRatingSummary(
+		metadata.AppendToOutgoingContext(alice, "x-tenant-id", "globex"),
+		&pb.GetRatingSummaryRequest{LaptopId: laptop.Id},
+	)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	acmeImages, err := os.ReadDir(filepath.Join(imageFolder, "acme"))
+	require.NoError(t, err)
+	require.Len(t, acmeImages, 1)
+
+	_, err = os.Stat(filepath.Join(imageFolder, "globex"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestTenantCredentials(t *testing.T) {
+	t.Parallel()
+
+	serverAddress := startTestServer(t, withTenants(t.TempDir(), map[string][]*service.User{
+		service.DefaultTenant: {newTestUser(t, "alice", service.UserRole)},
+		"acme":                {newTestUser(t, "alice", service.AdminRole)},
+	}))
+
+	loginRole := func(options ...grpc.DialOption) string {
+		conn, err := grpc.Dial(serverAddress, append(options, grpc.WithInsecure())...)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		tokens, err := client.NewAuthClient(conn).Login(context.Background(), "alice", "alice-password")
+		require.NoError(t, err)
+
+		claims, err := service.NewJWTManager(testSecretKey, time.Minute).VerifyToken(tokens.AccessToken)
+		require.NoError(t, err)
+		return claims.TenantID + "/" + claims.Role
+	}
+
+	require.Equal(t, "default/user", loginRole())
+	require.Equal(t, "acme/admin", loginRole(grpc.WithPerRPCCredentials(client.NewTenantCredentials("acme"))))
+}
+
+func TestAPIKeyStoreTenants(t *testing.T) {
+	t.Parallel()
+
+	store := service.NewInMemoryAPIKeyStore()
+	err := store.Save(&service.APIKey{ID: "key1", TenantID: "acme", Name: "inventory", Hash: "hash1"})
+	require.NoError(t, err)
+
+	keys, err := store.List("acme")
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+
+	keys, err = store.List("globex")
+	require.NoError(t, err)
+	require.Empty(t, keys)
+
+	err = store.Delete("globex", "key1")
+	require.ErrorIs(t, err, service.ErrAPIKeyNotFound)
+
+	err = store.Delete("acme", "key1")
+	require.NoError(t, err)
+}
+
+func newTestUser(t *testing.T, userName string, role string) *service.User {
+	user, err := service.NewUser(userName, userName+"-password", role)
+	require.NoError(t, err)
+	return user
+}
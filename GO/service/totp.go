@@ -0,0 +1,200 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TOTP parameters of RFC 6238, the defaults of authenticator apps.
+const (
+	totpDigits     = 6
+	totpPeriod     = 30 * time.Second
+	totpSecretSize = 20
+	// codes of the previous and next periods are accepted too, for clocks that drift
+	totpSkew = 1
+
+	recoveryCodeCount = 10
+	// 80 random bits, too many to brute force from a leaked hash
+	recoveryCodeSize = 10
+	totpIssuer       = "pcbook"
+
+	otpChallengeDuration    = 5 * time.Minute
+	maxOTPChallengeAttempts = 5
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newTOTPSecret returns a random secret shared with the authenticator app of a user.
+func newTOTPSecret() ([]byte, error) {
+	secret := make([]byte, totpSecretSize)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// totpCounter returns the number of the period containing t.
+func totpCounter(t time.Time) uint64 {
+	return uint64(t.Unix() / int64(totpPeriod/time.Second))
+}
+
+// hotpCode computes the RFC 4226 one-time password of the counter.
+func hotpCode(secret []byte, counter uint64) string {
+	message := make([]byte, 8)
+	binary.BigEndian.PutUint64(message, counter)
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(message)
+	sum := mac.Sum(nil)
+
+	// dynamic truncation
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	modulo := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		modulo *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%modulo)
+}
+
+// verifyTOTP returns the counter of the period whose code matches, if any.
+// Codes of periods up to lastCounter are rejected, so that a code cannot be replayed.
+func verifyTOTP(secret []byte, code string, now time.Time, lastCounter uint64) (uint64, bool) {
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := totpCounter(now)
+	for delta := -totpSkew; delta <= totpSkew; delta++ {
+		counter := current + uint64(delta)
+		if counter <= lastCounter {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(hotpCode(secret, counter)), []byte(code)) == 1 {
+			return counter, true
+		}
+	}
+	return 0, false
+}
+
+// totpURI returns the otpauth URI that authenticator apps read from a QR code.
+func totpURI(account string, secret []byte) string {
+	query := url.Values{}
+	query.Set("secret", totpEncoding.EncodeToString(secret))
+	query.Set("issuer", totpIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(int(totpPeriod/time.Second)))
+
+	uri := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + totpIssuer + ":" + account,
+		RawQuery: query.Encode(),
+	}
+	return uri.String()
+}
+
+// newRecoveryCodes returns one-time codes that replace the authenticator app if it is lost,
+// and the hashes of the codes to keep in the user store.
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		data := make([]byte, recoveryCodeSize)
+		_, err := rand.Read(data)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// 16 characters, read in groups of 4
+		code := strings.ToLower(totpEncoding.EncodeToString(data))
+		codes[i] = code[:4] + "-" + code[4:8] + "-" + code[8:12] + "-" + code[12:]
+		hashes[i] = hashAPIKey(codes[i])
+	}
+	return codes, hashes, nil
+}
+
+// otpChallenge is a login whose password was correct, waiting for the one-time password.
+type otpChallenge struct {
+	userName  string
+	expiresAt time.Time
+	attempts  int
+}
+
+// otpChallenges holds the pending challenges by the hash of their token.
+type otpChallenges struct {
+	mutex      sync.Mutex
+	challenges map[string]*otpChallenge
+}
+
+func newOTPChallenges() *otpChallenges {
+	return &otpChallenges{
+		challenges: make(map[string]*otpChallenge),
+	}
+}
+
+// issue returns the token of a new challenge for the user.
+func (c *otpChallenges) issue(userName string, now time.Time) (string, error) {
+	token, hash, err := newRefreshToken()
+	if err != nil {
+		return "", err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for hash, challenge := range c.challenges {
+		if !now.Before(challenge.expiresAt) {
+			delete(c.challenges, hash)
+		}
+	}
+
+	c.challenges[hash] = &otpChallenge{
+		userName:  userName,
+		expiresAt: now.Add(otpChallengeDuration),
+	}
+	return token, nil
+}
+
+// attempt returns the user of a valid challenge and counts the attempt.
+// The challenge is dropped once it expires or runs out of attempts.
+func (c *otpChallenges) attempt(token string, now time.Time) (string, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	hash := hashRefreshToken(token)
+	challenge := c.challenges[hash]
+	if challenge == nil {
+		return "", false
+	}
+	if !now.Before(challenge.expiresAt) {
+		delete(c.challenges, hash)
+		return "", false
+	}
+
+	challenge.attempts++
+	if challenge.attempts >= maxOTPChallengeAttempts {
+		delete(c.challenges, hash)
+	}
+	return challenge.userName, true
+}
+
+// complete drops the challenge once it has been answered.
+func (c *otpChallenges) complete(token string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.challenges, hashRefreshToken(token))
+}
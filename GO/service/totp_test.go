@@ -0,0 +1,95 @@
+package service_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"pcbook/service"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserVerifyTOTP(t *testing.T) {
+	t.Parallel()
+
+	// test vectors of RFC 6238, truncated to 6 digits
+	vectors := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+
+	for _, vector := range vectors {
+		user := &service.User{TOTPSecret: []byte("12345678901234567890")}
+		now := time.Unix(vector.unix, 0)
+
+		require.True(t, user.VerifyTOTP(vector.code, now), "code at %d", vector.unix)
+		// a code is only accepted once
+		require.False(t, user.VerifyTOTP(vector.code, now))
+	}
+
+	user := &service.User{TOTPSecret: []byte("12345678901234567890")}
+	require.True(t, user.VerifyTOTP("287082", time.Unix(59+30, 0)), "the code of the previous period is accepted")
+	require.False(t, user.VerifyTOTP("287082", time.Unix(59+60, 0)), "older codes are rejected")
+	require.False(t, user.VerifyTOTP("28708", time.Unix(59, 0)))
+	require.False(t, (&service.User{}).VerifyTOTP("287082", time.Unix(59, 0)))
+}
+
+// testTOTPCode returns the one-time password of the base32 encoded secret, as an authenticator app does.
+func testTOTPCode(t *testing.T, secret string, now time.Time) string {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	require.NoError(t, err)
+
+	message := make([]byte, 8)
+	binary.BigEndian.PutUint64(message, uint64(now.Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(message)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+func requireTOTPURI(t *testing.T, uri string, account string, secret string) {
+	parsed, err := url.Parse(uri)
+	require.NoError(t, err)
+	require.Equal(t, "otpauth", parsed.Scheme)
+	require.Equal(t, "totp", parsed.Host)
+	require.Equal(t, "/pcbook:"+account, parsed.Path)
+	require.Equal(t, secret, parsed.Query().Get("secret"))
+	require.Equal(t, "pcbook", parsed.Query().Get("issuer"))
+}
+
+// testClock is a clock that tests move forward.
+type testClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func newTestClock(now time.Time) *testClock {
+	return &testClock{now: now}
+}
+
+func (clock *testClock) Now() time.Time {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	return clock.now
+}
+
+func (clock *testClock) Advance(d time.Duration) {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	clock.now = clock.now.Add(d)
+}
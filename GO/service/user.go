@@ -1,15 +1,35 @@
 package service
 
 import (
+	"crypto/subtle"
 	"fmt"
+	"strings"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
+const (
+	AdminRole  = "admin"
+	UserRole   = "user"
+	VendorRole = "vendor"
+)
+
 type User struct {
 	UserName       string
 	HashedPassword string
 	Role           string
+	// TOTPSecret is required at login, with TOTPEnabled, once an enrolment is confirmed
+	TOTPSecret  []byte
+	TOTPEnabled bool
+	// TOTPCounter is the period of the last accepted one-time password, which cannot be used again
+	TOTPCounter uint64
+	// RecoveryCodeHashes are the hashes of the recovery codes that haven't been used yet
+	RecoveryCodeHashes []string
+	// PendingTOTPSecret and PendingRecoveryCodeHashes are enrolled but not confirmed yet,
+	// the current secret and recovery codes stay required until they are
+	PendingTOTPSecret         []byte
+	PendingRecoveryCodeHashes []string
 }
 
 func NewUser(userName string, password string, role string) (*User, error) {
@@ -32,8 +52,77 @@ func (user *User) IsCorrectPassword(password string) bool {
 
 func (user *User) Clone() *User {
 	return &User{
-		UserName:       user.UserName,
-		HashedPassword: user.HashedPassword,
-		Role:           user.Role,
+		UserName:           user.UserName,
+		HashedPassword:     user.HashedPassword,
+		Role:               user.Role,
+		TOTPSecret:         append([]byte(nil), user.TOTPSecret...),
+		TOTPEnabled:        user.TOTPEnabled,
+		TOTPCounter:        user.TOTPCounter,
+		RecoveryCodeHashes: append([]string(nil), user.RecoveryCodeHashes...),
+
+		PendingTOTPSecret:         append([]byte(nil), user.PendingTOTPSecret...),
+		PendingRecoveryCodeHashes: append([]string(nil), user.PendingRecoveryCodeHashes...),
+	}
+}
+
+// VerifyTOTP reports whether the code is the one-time password of the user at the given time.
+// The code and the earlier ones are used up, the user must be saved for that to last.
+func (user *User) VerifyTOTP(code string, now time.Time) bool {
+	if len(user.TOTPSecret) == 0 {
+		return false
+	}
+
+	counter, ok := verifyTOTP(user.TOTPSecret, code, now, user.TOTPCounter)
+	if !ok {
+		return false
+	}
+	user.TOTPCounter = counter
+	return true
+}
+
+// ConfirmTOTP reports whether the code is the one-time password of the pending secret at the given time.
+// The pending secret and recovery codes then replace the current ones.
+func (user *User) ConfirmTOTP(code string, now time.Time) bool {
+	if len(user.PendingTOTPSecret) == 0 {
+		return false
+	}
+
+	counter, ok := verifyTOTP(user.PendingTOTPSecret, code, now, 0)
+	if !ok {
+		return false
+	}
+	user.TOTPSecret = user.PendingTOTPSecret
+	user.TOTPEnabled = true
+	user.TOTPCounter = counter
+	user.RecoveryCodeHashes = user.PendingRecoveryCodeHashes
+	user.PendingTOTPSecret = nil
+	user.PendingRecoveryCodeHashes = nil
+	return true
+}
+
+// VerifyOTP is VerifyTOTP also accepting a recovery code, which is then removed.
+func (user *User) VerifyOTP(code string, now time.Time) bool {
+	if user.VerifyTOTP(code, now) {
+		return true
+	}
+
+	hash := hashAPIKey(strings.ToLower(strings.TrimSpace(code)))
+	for i, recoveryCodeHash := range user.RecoveryCodeHashes {
+		if subtle.ConstantTimeCompare([]byte(recoveryCodeHash), []byte(hash)) == 1 {
+			user.RecoveryCodeHashes = append(user.RecoveryCodeHashes[:i:i], user.RecoveryCodeHashes[i+1:]...)
+			return true
+		}
 	}
+	return false
+}
+
+// SetPassword replaces the password of the user with a hash of the new one.
+func (user *User) SetPassword(password string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("cannot hash password: %w", err)
+	}
+
+	user.HashedPassword = string(hashedPassword)
+	return nil
 }
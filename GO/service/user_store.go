@@ -1,13 +1,25 @@
 package service
 
 import (
+	"errors"
 	"fmt"
+	"sort"
 	"sync"
 )
 
+var (
+	ErrUserAlreadyExists = errors.New("user already exists")
+	ErrUserNotFound      = errors.New("user not found")
+)
+
 type UserStore interface {
 	Save(user *User) error
 	Find(userName string) (*User, error)
+	// Modify applies modify to the stored user atomically, so that concurrent changes of the user aren't lost
+	// and a one-time password is used up once. The changes are saved and the user returned only if modify returns nil.
+	Modify(userName string, modify func(user *User) error) (*User, error)
+	Delete(userName string) error
+	List() ([]*User, error)
 }
 
 type InMemoryUserStore struct {
@@ -26,10 +38,10 @@ func (store *InMemoryUserStore) Save(user *User) error {
 	defer store.mutex.Unlock()
 
 	if store.users[user.UserName] != nil {
-		return fmt.Errorf("user %s already exists", user.UserName)
+		return fmt.Errorf("user %s: %w", user.UserName, ErrUserAlreadyExists)
 	}
 
-	store.users[user.UserName] = user
+	store.users[user.UserName] = user.Clone()
 	// log.Printf("user %s saved", user.UserName)
 	return nil
 }
@@ -40,8 +52,55 @@ func (store *InMemoryUserStore) Find(userName string) (*User, error) {
 
 	user := store.users[userName]
 	if user == nil {
-		return nil, fmt.Errorf("user %s not found", userName)
+		return nil, fmt.Errorf("user %s: %w", userName, ErrUserNotFound)
+	}
+
+	return user.Clone(), nil
+}
+
+func (store *InMemoryUserStore) Modify(userName string, modify func(user *User) error) (*User, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	stored := store.users[userName]
+	if stored == nil {
+		return nil, fmt.Errorf("user %s: %w", userName, ErrUserNotFound)
 	}
 
+	user := stored.Clone()
+	err := modify(user)
+	if err != nil {
+		return nil, err
+	}
+
+	store.users[userName] = user
 	return user.Clone(), nil
 }
+
+func (store *InMemoryUserStore) Delete(userName string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.users[userName] == nil {
+		return fmt.Errorf("user %s: %w", userName, ErrUserNotFound)
+	}
+
+	delete(store.users, userName)
+	return nil
+}
+
+func (store *InMemoryUserStore) List() ([]*User, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	users := make([]*User, 0, len(store.users))
+	for _, user := range store.users {
+		users = append(users, user.Clone())
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].UserName < users[j].UserName
+	})
+
+	return users, nil
+}